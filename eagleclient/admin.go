@@ -0,0 +1,205 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"github.com/duyanghao/eagle/pkg/utils/process"
+	"github.com/duyanghao/eagle/pkg/utils/ratelimiter"
+	distdigests "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInProgress is returned when evicting a layer being downloaded.
+var ErrInProgress = errors.New("layer is being downloaded")
+
+// ErrInUse is returned when evicting a layer being served.
+var ErrInUse = errors.New("layer is being served")
+
+// CacheEntry describes a layer in cache.
+type CacheEntry struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	Completed bool   `json:"completed"`
+	Pinned    bool   `json:"pinned"`
+	InUse     int    `json:"inUse"` // responses being served from the layer
+	Seeding   bool   `json:"seeding"`
+}
+
+// Download describes a layer being downloaded.
+type Download struct {
+	ID          string            `json:"id"`
+	InfoHash    string            `json:"infoHash"`
+	Total       int64             `json:"total"`
+	Completed   int64             `json:"completed"`
+	ActivePeers int               `json:"activePeers"`
+	TotalPeers  int               `json:"totalPeers"`
+	Peers       []string          `json:"peers"` // addresses of known peers
+	Progress    *process.Progress `json:"progress,omitempty"`
+}
+
+// CacheEntries returns layers in cache from the most recently used to the
+// least, followed by layers being downloaded.
+func (e *BtEngine) CacheEntries() []CacheEntry {
+	var entries []CacheEntry
+	for _, id := range e.lruCache.Keys() {
+		entry, exist := e.lruCache.Peek(id)
+		if !exist {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			ID:        id,
+			Size:      entry.Size,
+			Completed: entry.Completed,
+			Pinned:    entry.Pinned,
+			InUse:     entry.InUse,
+			Seeding:   entry.Completed && e.getTorrent(id) != nil,
+		})
+	}
+	return entries
+}
+
+// Downloads returns layers being downloaded with their progress and peers.
+func (e *BtEngine) Downloads() []Download {
+	progress := make(map[string]process.Progress)
+	for _, p := range e.progress.Active() {
+		progress[p.ID] = p
+	}
+	e.RLock()
+	defer e.RUnlock()
+	var downloads []Download
+	for id, tt := range e.idInfos {
+		if tt.Info() != nil && tt.BytesMissing() == 0 {
+			continue
+		}
+		stats := tt.Stats()
+		d := Download{
+			ID:          id,
+			InfoHash:    tt.InfoHash().HexString(),
+			ActivePeers: stats.ActivePeers,
+			TotalPeers:  stats.TotalPeers,
+		}
+		if tt.Info() != nil {
+			d.Total = tt.Length()
+			d.Completed = tt.BytesCompleted()
+		}
+		for _, p := range tt.KnownSwarm() {
+			if p.Addr != nil {
+				d.Peers = append(d.Peers, p.Addr.String())
+			}
+		}
+		if p, ok := progress[id]; ok {
+			d.Progress = &p
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads
+}
+
+// Evict removes completed layer id from cache.
+func (e *BtEngine) Evict(id string) error {
+	entry, exist := e.lruCache.Peek(id)
+	if !exist {
+		return backenderrors.New(backenderrors.ErrBlobNotFound, id, nil)
+	}
+	if !entry.Completed {
+		return ErrInProgress
+	}
+	if entry.InUse > 0 {
+		return ErrInUse
+	}
+	log.Infof("Evict layer %s on request", id)
+	// evicting from lruCache drops torrent and removes files as well
+	e.lruCache.Remove(id)
+	e.indexChanged()
+	return nil
+}
+
+// Pin keeps layer id in cache until it is unpinned.
+func (e *BtEngine) Pin(id string) error {
+	if !e.lruCache.Pin(id) {
+		return backenderrors.New(backenderrors.ErrBlobNotFound, id, nil)
+	}
+	log.Infof("Pin layer %s", id)
+	e.indexChanged()
+	return nil
+}
+
+// Unpin makes layer id evictable again.
+func (e *BtEngine) Unpin(id string) error {
+	if !e.lruCache.Unpin(id) {
+		return backenderrors.New(backenderrors.ErrBlobNotFound, id, nil)
+	}
+	log.Infof("Unpin layer %s", id)
+	e.indexChanged()
+	return nil
+}
+
+// Bandwidth describes bandwidth limits of p2p client.
+type Bandwidth struct {
+	Current    ratelimiter.Limits `json:"current"`
+	Scheduled  ratelimiter.Limits `json:"scheduled"`
+	Overridden bool               `json:"overridden"`
+	Until      *time.Time         `json:"until,omitempty"` // expiry of override
+}
+
+// Bandwidth returns bandwidth limits in effect and those of schedule.
+func (e *BtEngine) Bandwidth() Bandwidth {
+	current, overridden, until := e.bandwidth.Limits()
+	b := Bandwidth{
+		Current:    current,
+		Scheduled:  e.bandwidth.Scheduled(time.Now()),
+		Overridden: overridden,
+	}
+	if !until.IsZero() {
+		b.Until = &until
+	}
+	return b
+}
+
+// SetBandwidth overrides scheduled bandwidth limits for d, or until reset
+// if d is zero. Zero limit keeps the scheduled one.
+func (e *BtEngine) SetBandwidth(limits ratelimiter.Limits, d time.Duration) {
+	log.Infof("Override bandwidth limits with %+v for %v", limits, d)
+	e.bandwidth.Override(limits, d)
+}
+
+// ResetBandwidth goes back to scheduled bandwidth limits.
+func (e *BtEngine) ResetBandwidth() {
+	log.Infof("Reset bandwidth limits to schedule")
+	e.bandwidth.Reset()
+}
+
+// PrefetchLayer downloads layer digest of repository into cache, as if it
+// was pulled by docker.
+func (e *BtEngine) PrefetchLayer(repository, digest string) error {
+	if repository == "" {
+		return errors.New("repository is required")
+	}
+	if _, err := distdigests.Parse(digest); err != nil {
+		return fmt.Errorf("invalid digest %q: %v", digest, err)
+	}
+	blobUrl := fmt.Sprintf("/v2/%s/blobs/%s", repository, digest)
+	req, err := http.NewRequest(http.MethodGet, blobUrl, nil)
+	if err != nil {
+		return err
+	}
+	_, err = e.downloadLayerSync(req, blobUrl)
+	return err
+}
@@ -11,19 +11,9 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-package process
+package eagleclient
 
-import (
-	"io"
-
-	pb "gopkg.in/cheggaaa/pb.v1"
-)
-
-func NewProgressBar(total int, w io.Writer) *pb.ProgressBar {
-	bar := pb.New(total).SetUnits(pb.U_BYTES)
-	bar.Output = w
-	bar.SetMaxWidth(80)
-	bar.ShowTimeLeft = false
-	bar.ShowPercent = false
-	return bar
+// diskFree returns -1 as free space of file system is unknown on windows.
+func diskFree(dir string) int64 {
+	return -1
 }
@@ -16,14 +16,16 @@ package eagleclient
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"github.com/duyanghao/eagle/pkg/scrubber"
 	"github.com/duyanghao/eagle/pkg/utils/lrucache"
 	"github.com/duyanghao/eagle/pkg/utils/process"
-	"io/ioutil"
+	"github.com/duyanghao/eagle/pkg/utils/ratelimiter"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -31,7 +33,10 @@ import (
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
 	"github.com/duyanghao/eagle/pkg/constants"
+	"github.com/duyanghao/eagle/pkg/locality"
+	"github.com/duyanghao/eagle/pkg/peerauth"
 	pb "github.com/duyanghao/eagle/proto/metainfo"
 	distdigests "github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
@@ -45,7 +50,35 @@ type Config struct {
 	UploadRateLimit   int64
 	DownloadRateLimit int64
 	CacheLimitSize    int64
-	DownloadTimeout   time.Duration
+	Stall             StallConfig
+	ScrubInterval     time.Duration
+	ScrubRateLimit    int64
+	StreamReadahead   int64
+	Locality          *locality.Config
+	LANDiscovery      *LANDiscoveryConfig
+	// layers downloaded at a time when prefetching image
+	PrefetchConcurrency int
+	// cache directories with their own size limits, root directory with
+	// CacheLimitSize if not set
+	Roots []CacheRoot
+	// placement of new layers among Roots, PlacementFreeSpace by default
+	Placement string
+	// layers not accessed for MaxAge are expired if it is positive, and
+	// layers are never evicted within MinResidency after downloaded
+	MaxAge       time.Duration
+	MinResidency time.Duration
+	// images whose config and layers are prefetched and pinned in cache
+	PinnedImages []string
+	// windows of time with their own bandwidth limits instead of
+	// UploadRateLimit and DownloadRateLimit
+	BandwidthSchedule []ratelimiter.Window
+	// policy of stopping seeding cached layers, seeding until eviction if nil
+	Seeding *SeedingPolicy
+	// authentication of peers, shared with seeder, disabled if nil
+	PeerAuth *peerauth.Config
+	// registry host[:port] which Seeder fetches blobs from, prefetched
+	// images are resolved against it
+	Origin string
 }
 
 type idInfo struct {
@@ -66,14 +99,26 @@ type BtEngine struct {
 	rootDir        string
 	trackers       []string
 	seeders        []string
-
-	torrentDir string
-	dataDir    string
+	topology       *locality.Topology
+	lsd            *lsd
+	progress       *process.Reporter
+	registryClient *http.Client
+	indexDirty     chan struct{}
+	bandwidth      *ratelimiter.Scheduler
+	retention      *retention
+	peerSocket     *peerauth.Socket
+
+	torrentWaits map[string][]chan *torrent.Torrent // image ID -> waiters of its torrent
+
+	rejectedLock sync.Mutex
+	rejected     map[string]rejection // layer id -> digest mismatch found recently
+
+	roots      []*cacheRoot
+	rootsLock  sync.Mutex
+	layerRoots map[string]*cacheRoot // layer id -> cache root
 }
 
 func NewBtEngine(root string, trackers, seeders []string, c *Config) *BtEngine {
-	dataDir := path.Join(root, "data")
-	torrentDir := path.Join(root, "torrents")
 	if c == nil {
 		c = &Config{
 			EnableUpload:      true,
@@ -83,48 +128,139 @@ func NewBtEngine(root string, trackers, seeders []string, c *Config) *BtEngine {
 			DownloadRateLimit: constants.DefaultDownloadRateLimit,
 		}
 	}
+	if len(c.Roots) == 0 {
+		c.Roots = []CacheRoot{{Dir: root, LimitSize: c.CacheLimitSize}}
+	}
+	if c.StreamReadahead <= 0 {
+		c.StreamReadahead = constants.DefaultStreamReadahead
+	}
+	if c.PrefetchConcurrency <= 0 {
+		c.PrefetchConcurrency = constants.DefaultPrefetchConcurrency
+	}
+	if c.Stall.StallTimeout <= 0 {
+		c.Stall.StallTimeout = constants.DefaultStallTimeout
+	}
+	if c.Stall.MinThroughput > 0 && c.Stall.ThroughputWindow <= 0 {
+		c.Stall.ThroughputWindow = constants.DefaultThroughputWindow
+	}
+	progress := process.NewReporter()
+	progress.Subscribe(process.NewLogListener(constants.DefaultProgressLogInterval))
 	return &BtEngine{
-		rootDir:    root,
+		rootDir:    c.Roots[0].Dir,
 		trackers:   trackers,
 		seeders:    seeders,
-		dataDir:    dataDir,
-		torrentDir: torrentDir,
+		roots:      newCacheRoots(c.Roots),
+		layerRoots: make(map[string]*cacheRoot),
 		config:     c,
 		idInfos:    make(map[string]*torrent.Torrent),
+		progress:   progress,
+		indexDirty: make(chan struct{}, 1),
+		registryClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
 	}
 }
 
+// Progress returns reporter of download progress, which listeners can subscribe to.
+func (e *BtEngine) Progress() *process.Reporter {
+	return e.progress
+}
+
 func (e *BtEngine) Run() error {
 	// create torrent client
-	if err := os.MkdirAll(e.dataDir, 0700); err != nil && !os.IsExist(err) {
-		return nil
-	}
-	if err := os.MkdirAll(e.torrentDir, 0700); err != nil && !os.IsExist(err) {
-		return nil
+	for _, r := range e.roots {
+		if err := os.MkdirAll(r.dataDir, 0700); err != nil && !os.IsExist(err) {
+			return nil
+		}
+		if err := os.MkdirAll(r.torrentDir, 0700); err != nil && !os.IsExist(err) {
+			return nil
+		}
 	}
 
 	if e.client != nil {
 		e.client.Close()
+		if e.peerSocket != nil {
+			e.peerSocket.Close()
+		}
 		time.Sleep(1 * time.Second)
 	}
+	// each cache root keeps data and piece completion of its layers
+	for _, r := range e.roots {
+		if r.storage != nil {
+			r.storage.Close()
+		}
+		r.storage = storage.NewFile(r.dataDir)
+	}
 
 	c := e.config
 	if c.IncomingPort <= 0 {
 		return fmt.Errorf("Invalid incoming port (%d)", c.IncomingPort)
 	}
 	tc := torrent.NewDefaultClientConfig()
-	tc.DataDir = e.dataDir
+	tc.DataDir = e.roots[0].dataDir
+	tc.DefaultStorage = e.roots[0].storage
 	tc.NoUpload = !c.EnableUpload
 	tc.Seed = c.EnableSeeding
 	tc.DisableUTP = true
 	tc.ListenPort = c.IncomingPort
 	tc.UploadRateLimiter = rate.NewLimiter(rate.Limit(c.UploadRateLimit), constants.DefaultRateLimitBurst)
 	tc.DownloadRateLimiter = rate.NewLimiter(rate.Limit(c.DownloadRateLimit), constants.DefaultRateLimitBurst)
+	// limits of live limiters follow schedule and runtime changes
+	if e.bandwidth != nil {
+		e.bandwidth.Stop()
+	}
+	e.bandwidth = ratelimiter.NewScheduler(tc.UploadRateLimiter, tc.DownloadRateLimiter,
+		ratelimiter.Limits{Upload: c.UploadRateLimit, Download: c.DownloadRateLimit}, c.BandwidthSchedule)
+	e.bandwidth.Start()
+	if c.Locality != nil && len(c.Locality.Subnets) > 0 {
+		topology, err := locality.New(c.Locality)
+		if err != nil {
+			return err
+		}
+		e.topology = topology
+		log.Infof("Enable locality-aware peer selection, labels of local node: %+v", topology.Self())
+		// peers are learned from own announcer, which ranks them by locality
+		tc.DisableTrackers = true
+		tc.NoDHT = true
+		// peers exchanged are not ranked, so don't exchange them if cross IDC peers are limited
+		tc.DisablePEX = c.Locality.MaxCrossIDCPeers > 0
+		if tc.DisablePEX {
+			log.Infof("Disable PEX since cross IDC peers are limited to %d", c.Locality.MaxCrossIDCPeers)
+		}
+	}
+	if c.PeerAuth != nil {
+		// peers are only served through authenticated socket
+		peerauth.Apply(tc)
+	}
 	client, err := torrent.NewClient(tc)
 	if err != nil {
 		return err
 	}
 	e.client = client
+	if c.PeerAuth != nil {
+		if e.peerSocket, err = peerauth.Listen(client, c.PeerAuth, c.IncomingPort); err != nil {
+			log.Errorf("Listen for authenticated peers failed: %v", err)
+			return err
+		}
+	}
+
+	// report progress of downloads to metrics
+	e.progress.PublishExpvar("eagleclient_downloads")
+
+	// find peers of LAN in case trackers are down
+	if c.LANDiscovery.enabled() && e.lsd == nil {
+		if c.LANDiscovery.Interval <= 0 {
+			c.LANDiscovery.Interval = constants.DefaultLSDInterval
+		}
+		e.lsd, err = e.startLSD(*c.LANDiscovery)
+		if err != nil {
+			return err
+		}
+	}
 
 	// create metainfo client
 	e.metaInfoClient, err = e.newMetaInfoClient()
@@ -133,59 +269,169 @@ func (e *BtEngine) Run() error {
 	}
 
 	// create lruCache
-	e.lruCache, err = lrucache.NewLRU(c.CacheLimitSize, e.DeleteTorrent)
+	var limitSize int64
+	rootLimits := make(map[string]int64)
+	for _, r := range e.roots {
+		limitSize += r.LimitSize
+		rootLimits[r.Dir] = r.LimitSize
+	}
+	e.lruCache, err = lrucache.NewLRU(limitSize, e.DeleteTorrent)
 	if err != nil {
 		log.Errorf("Create lruCache for p2p client failed, %v", err)
 		return err
 	}
+	// account layers per cache root
+	e.lruCache.SetGroups(e.cacheGroup, rootLimits)
+	e.lruCache.SetPolicy(c.MaxAge, c.MinResidency)
 
-	files, err := ioutil.ReadDir(e.dataDir)
+	files, err := e.scanLayers()
 	if err != nil {
 		return err
 	}
 
+	// restore recency and pins of cached layers from index, reconciling it
+	// with layers on disk
+	index := e.loadIndex()
+	onDisk := make(map[string]bool)
 	for _, f := range files {
-		go func(f os.FileInfo) {
-			if filepath.Ext(f.Name()) != ".layer" {
-				return
-			}
-			ss := strings.Split(f.Name(), ".")
-			if len(ss) != 2 {
-				log.Errorf("Found invalid layer file %s", f.Name())
-				return
+		onDisk[strings.TrimSuffix(f.Name(), ".layer")] = true
+	}
+	for id := range index {
+		if !onDisk[id] {
+			log.Warnf("Layer %s in cache index is missing on disk, drop it", id)
+			for _, r := range e.roots {
+				os.Remove(path.Join(r.torrentDir, id+".torrent"))
 			}
-
-			id := ss[0]
-			tf := e.GetFilePath(id)
-			if _, err = os.Lstat(tf); err != nil {
+		}
+	}
+	if c.Seeding.enabled() {
+		e.retention = newRetention(e, c.Seeding)
+		go e.retention.run()
+	}
+	// cached layers are registered in progress until verified, so that pulls
+	// of them wait rather than download them again, and verified a few at
+	// once to bound disk reads
+	var restored sync.WaitGroup
+	sem := make(chan struct{}, constants.DefaultRestoreLimit)
+	for _, f := range files {
+		ss := strings.Split(f.Name(), ".")
+		if len(ss) != 2 {
+			log.Errorf("Found invalid layer file %s", f.Name())
+			continue
+		}
+		id := ss[0]
+		// layer being downloaded is resumed rather than seeded
+		if _, err := os.Lstat(e.GetPartialTorrentFilePath(id)); err == nil {
+			continue
+		}
+		if _, exist := e.lruCache.CreateIfNotExists(id); exist {
+			continue
+		}
+		restored.Add(1)
+		go func(id string, f os.FileInfo) {
+			defer restored.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := e.verifyLayer(id); err != nil {
+				log.Errorf("Verify cached layer %s failed: %v, try to remove it", id, err)
+				// files are removed before pulls waiting for layer download it
+				e.dropLayer(id)()
+				e.lruCache.Remove(id)
 				return
 			}
 
-			if err = e.StartSeed(id); err != nil {
+			// seeding stopped by seeding policy stays stopped
+			if entry, ok := index[id]; ok && entry.SeedingStopped && e.retention != nil {
+				e.retention.restoreStopped(id)
+			} else if err := e.StartSeed(id); err != nil {
 				log.Errorf("Start seed %s failed: %v", id, err)
+				e.lruCache.Remove(id)
 				return
 			}
-			e.lruCache.CreateIfNotExists(id)
-			e.lruCache.SetComplete(id, f.Size())
-		}(f)
+			// layers not in index are considered accessed when they were written
+			lastAccess, pinned := f.ModTime(), false
+			if entry, ok := index[id]; ok {
+				lastAccess, pinned = entry.LastAccess, entry.Pinned
+				if entry.Size != f.Size() {
+					log.Warnf("Size of layer %s in cache index is %d, while %d on disk", id, entry.Size, f.Size())
+				}
+				if tt := e.getTorrent(id); tt != nil && entry.InfoHash != "" && entry.InfoHash != tt.InfoHash().HexString() {
+					log.Warnf("Infohash of layer %s in cache index is %s, while %s of its torrent", id, entry.InfoHash, tt.InfoHash().HexString())
+				}
+			}
+			e.lruCache.Restore(id, f.Size(), lastAccess, pinned)
+		}(id, f)
 	}
+	if err := e.resumeDownloads(); err != nil {
+		log.Errorf("Resume downloads failed: %v", err)
+	}
+	// index is saved once all cached layers are restored, so that none of
+	// them is dropped from index if restart happens again
+	go func() {
+		restored.Wait()
+		e.indexChanged()
+		e.persistIndex()
+	}()
 	go func() {
 		for {
 			time.Sleep(time.Minute * 1)
+			if n := e.lruCache.Expire(); n > 0 {
+				log.Infof("Expired or evicted %d layers from cache", n)
+			}
 			e.lruCache.Output()
 		}
 	}()
+	for _, image := range c.PinnedImages {
+		go func(image string) {
+			if err := e.PinImage(image); err != nil {
+				log.Errorf("Pin image %s failed: %v", image, err)
+			}
+		}(image)
+	}
+
+	// verify cached layers in background
+	if c.ScrubInterval > 0 {
+		scrubber.New("eagleclient", scrubSource{e}, scrubber.Config{
+			Interval:  c.ScrubInterval,
+			RateLimit: c.ScrubRateLimit,
+		}).Start()
+	}
 	return nil
 }
 
+// GetTorrentFromSeeder gets metainfo of blob from seeders. Seeder errors are
+// converted into backenderrors kinds, and retryable ones are retried against
+// other seeders before giving up.
 func (e *BtEngine) GetTorrentFromSeeder(req *http.Request, blobUrl string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < len(e.seeders); attempt++ {
+		if attempt > 0 {
+			log.Warnf("Get metainfo of %s from seeder failed: %v, retry %d ...", blobUrl, err, attempt)
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		var t []byte
+		t, err = e.getTorrentFromSeeder(req)
+		if err == nil {
+			return t, nil
+		}
+		err = backenderrors.FromStatus(blobUrl, err)
+		// another seeder may still have space for the blob
+		if !backenderrors.IsRetryable(err) && !backenderrors.IsQuotaExceeded(err) {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (e *BtEngine) getTorrentFromSeeder(req *http.Request) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	metaInfo, err := e.metaInfoClient.GetMetaInfo(ctx, &pb.MetaInfoRequest{Url: req.URL.Path})
 	if err != nil {
 		return nil, err
 	}
-	return metaInfo.Metainfo, err
+	return metaInfo.Metainfo, nil
 }
 
 func (e *BtEngine) downloadLayer(ctx context.Context, req *http.Request, blobUrl string) (int64, error) {
@@ -202,30 +448,80 @@ func (e *BtEngine) downloadLayer(ctx context.Context, req *http.Request, blobUrl
 	reader := bytes.NewBuffer(t)
 	metaInfo, err := metainfo.Load(reader)
 	if err != nil {
-		return -1, fmt.Errorf("Load torrent file failed: %v", err)
+		return -1, backenderrors.New(backenderrors.ErrCorrupt, id, fmt.Errorf("Load torrent file failed: %v", err))
 	}
 	info, err := metaInfo.UnmarshalInfo()
 	if err != nil {
-		return -1, fmt.Errorf("UnmarshalInfo failed: %v", err)
+		return -1, backenderrors.New(backenderrors.ErrCorrupt, id, fmt.Errorf("UnmarshalInfo failed: %v", err))
 	}
-	progress := process.NewProgressDownload(id, int(info.TotalLength()), os.Stdout)
+	// Persist metainfo, so that download can be resumed after restart
+	if err := writeMetaInfo(e.GetPartialTorrentFilePath(id), metaInfo); err != nil {
+		log.Warnf("Persist metainfo of layer %s failed: %v", id, err)
+	}
+	return e.leechLayer(ctx, id, metaInfo, &info, false)
+}
+
+// leechLayer downloads layer of metaInfo and verifies it. Pieces already
+// on disk are hashed again first if resume is true.
+func (e *BtEngine) leechLayer(ctx context.Context, id string, metaInfo *metainfo.MetaInfo, info *metainfo.Info, resume bool) (int64, error) {
+	progress := process.NewProgressDownload(id, info.TotalLength(), e.progress)
 	// Download layer file
 	log.Debugf("Start to download layer %s", id)
-	if err := e.StartLeecher(ctx, id, metaInfo, progress); err != nil {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tt, err := e.startLeecher(id, metaInfo, resume)
+	if err != nil {
 		log.Errorf("Download layer %s failed: %v", id, err)
 		return info.TotalLength(), err
-	} else {
+	}
+	// watch progress once pieces on disk are hashed, which takes a while for
+	// a large layer without completing any bytes
+	aborted := make(chan error, 1)
+	go e.watchProgress(ctx, id, cancel, aborted)
+	progress.WaitComplete(ctx, tt)
+	select {
+	case err := <-aborted:
+		return info.TotalLength(), err
+	default:
 		log.Infof("Download layer %s success", id)
 	}
+	// Piece hashes only prove content matches torrent from seeder,
+	// verify it against digest before serving it
+	if err := e.verifyLayer(id); err != nil {
+		log.Errorf("Verify layer %s failed: %v", id, err)
+		return info.TotalLength(), err
+	}
+	// Layer is complete, keep its metainfo as torrent of seeding
+	if err := os.Rename(e.GetPartialTorrentFilePath(id), e.GetTorrentFilePath(id)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Keep metainfo of layer %s failed: %v", id, err)
+	}
 	return info.TotalLength(), nil
 }
 
+// finishDownload updates status of layer with result of its download,
+// removing relevant records of failed download.
+func (e *BtEngine) finishDownload(id string, size int64, err error) {
+	if err != nil {
+		log.Errorf("Download layer: %s failed, %v, try to remove its relevant records ...", id, err)
+		os.Remove(e.GetTorrentFilePath(id))
+		os.Remove(e.GetPartialTorrentFilePath(id))
+		os.Remove(e.GetFilePath(id))
+		e.lruCache.Remove(id)
+	} else {
+		log.Infof("Download layer: %s successfully, try to update status ...", id)
+		e.lruCache.SetComplete(id, size)
+		e.indexChanged()
+	}
+}
+
 func (e *BtEngine) downloadLayerSync(req *http.Request, blobUrl string) (string, error) {
 	// get only once each of layer
 	digest := blobUrl[strings.LastIndex(blobUrl, "/")+1:]
 	id := distdigests.Digest(digest).Encoded()
 	layerFile := e.GetFilePath(id)
-	torrentFile := e.GetTorrentFilePath(id)
+	if err := e.checkRejected(id); err != nil {
+		return layerFile, err
+	}
 Loop:
 	entry, exist := e.lruCache.Get(id)
 Execute:
@@ -237,6 +533,7 @@ Execute:
 				return layerFile, err
 			}
 			log.Infof("layer: %s has been cached, return directly", id)
+			e.resumeSeeding(id)
 			return layerFile, nil
 		}
 		// wait
@@ -252,39 +549,23 @@ Execute:
 	if exist {
 		goto Execute
 	} else { // get layer from origin
-		var err error
-		errChan := make(chan error, 1)
-		sizeChan := make(chan int64, 1)
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		go func() {
-			size, err := e.downloadLayer(ctx, req, blobUrl)
-			sizeChan <- size
-			errChan <- err
-		}()
-		select {
-		case err = <-errChan:
-			size := <-sizeChan
-			if err != nil {
-				log.Errorf("Download layer: %s failed, %v, try to remove its relevant records ...", id, err)
-				os.Remove(torrentFile)
-				os.Remove(layerFile)
-				e.lruCache.Remove(id)
-			} else {
-				log.Infof("Download layer: %s successfully, try to update status ...", id)
-				e.lruCache.SetComplete(id, size)
-			}
-		case <-time.After(e.config.DownloadTimeout * time.Second):
-			err = fmt.Errorf("Download layer: %s timeout %s", id, e.config.DownloadTimeout)
-			log.Errorf("Download layer: %s timeout %s, %v, try to remove its relevant records ...", id, e.config.DownloadTimeout, err)
-			os.Remove(torrentFile)
-			os.Remove(layerFile)
-			e.lruCache.Remove(id)
+		size, err := e.downloadLayer(context.Background(), req, blobUrl)
+		e.finishDownload(id, size, err)
+		if IsDigestMismatch(err) {
+			e.rejectLayer(req, id, err)
 		}
 		return layerFile, err
 	}
 }
 
+// resumeSeeding starts seeding layer id pulled locally again, if seeding of
+// it has been stopped by seeding policy.
+func (e *BtEngine) resumeSeeding(id string) {
+	if e.retention != nil {
+		go e.retention.resume(id)
+	}
+}
+
 func (e *BtEngine) DownloadLayer(req *http.Request, blobUrl string) (string, error) {
 	return e.downloadLayerSync(req, blobUrl)
 }
@@ -294,11 +575,16 @@ func (e *BtEngine) RootDir() string {
 }
 
 func (e *BtEngine) GetTorrentFilePath(id string) string {
-	return path.Join(e.rootDir, "torrents", id+".torrent")
+	return path.Join(e.rootOf(id).torrentDir, id+".torrent")
+}
+
+// GetPartialTorrentFilePath returns path of metainfo of layer being downloaded
+func (e *BtEngine) GetPartialTorrentFilePath(id string) string {
+	return path.Join(e.rootOf(id).torrentDir, id+partialSuffix)
 }
 
 func (e *BtEngine) GetFilePath(id string) string {
-	return path.Join(e.rootDir, "data", id+".layer")
+	return path.Join(e.rootOf(id).dataDir, id+".layer")
 }
 
 func (e *BtEngine) StartSeed(id string) error {
@@ -316,12 +602,13 @@ func (e *BtEngine) StartSeed(id string) error {
 		return fmt.Errorf("Load torrent file failed: %v", err)
 	}
 
-	tt, err := e.client.AddTorrent(metaInfo)
+	tt, err := e.addTorrentSpec(id, metaInfo)
 	if err != nil {
 		return fmt.Errorf("Add torrent failed: %v", err)
 	}
 
 	e.addTorrent(id, tt)
+	e.startAnnouncer(id, tt, metaInfo)
 	go func() {
 		<-tt.GotInfo()
 		if tt.Info() != nil {
@@ -333,13 +620,33 @@ func (e *BtEngine) StartSeed(id string) error {
 	return nil
 }
 
-func (e *BtEngine) StartLeecher(ctx context.Context, id string, metaInfo *metainfo.MetaInfo, p *process.ProgressDownload) error {
-	tt, err := e.client.AddTorrent(metaInfo)
+func (e *BtEngine) StartLeecher(ctx context.Context, id string, metaInfo *metainfo.MetaInfo, p *process.ProgressDownload, verify bool) error {
+	tt, err := e.startLeecher(id, metaInfo, verify)
 	if err != nil {
-		return fmt.Errorf("Add torrent failed: %v", err)
+		return err
+	}
+	if p != nil {
+		p.WaitComplete(ctx, tt)
+	}
+	return nil
+}
+
+// startLeecher adds torrent of layer id and starts downloading it. Pieces on
+// disk are hashed first if verify is true.
+func (e *BtEngine) startLeecher(id string, metaInfo *metainfo.MetaInfo, verify bool) (*torrent.Torrent, error) {
+	tt, err := e.addTorrentSpec(id, metaInfo)
+	if err != nil {
+		return nil, fmt.Errorf("Add torrent failed: %v", err)
 	}
 
 	e.addTorrent(id, tt)
+	e.startAnnouncer(id, tt, metaInfo)
+	if verify {
+		// completion recorded before restart may not match data on disk
+		<-tt.GotInfo()
+		tt.VerifyData()
+		log.Infof("Verify %d/%d bytes of layer %s on disk", tt.BytesCompleted(), tt.Length(), id)
+	}
 	go func() {
 		<-tt.GotInfo()
 		if tt.Info() != nil {
@@ -347,11 +654,7 @@ func (e *BtEngine) StartLeecher(ctx context.Context, id string, metaInfo *metain
 		}
 		log.Infof("start torrent %v of layer %s success", tt.InfoHash(), id)
 	}()
-
-	if p != nil {
-		p.WaitComplete(ctx, tt)
-	}
-	return nil
+	return tt, nil
 }
 
 func (e *BtEngine) createTorrent(id string) error {
@@ -389,28 +692,53 @@ func (e *BtEngine) createTorrent(id string) error {
 	return nil
 }
 
+// addTorrentSpec adds torrent of layer id, whose data is kept in its cache root.
+func (e *BtEngine) addTorrentSpec(id string, metaInfo *metainfo.MetaInfo) (*torrent.Torrent, error) {
+	spec := torrent.TorrentSpecFromMetaInfo(metaInfo)
+	spec.Storage = e.rootOf(id).storage
+	tt, _, err := e.client.AddTorrentSpec(spec)
+	return tt, err
+}
+
 func (e *BtEngine) addTorrent(id string, tt *torrent.Torrent) {
 	e.Lock()
-	defer e.Unlock()
 	e.idInfos[id] = tt
+	for _, w := range e.torrentWaits[id] {
+		w <- tt
+	}
+	delete(e.torrentWaits, id)
+	e.Unlock()
+	if e.lsd != nil {
+		e.lsd.notify()
+	}
 }
 
 func (e *BtEngine) DeleteTorrent(id string) {
-	// remove info and bt torrent records
+	// remove data file asynchronously
+	go e.dropLayer(id)()
+}
+
+// dropLayer removes info and bt torrent records of layer id, and returns a
+// function removing its files.
+func (e *BtEngine) dropLayer(id string) func() {
 	e.deleteTorrent(id)
+	if e.retention != nil {
+		e.retention.forget(id)
+	}
+	e.indexChanged()
 
-	// remove data file asynchronously
-	go func() {
-		tfn := e.GetTorrentFilePath(id)
+	tfn, pfn, dfn := e.GetTorrentFilePath(id), e.GetPartialTorrentFilePath(id), e.GetFilePath(id)
+	e.forgetRoot(id)
+	return func() {
 		if err := os.Remove(tfn); err != nil && !os.IsNotExist(err) {
 			log.Errorf("Remove torrent file %s failed: %v", tfn, err)
 		}
+		os.Remove(pfn)
 
-		dfn := e.GetFilePath(id)
 		if err := os.Remove(dfn); err != nil && !os.IsNotExist(err) {
 			log.Errorf("Remove layer file %s failed: %v", dfn, err)
 		}
-	}()
+	}
 }
 
 func (e *BtEngine) deleteTorrent(id string) {
@@ -0,0 +1,144 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/duyanghao/eagle/pkg/constants"
+	log "github.com/sirupsen/logrus"
+)
+
+// indexFileName is name of cache index under root directory
+const indexFileName = "index.json"
+
+// indexEntry is persisted state of a cached layer.
+type indexEntry struct {
+	Digest     string    `json:"digest"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"lastAccess"`
+	Pinned     bool      `json:"pinned,omitempty"`
+	InfoHash   string    `json:"infoHash,omitempty"`
+	// seeding stopped by seeding policy, kept stopped after restart
+	SeedingStopped bool `json:"seedingStopped,omitempty"`
+}
+
+type cacheIndex struct {
+	Entries []indexEntry `json:"entries"`
+}
+
+func (e *BtEngine) indexPath() string {
+	return path.Join(e.rootDir, indexFileName)
+}
+
+// loadIndex loads cache index persisted before restart, which is empty if
+// there is none or it is unreadable.
+func (e *BtEngine) loadIndex() map[string]indexEntry {
+	entries := make(map[string]indexEntry)
+	content, err := ioutil.ReadFile(e.indexPath())
+	if os.IsNotExist(err) {
+		return entries
+	}
+	if err != nil {
+		log.Errorf("Read cache index failed: %v, restore cache from data directory only", err)
+		return entries
+	}
+	var index cacheIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		log.Errorf("Decode cache index failed: %v, restore cache from data directory only", err)
+		return entries
+	}
+	for _, entry := range index.Entries {
+		entries[entry.Digest] = entry
+	}
+	return entries
+}
+
+// saveIndex persists completed layers in cache with their recency.
+func (e *BtEngine) saveIndex() error {
+	var index cacheIndex
+	for _, id := range e.lruCache.Keys() {
+		entry, exist := e.lruCache.Peek(id)
+		if !exist || !entry.Completed {
+			continue
+		}
+		ie := indexEntry{
+			Digest:     id,
+			Size:       entry.Size,
+			LastAccess: entry.LastAccess,
+			Pinned:     entry.Pinned,
+		}
+		if tt := e.getTorrent(id); tt != nil {
+			ie.InfoHash = tt.InfoHash().HexString()
+		}
+		if e.retention != nil {
+			ie.SeedingStopped = e.retention.isStopped(id)
+		}
+		index.Entries = append(index.Entries, ie)
+	}
+	content, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(e.indexPath(), content)
+}
+
+// indexChanged saves cache index soon, e.g. a layer is added or pinned.
+func (e *BtEngine) indexChanged() {
+	select {
+	case e.indexDirty <- struct{}{}:
+	default:
+	}
+}
+
+// persistIndex saves cache index on changes, and periodically to keep
+// recency of layers accessed.
+func (e *BtEngine) persistIndex() {
+	ticker := time.NewTicker(constants.DefaultIndexSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.indexDirty:
+		}
+		if err := e.saveIndex(); err != nil {
+			log.Errorf("Save cache index failed: %v", err)
+		}
+	}
+}
+
+// writeFileAtomic writes content into name through a temporary file, so
+// that name is never left truncated.
+func writeFileAtomic(name string, content []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
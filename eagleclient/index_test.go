@@ -0,0 +1,69 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/duyanghao/eagle/pkg/utils/lrucache"
+)
+
+func TestCacheIndex(t *testing.T) {
+	e := NewBtEngine(t.TempDir(), nil, nil, nil)
+	var err error
+	e.lruCache, err = lrucache.NewLRU(100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Round(time.Second)
+	// restored in random order, as layers are verified concurrently
+	e.lruCache.Restore("b", 10, now.Add(-2*time.Hour), false)
+	e.lruCache.Restore("c", 10, now.Add(-time.Hour), true)
+	e.lruCache.Restore("a", 10, now.Add(-3*time.Hour), false)
+	if keys, want := e.lruCache.Keys(), []string{"c", "b", "a"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got keys %v, want %v from the most recently used", keys, want)
+	}
+
+	if err := e.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index := e.loadIndex()
+	if len(index) != 3 {
+		t.Fatalf("got %d entries in index, want 3", len(index))
+	}
+	want := indexEntry{Digest: "c", Size: 10, LastAccess: now.Add(-time.Hour), Pinned: true}
+	if got := index["c"]; !got.LastAccess.Equal(want.LastAccess) || got.Size != want.Size || !got.Pinned {
+		t.Fatalf("got entry %+v, want %+v", got, want)
+	}
+
+	// seeding stopped by seeding policy is kept across restarts
+	e.retention = newRetention(e, &SeedingPolicy{IdleTime: time.Hour})
+	e.retention.restoreStopped("b")
+	if err := e.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index = e.loadIndex()
+	if !index["b"].SeedingStopped || index["c"].SeedingStopped {
+		t.Fatalf("got entries %+v, want seeding of b stopped only", index)
+	}
+
+	// the least recently used one which is not pinned is evicted
+	e.lruCache.Pin("a")
+	e.lruCache.Restore("d", 80, now, false)
+	if keys, want := e.lruCache.Keys(), []string{"d", "c", "a"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got keys %v after eviction, want %v", keys, want)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/tracker"
+	"github.com/duyanghao/eagle/pkg/constants"
+	"github.com/duyanghao/eagle/pkg/locality"
+	log "github.com/sirupsen/logrus"
+)
+
+// announcer announces torrent to trackers on behalf of torrent client when
+// locality is enabled, and adds peers in the order of their distance. Peers
+// outside local IDC are withheld while peers of local IDC serve the download,
+// and are limited by MaxCrossIDCPeers once added. Torrent client unchokes
+// every interested peer, so local IDC peers are preferred in serving by
+// closing connections of cross IDC peers beyond MaxCrossIDCPeers, incoming
+// ones included.
+type announcer struct {
+	*BtEngine
+	id       string
+	tt       *torrent.Torrent
+	trackers []string
+
+	mu sync.Mutex
+	// cross IDC peers ever added, bounded by MaxCrossIDCPeers
+	crossIDC map[string]struct{}
+	// cross IDC peers last announced and not added yet
+	withheld []tracker.Peer
+	// useful bytes downloaded at last check of local IDC peers
+	lastRead int64
+}
+
+// startAnnouncer announces tt until it is dropped, if locality is enabled.
+func (e *BtEngine) startAnnouncer(id string, tt *torrent.Torrent, metaInfo *metainfo.MetaInfo) {
+	if e.topology == nil {
+		return
+	}
+	a := &announcer{
+		BtEngine: e,
+		id:       id,
+		tt:       tt,
+		crossIDC: make(map[string]struct{}),
+	}
+	for url := range metaInfo.UpvertedAnnounceList().DistinctValues() {
+		a.trackers = append(a.trackers, url)
+	}
+	go a.run()
+}
+
+func (a *announcer) run() {
+	event := tracker.Started
+	next := time.Now()
+	check := time.NewTicker(constants.DefaultLocalityCheck)
+	defer check.Stop()
+	for {
+		if now := time.Now(); !now.Before(next) {
+			next = now.Add(a.announce(event))
+			event = tracker.None
+		}
+		select {
+		case <-a.tt.Closed():
+			// trackers would list dropped torrent until it times out
+			a.announce(tracker.Stopped)
+			return
+		case <-check.C:
+			a.mu.Lock()
+			a.release(false)
+			a.limitCrossIDC()
+			a.mu.Unlock()
+		}
+	}
+}
+
+// announce announces to all trackers, adds peers returned by them and
+// returns interval before next announce.
+func (a *announcer) announce(event tracker.AnnounceEvent) time.Duration {
+	req := tracker.AnnounceRequest{
+		InfoHash: a.tt.InfoHash(),
+		PeerId:   a.client.PeerID(),
+		Left:     -1,
+		Event:    event,
+		NumWant:  -1,
+		Port:     uint16(a.client.LocalPort()),
+	}
+	if a.tt.Info() != nil {
+		req.Left = a.tt.BytesMissing()
+	}
+	stats := a.tt.Stats()
+	req.Uploaded = stats.BytesWrittenData.Int64()
+	req.Downloaded = stats.BytesReadUsefulData.Int64()
+
+	var peers []tracker.Peer
+	interval := time.Duration(0)
+	for _, url := range a.trackers {
+		ctx, cancel := context.WithTimeout(context.Background(), constants.DefaultAnnounceTimeout)
+		resp, err := tracker.Announce{TrackerUrl: url, Request: req, Context: ctx}.Do()
+		cancel()
+		if err != nil {
+			log.Warnf("Announce layer %s to tracker %s failed: %v", a.id, url, err)
+			continue
+		}
+		peers = append(peers, resp.Peers...)
+		if i := time.Duration(resp.Interval) * time.Second; interval == 0 || i < interval {
+			interval = i
+		}
+	}
+	if event == tracker.Stopped {
+		return 0
+	}
+	a.addPeers(peers)
+
+	if interval <= 0 {
+		interval = constants.DefaultAnnounceInterval
+	}
+	if interval < constants.DefaultMinAnnounceInterval {
+		interval = constants.DefaultMinAnnounceInterval
+	}
+	return interval
+}
+
+// addPeers adds local IDC peers from the closest to the farthest, while
+// cross IDC peers are withheld until local IDC peers are exhausted, or added
+// right away if there are no local IDC peers at all.
+func (a *announcer) addPeers(peers []tracker.Peer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// connections are all gone, so give other cross IDC peers a chance
+	if len(a.tt.PeerConns()) == 0 {
+		a.crossIDC = make(map[string]struct{})
+	}
+
+	ips := make([]net.IP, len(peers))
+	for i, p := range peers {
+		ips[i] = p.IP
+	}
+	var local []torrent.Peer
+	a.withheld = nil
+	for _, i := range a.topology.Select(ips) {
+		p := peers[i]
+		if a.topology.Distance(p.IP) > locality.SameIDC {
+			a.withheld = append(a.withheld, p)
+			continue
+		}
+		local = append(local, newPeer(p))
+	}
+	if len(local) > 0 {
+		a.tt.AddPeers(local)
+	}
+	log.Debugf("Add %d local IDC peers of %d announced for layer %s", len(local), len(peers), a.id)
+	a.release(len(local) == 0)
+}
+
+// release adds withheld cross IDC peers if forced or local IDC peers are
+// exhausted. Cross IDC peers already added are always added again, while
+// new ones are added until MaxCrossIDCPeers is reached.
+func (a *announcer) release(force bool) {
+	if len(a.withheld) == 0 || !force && !a.localExhausted() {
+		return
+	}
+	var added []torrent.Peer
+	for _, p := range a.withheld {
+		addr := &net.TCPAddr{IP: p.IP, Port: p.Port}
+		if _, exist := a.crossIDC[addr.String()]; !exist {
+			if max := a.config.Locality.MaxCrossIDCPeers; max > 0 && len(a.crossIDC) >= max {
+				continue
+			}
+			a.crossIDC[addr.String()] = struct{}{}
+		}
+		added = append(added, newPeer(p))
+	}
+	a.withheld = nil
+	if len(added) > 0 {
+		a.tt.AddPeers(added)
+	}
+	log.Debugf("Add %d cross IDC peers for layer %s", len(added), a.id)
+}
+
+// localExhausted returns true if the torrent has no connections, or its
+// download makes no progress since last check, i.e. peers connected don't
+// have pieces missing. Torrents being seeded don't need cross IDC peers.
+func (a *announcer) localExhausted() bool {
+	if len(a.tt.PeerConns()) == 0 {
+		return true
+	}
+	if a.tt.Info() == nil || a.tt.BytesMissing() == 0 {
+		return false
+	}
+	stats := a.tt.Stats()
+	read := stats.BytesReadUsefulData.Int64()
+	stalled := read == a.lastRead
+	a.lastRead = read
+	return stalled
+}
+
+// limitCrossIDC closes connections of cross IDC peers beyond
+// MaxCrossIDCPeers, keeping connections to peers added by announcer first.
+func (a *announcer) limitCrossIDC() {
+	max := a.config.Locality.MaxCrossIDCPeers
+	if max <= 0 {
+		return
+	}
+	var added, others []net.Conn
+	for _, pc := range a.tt.PeerConns() {
+		conn, _ := peerNetConn(pc)
+		if conn == nil {
+			continue
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || a.topology.Distance(net.ParseIP(host)) <= locality.SameIDC {
+			continue
+		}
+		if _, ok := a.crossIDC[conn.RemoteAddr().String()]; ok {
+			added = append(added, conn)
+		} else {
+			others = append(others, conn)
+		}
+	}
+	conns := append(added, others...)
+	if len(conns) <= max {
+		return
+	}
+	// torrent client drops connection closed as if peer hung up
+	for _, conn := range conns[max:] {
+		conn.Close()
+	}
+	log.Infof("Close %d cross IDC connections of layer %s beyond %d", len(conns)-max, a.id, max)
+}
+
+// peerNetConn returns network connection of pc, which torrent client
+// doesn't expose, and false if it can't be found, e.g. torrent client is
+// upgraded with PeerConn changed.
+func peerNetConn(pc *torrent.PeerConn) (net.Conn, bool) {
+	f := reflect.ValueOf(pc).Elem().FieldByName("conn")
+	if !f.IsValid() || f.Type() != reflect.TypeOf((*net.Conn)(nil)).Elem() {
+		return nil, false
+	}
+	conn := *(*net.Conn)(unsafe.Pointer(f.UnsafeAddr()))
+	return conn, true
+}
+
+func newPeer(p tracker.Peer) torrent.Peer {
+	peer := torrent.Peer{Addr: &net.TCPAddr{IP: p.IP, Port: p.Port}, Source: torrent.PeerSourceTracker}
+	copy(peer.Id[:], p.ID)
+	return peer
+}
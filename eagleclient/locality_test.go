@@ -0,0 +1,83 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/pkg/locality"
+)
+
+func TestPeerNetConn(t *testing.T) {
+	// connection is read from unexported field of torrent client
+	if _, ok := peerNetConn(&torrent.PeerConn{}); !ok {
+		t.Fatal("expected network connection of PeerConn found")
+	}
+}
+
+func TestAnnounceStopped(t *testing.T) {
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		bencode.NewEncoder(w).Encode(map[string]interface{}{"interval": 60, "peers": ""})
+	}))
+	defer srv.Close()
+	root, err := ioutil.TempDir("", "eagleclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c := &Config{Locality: &locality.Config{Subnets: []locality.Subnet{{CIDR: "10.0.0.0/8"}}}}
+	e := NewBtEngine(root, nil, nil, c)
+	if e.topology, err = locality.New(c.Locality); err != nil {
+		t.Fatal(err)
+	}
+	tc := torrent.NewDefaultClientConfig()
+	tc.DataDir = root
+	tc.ListenPort = 0
+	tc.NoDHT = true
+	tc.DisableTrackers = true
+	tc.NoDefaultPortForwarding = true
+	if e.client, err = torrent.NewClient(tc); err != nil {
+		t.Fatal(err)
+	}
+	defer e.client.Close()
+
+	mi := &metainfo.MetaInfo{AnnounceList: [][]string{{srv.URL + "/announce"}}}
+	tt, _, err := e.client.AddTorrentSpec(torrent.TorrentSpecFromMetaInfo(mi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.startAnnouncer("layer", tt, mi)
+	for _, want := range []string{"started", "stopped"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s announced", want)
+		}
+		tt.Drop()
+	}
+}
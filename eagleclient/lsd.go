@@ -0,0 +1,231 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lsdMulticastGroup = "239.192.152.143"
+	lsdDefaultPort    = 6771
+	// infohashes carried by each announce, keeping datagram below MTU
+	lsdMaxInfohashes = 20
+
+	peerSourceLSD torrent.PeerSource = "Lsd"
+)
+
+// LANDiscoveryConfig configures local service discovery(BEP 14), which lets
+// BtEngine instances of a LAN find each other without trackers.
+type LANDiscoveryConfig struct {
+	Multicast bool          // announce to BEP 14 multicast group
+	Port      int           // port of local service discovery
+	Peers     []string      // gossip list of other nodes, "host" or "host:port"
+	Interval  time.Duration // interval of announcing all torrents
+}
+
+func (c *LANDiscoveryConfig) enabled() bool {
+	return c != nil && (c.Multicast || len(c.Peers) > 0)
+}
+
+// lsd announces infohashes of local torrents to LAN, and feeds peers
+// announcing the same infohashes into torrent client.
+type lsd struct {
+	*BtEngine
+	config  LANDiscoveryConfig
+	conn    *net.UDPConn
+	group   *net.UDPAddr
+	cookie  string
+	trigger chan struct{}
+}
+
+func (e *BtEngine) startLSD(c LANDiscoveryConfig) (*lsd, error) {
+	if c.Port <= 0 {
+		c.Port = lsdDefaultPort
+	}
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	l := &lsd{
+		BtEngine: e,
+		config:   c,
+		cookie:   hex.EncodeToString(cookie),
+		trigger:  make(chan struct{}, 1),
+	}
+	var err error
+	if c.Multicast {
+		l.group = &net.UDPAddr{IP: net.ParseIP(lsdMulticastGroup), Port: c.Port}
+		// unicast announces of gossip peers are received as well
+		l.conn, err = net.ListenMulticastUDP("udp4", nil, l.group)
+	} else {
+		l.conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: c.Port})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen on port %d of local service discovery: %v", c.Port, err)
+	}
+	go l.serve()
+	go l.run()
+	log.Infof("Start local service discovery on port %d, multicast: %v, peers: %v", c.Port, c.Multicast, c.Peers)
+	return l, nil
+}
+
+// notify announces torrents soon, e.g. a torrent is added.
+func (l *lsd) notify() {
+	select {
+	case l.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (l *lsd) run() {
+	ticker := time.NewTicker(l.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.trigger:
+		}
+		l.announce()
+	}
+}
+
+func (l *lsd) announce() {
+	var hashes []metainfo.Hash
+	l.RLock()
+	for _, tt := range l.idInfos {
+		hashes = append(hashes, tt.InfoHash())
+	}
+	l.RUnlock()
+	if len(hashes) == 0 {
+		return
+	}
+
+	targets := l.targets()
+	port := l.client.LocalPort()
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > lsdMaxInfohashes {
+			n = lsdMaxInfohashes
+		}
+		msg := lsdMessage(port, l.cookie, hashes[:n])
+		hashes = hashes[n:]
+		for _, addr := range targets {
+			if _, err := l.conn.WriteToUDP(msg, addr); err != nil {
+				log.Debugf("Send local service discovery announce to %s failed: %v", addr, err)
+			}
+		}
+	}
+}
+
+// targets resolves addresses to announce to on each round, so that gossip
+// peers may change their addresses.
+func (l *lsd) targets() []*net.UDPAddr {
+	var targets []*net.UDPAddr
+	if l.group != nil {
+		targets = append(targets, l.group)
+	}
+	for _, p := range l.config.Peers {
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			p = net.JoinHostPort(p, strconv.Itoa(l.config.Port))
+		}
+		addr, err := net.ResolveUDPAddr("udp4", p)
+		if err != nil {
+			log.Debugf("Resolve local service discovery peer %s failed: %v", p, err)
+			continue
+		}
+		targets = append(targets, addr)
+	}
+	return targets
+}
+
+func (l *lsd) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Read local service discovery announce failed: %v", err)
+			return
+		}
+		port, hashes, cookie, err := parseLSDMessage(buf[:n])
+		if err != nil {
+			log.Debugf("Invalid local service discovery announce from %s: %v", src, err)
+			continue
+		}
+		// own announce looped back
+		if cookie == l.cookie {
+			continue
+		}
+		peer := torrent.Peer{
+			Addr:   &net.TCPAddr{IP: src.IP, Port: port},
+			Source: peerSourceLSD,
+		}
+		for _, h := range hashes {
+			if tt, ok := l.client.Torrent(h); ok {
+				tt.AddPeers([]torrent.Peer{peer})
+				log.Debugf("Add peer %s of torrent %s from local service discovery", peer.Addr, h)
+			}
+		}
+	}
+}
+
+// lsdMessage builds a BEP 14 announce.
+func lsdMessage(port int, cookie string, hashes []metainfo.Hash) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s:%d\r\n", lsdMulticastGroup, lsdDefaultPort)
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, h := range hashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", h.HexString())
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// parseLSDMessage parses a BEP 14 announce.
+func parseLSDMessage(b []byte) (int, []metainfo.Hash, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, "", fmt.Errorf("unexpected method %s", req.Method)
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, "", fmt.Errorf("invalid port %q", req.Header.Get("Port"))
+	}
+	var hashes []metainfo.Hash
+	for _, s := range req.Header["Infohash"] {
+		var h metainfo.Hash
+		if err := h.FromHexString(s); err != nil {
+			return 0, nil, "", fmt.Errorf("invalid infohash %q: %v", s, err)
+		}
+		hashes = append(hashes, h)
+	}
+	return port, hashes, req.Header.Get("Cookie"), nil
+}
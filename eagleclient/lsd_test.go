@@ -0,0 +1,47 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestLSDMessage(t *testing.T) {
+	hashes := []metainfo.Hash{
+		metainfo.NewHashFromHex("0123456789abcdef0123456789abcdef01234567"),
+		metainfo.NewHashFromHex("89abcdef0123456789abcdef0123456789abcdef"),
+	}
+	port, got, cookie, err := parseLSDMessage(lsdMessage(61007, "c00k1e", hashes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 61007 || cookie != "c00k1e" || !reflect.DeepEqual(got, hashes) {
+		t.Fatalf("parsed port %d, cookie %s, infohashes %v", port, cookie, got)
+	}
+}
+
+func TestParseInvalidLSDMessage(t *testing.T) {
+	for _, msg := range []string{
+		"GET / HTTP/1.1\r\nPort: 6881\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: x\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: xyz\r\n\r\n",
+	} {
+		if _, _, _, err := parseLSDMessage([]byte(msg)); err == nil {
+			t.Errorf("expected error of %q", msg)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+
+	distdigests "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Media types of image manifests
+const (
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeManifestV1   = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+const (
+	defaultRegistry   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// imageRef is a parsed image reference, e.g. registry.example.com/library/nginx:1.19
+type imageRef struct {
+	registry   string
+	repository string
+	reference  string // tag or digest
+}
+
+// parseImageRef parses image reference the way docker does, defaulting
+// registry to docker hub and tag to latest.
+func parseImageRef(s string) (imageRef, error) {
+	if s == "" {
+		return imageRef{}, errors.New("empty image reference")
+	}
+	ref := imageRef{registry: defaultRegistry}
+	name := s
+	if i := strings.Index(s, "@"); i >= 0 {
+		name, ref.reference = s[:i], s[i+1:]
+		if _, err := distdigests.Parse(ref.reference); err != nil {
+			return imageRef{}, fmt.Errorf("invalid digest of image %s: %v", s, err)
+		}
+	} else if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		name, ref.reference = s[:i], s[i+1:]
+	}
+	if ref.reference == "" {
+		ref.reference = "latest"
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry, name = host, name[i+1:]
+		}
+	}
+	if ref.registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || strings.ToLower(name) != name {
+		return imageRef{}, fmt.Errorf("invalid repository of image %s", s)
+	}
+	ref.repository = name
+	return ref, nil
+}
+
+// originRef points ref to origin of Seeder, from which blobs of image are
+// fetched, so that manifest is resolved from the same registry. Hostless
+// references resolve against origin, and ones naming another registry are
+// rejected, as their blobs can't be fetched through Seeder.
+func (e *BtEngine) originRef(ref imageRef) (imageRef, error) {
+	origin := e.config.Origin
+	if origin == "" {
+		return imageRef{}, errors.New("origin is not configured")
+	}
+	if ref.registry != defaultRegistry && ref.registry != origin {
+		return imageRef{}, fmt.Errorf("registry %s is not origin %s", ref.registry, origin)
+	}
+	ref.registry = origin
+	return ref, nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+	// schema1
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+// fetchManifest gets manifest of image from registry, through https first
+// and then http for insecure registries.
+func (e *BtEngine) fetchManifest(ref imageRef, reference string) (*manifest, string, error) {
+	registry := ref.registry
+	if registry == defaultRegistry {
+		registry = dockerHubRegistry
+	}
+	var err error
+	for _, scheme := range []string{"https", "http"} {
+		var (
+			m         *manifest
+			mediaType string
+		)
+		m, mediaType, err = e.getManifest(fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registry, ref.repository, reference))
+		if err == nil {
+			return m, mediaType, nil
+		}
+		if _, ok := err.(*manifestStatusError); ok {
+			break
+		}
+	}
+	return nil, "", err
+}
+
+// manifestStatusError is returned when registry responds with unexpected status
+type manifestStatusError struct {
+	url    string
+	status string
+}
+
+func (e *manifestStatusError) Error() string {
+	return fmt.Sprintf("get manifest %s: registry rsp status: %s", e.url, e.status)
+}
+
+// getManifest gets manifest from url. Registries requiring a bearer token,
+// e.g. docker hub, are answered with an anonymous token got from the token
+// service they point to.
+func (e *BtEngine) getManifest(url string) (*manifest, string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		mediaTypeManifestList, mediaTypeManifest, mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeManifestV1,
+	}, ", "))
+	resp, err := e.registryClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		token, err := e.fetchToken(challenge)
+		if err != nil {
+			return nil, "", fmt.Errorf("authenticate for manifest %s: %v", url, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if resp, err = e.registryClient.Do(req); err != nil {
+			return nil, "", err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &manifestStatusError{url: url, status: resp.Status}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, "", fmt.Errorf("decode manifest %s: %v", url, err)
+	}
+	mediaType := m.MediaType
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mediaType = strings.TrimSpace(strings.Split(ct, ";")[0])
+	}
+	return &m, mediaType, nil
+}
+
+// fetchToken gets an anonymous token from the token service of bearer
+// challenge of registry.
+func (e *BtEngine) fetchToken(challenge string) (string, error) {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid realm of challenge %q: %v", challenge, err)
+	}
+	q := u.Query()
+	for _, key := range []string{"service", "scope"} {
+		if v := params[key]; v != "" {
+			q.Set(key, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	resp, err := e.registryClient.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token %s: rsp status: %s", u, resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("decode token %s: %v", u, err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return "", fmt.Errorf("no token from %s", u)
+	}
+	return t.Token, nil
+}
+
+// parseBearerChallenge parses parameters of WWW-Authenticate header of
+// Bearer scheme, e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseBearerChallenge(header string) (map[string]string, bool) {
+	const scheme = "bearer "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	s := header[len(scheme):]
+	for {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.Index(s, "=")
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			value, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[key] = value
+	}
+	return params, true
+}
+
+// resolveImage returns digests of config and layers of image for the
+// platform of local node.
+func (e *BtEngine) resolveImage(ref imageRef) ([]string, error) {
+	m, mediaType, err := e.fetchManifest(ref, ref.reference)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == mediaTypeManifestList || mediaType == mediaTypeOCIIndex || len(m.Manifests) > 0 {
+		digest := ""
+		for _, d := range m.Manifests {
+			if d.Platform != nil && d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+				digest = d.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, fmt.Errorf("no manifest of platform %s/%s", runtime.GOOS, runtime.GOARCH)
+		}
+		if m, _, err = e.fetchManifest(ref, digest); err != nil {
+			return nil, err
+		}
+	}
+	seen := make(map[string]bool)
+	var digests []string
+	add := func(d string) {
+		if d != "" && !seen[d] {
+			seen[d] = true
+			digests = append(digests, d)
+		}
+	}
+	add(m.Config.Digest)
+	for _, l := range m.Layers {
+		add(l.Digest)
+	}
+	for _, l := range m.FSLayers {
+		add(l.BlobSum)
+	}
+	if len(digests) == 0 {
+		return nil, fmt.Errorf("no layers in manifest of %s/%s:%s", ref.registry, ref.repository, ref.reference)
+	}
+	return digests, nil
+}
+
+// PrefetchImage downloads config and layers of image into cache through
+// p2p, at most PrefetchConcurrency of them at a time, so that they are
+// served from cache when the image is pulled.
+func (e *BtEngine) PrefetchImage(image string) error {
+	_, err := e.prefetchImage(image)
+	return err
+}
+
+// PinImage prefetches config and layers of image, and pins them in cache.
+// Blobs prefetched are pinned even if others failed.
+func (e *BtEngine) PinImage(image string) error {
+	digests, err := e.prefetchImage(image)
+	for _, digest := range digests {
+		if perr := e.Pin(distdigests.Digest(digest).Encoded()); perr != nil {
+			log.Errorf("Pin blob %s of image %s failed: %v", digest, image, perr)
+		}
+	}
+	return err
+}
+
+// prefetchImage returns digests of blobs of image prefetched.
+func (e *BtEngine) prefetchImage(image string) ([]string, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	if ref, err = e.originRef(ref); err != nil {
+		return nil, fmt.Errorf("image %s: %v", image, err)
+	}
+	digests, err := e.resolveImage(ref)
+	if err != nil {
+		return nil, fmt.Errorf("resolve image %s: %v", image, err)
+	}
+	log.Infof("Prefetch %d blobs of image %s", len(digests), image)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		fetched []string
+		failed  []string
+		first   error
+	)
+	sem := make(chan struct{}, e.config.PrefetchConcurrency)
+	for _, digest := range digests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(digest string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := e.PrefetchLayer(ref.repository, digest)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Errorf("Prefetch blob %s of image %s failed: %v", digest, image, err)
+				failed = append(failed, digest)
+				if first == nil {
+					first = err
+				}
+				return
+			}
+			fetched = append(fetched, digest)
+		}(digest)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return fetched, fmt.Errorf("prefetch %d/%d blobs of image %s failed, e.g. %s: %v", len(failed), len(digests), image, failed[0], first)
+	}
+	return fetched, nil
+}
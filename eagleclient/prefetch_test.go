@@ -0,0 +1,175 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	tests := []struct {
+		image string
+		want  imageRef
+	}{
+		{"nginx", imageRef{"docker.io", "library/nginx", "latest"}},
+		{"nginx:1.19", imageRef{"docker.io", "library/nginx", "1.19"}},
+		{"duyanghao/eagle:v1", imageRef{"docker.io", "duyanghao/eagle", "v1"}},
+		{"registry.example.com:5000/library/nginx", imageRef{"registry.example.com:5000", "library/nginx", "latest"}},
+		{"localhost/foo/bar@" + digest, imageRef{"localhost", "foo/bar", digest}},
+	}
+	for _, test := range tests {
+		got, err := parseImageRef(test.image)
+		if err != nil {
+			t.Errorf("parse %s: %v", test.image, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parse %s: got %+v, want %+v", test.image, got, test.want)
+		}
+	}
+	for _, image := range []string{"", "Nginx", "nginx@sha256:xyz"} {
+		if _, err := parseImageRef(image); err == nil {
+			t.Errorf("expected error of parsing %q", image)
+		}
+	}
+}
+
+func TestOriginRef(t *testing.T) {
+	e := NewBtEngine(t.TempDir(), nil, nil, nil)
+	ref, _ := parseImageRef("nginx")
+	if _, err := e.originRef(ref); err == nil {
+		t.Fatal("expected error of missing origin")
+	}
+
+	e.config.Origin = "registry.example.com:5000"
+	for _, image := range []string{"nginx", "registry.example.com:5000/library/nginx"} {
+		ref, _ := parseImageRef(image)
+		got, err := e.originRef(ref)
+		if err != nil {
+			t.Errorf("origin of %s: %v", image, err)
+			continue
+		}
+		if want := (imageRef{"registry.example.com:5000", "library/nginx", "latest"}); got != want {
+			t.Errorf("origin of %s: got %+v, want %+v", image, got, want)
+		}
+	}
+	ref, _ = parseImageRef("other.example.com/library/nginx")
+	if _, err := e.originRef(ref); err == nil {
+		t.Fatal("expected error of registry other than origin")
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	const index = `{"manifests": [
+		{"digest": "sha256:other", "platform": {"architecture": "s390x", "os": "linux"}},
+		{"digest": "sha256:local", "platform": {"architecture": "%s", "os": "%s"}}
+	]}`
+	const manifest = `{"config": {"digest": "sha256:config"},
+		"layers": [{"digest": "sha256:layer1"}, {"digest": "sha256:layer2"}, {"digest": "sha256:layer1"}]}`
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/app/manifests/v1":
+			w.Header().Set("Content-Type", mediaTypeManifestList)
+			fmt.Fprintf(w, index, runtime.GOARCH, runtime.GOOS)
+		case "/v2/library/app/manifests/sha256:local":
+			w.Header().Set("Content-Type", mediaTypeManifest)
+			fmt.Fprint(w, manifest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	e := NewBtEngine(t.TempDir(), nil, nil, nil)
+	ref, err := parseImageRef(strings.TrimPrefix(registry.URL, "http://") + "/library/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests, err := e.resolveImage(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sha256:config", "sha256:layer1", "sha256:layer2"}; !reflect.DeepEqual(digests, want) {
+		t.Fatalf("got digests %v, want %v", digests, want)
+	}
+
+	ref.reference = "v2"
+	if _, err := e.resolveImage(ref); err == nil {
+		t.Fatal("expected error of missing manifest")
+	}
+}
+
+func TestResolveImageWithToken(t *testing.T) {
+	const manifest = `{"config": {"digest": "sha256:config"}, "layers": [{"digest": "sha256:layer"}]}`
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.URL.Query().Get("service") != "test-registry" || r.URL.Query().Get("scope") != "repository:library/app:pull" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"token": "secret"}`)
+		case "/v2/library/app/manifests/v1":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					`Bearer realm="%s/token",service="test-registry",scope="repository:library/app:pull"`, registry.URL))
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", mediaTypeManifest)
+			fmt.Fprint(w, manifest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	e := NewBtEngine(t.TempDir(), nil, nil, nil)
+	ref, err := parseImageRef(strings.TrimPrefix(registry.URL, "http://") + "/library/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests, err := e.resolveImage(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sha256:config", "sha256:layer"}; !reflect.DeepEqual(digests, want) {
+		t.Fatalf("got digests %v, want %v", digests, want)
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	params, ok := parseBearerChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	want := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull,push",
+	}
+	if !ok || !reflect.DeepEqual(params, want) {
+		t.Fatalf("got %v, %t, want %v", params, ok, want)
+	}
+	for _, header := range []string{"", `Basic realm="registry"`, `Bearer realm="unterminated`} {
+		if _, ok := parseBearerChallenge(header); ok {
+			t.Errorf("expected %q rejected", header)
+		}
+	}
+}
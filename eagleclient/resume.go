@@ -0,0 +1,97 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+	log "github.com/sirupsen/logrus"
+)
+
+// partialSuffix is suffix of metainfo of layer being downloaded, which is
+// renamed into torrent file once the layer is downloaded and verified
+const partialSuffix = ".partial"
+
+// resumeDownloads re-attaches downloads interrupted by restart, whose
+// metainfo is found in torrent directories of cache roots.
+func (e *BtEngine) resumeDownloads() error {
+	for _, r := range e.roots {
+		files, err := ioutil.ReadDir(r.torrentDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if path.Ext(f.Name()) != partialSuffix {
+				continue
+			}
+			id := strings.TrimSuffix(f.Name(), partialSuffix)
+			e.setRoot(id, r)
+			go e.resumeLayer(id)
+		}
+	}
+	return nil
+}
+
+// resumeLayer downloads layer from where it stopped. Pieces on disk are
+// hashed again, so only missing or corrupt ones are downloaded.
+func (e *BtEngine) resumeLayer(id string) {
+	metaInfo, err := metainfo.LoadFromFile(e.GetPartialTorrentFilePath(id))
+	if err != nil {
+		log.Errorf("Load metainfo of interrupted layer %s failed: %v, try to remove it", id, err)
+		os.Remove(e.GetPartialTorrentFilePath(id))
+		os.Remove(e.GetFilePath(id))
+		return
+	}
+	info, err := metaInfo.UnmarshalInfo()
+	if err != nil {
+		log.Errorf("Unmarshal metainfo of interrupted layer %s failed: %v, try to remove it", id, err)
+		os.Remove(e.GetPartialTorrentFilePath(id))
+		os.Remove(e.GetFilePath(id))
+		return
+	}
+	if _, exist := e.lruCache.CreateIfNotExists(id); exist {
+		return
+	}
+	log.Infof("Resume download of layer %s", id)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	size, err := e.leechLayer(ctx, id, metaInfo, &info, true)
+	e.finishDownload(id, size, err)
+}
+
+// writeMetaInfo writes metaInfo into name through a temporary file, so that
+// name is never left truncated.
+func writeMetaInfo(name string, metaInfo *metainfo.MetaInfo) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = metaInfo.Write(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/duyanghao/eagle/pkg/utils/lrucache"
+)
+
+// slowStorage is file storage delaying the first read of piece 0, as
+// hashing a large layer on disk does.
+type slowStorage struct {
+	storage.ClientImplCloser
+	delay time.Duration
+	once  sync.Once
+}
+
+func (s *slowStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.ClientImplCloser.OpenTorrent(info, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return slowTorrent{t, s}, nil
+}
+
+type slowTorrent struct {
+	storage.TorrentImpl
+	s *slowStorage
+}
+
+func (t slowTorrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return slowPiece{t.TorrentImpl.Piece(p), p.Index(), t.s}
+}
+
+type slowPiece struct {
+	storage.PieceImpl
+	index int
+	s     *slowStorage
+}
+
+func (p slowPiece) ReadAt(b []byte, off int64) (int, error) {
+	if p.index == 0 {
+		p.s.once.Do(func() { time.Sleep(p.s.delay) })
+	}
+	return p.PieceImpl.ReadAt(b, off)
+}
+
+// newResumeEngine returns engine restarted with a layer whose download was
+// interrupted once all of its pieces were written, and hashing pieces of
+// which on disk takes delay.
+func newResumeEngine(t *testing.T, root string, stall StallConfig, delay time.Duration) (*BtEngine, string) {
+	e := NewBtEngine(root, nil, nil, &Config{Stall: stall})
+	r := e.roots[0]
+	for _, dir := range []string{r.dataDir, r.torrentDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+	sum := sha256.Sum256(content)
+	id := hex.EncodeToString(sum[:])
+	if err := ioutil.WriteFile(e.GetFilePath(id), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	if err := info.BuildFromFilePath(e.GetFilePath(id)); err != nil {
+		t.Fatal(err)
+	}
+	mi := &metainfo.MetaInfo{}
+	var err error
+	if mi.InfoBytes, err = bencode.Marshal(&info); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetaInfo(e.GetPartialTorrentFilePath(id), mi); err != nil {
+		t.Fatal(err)
+	}
+
+	r.storage = &slowStorage{ClientImplCloser: storage.NewFile(r.dataDir), delay: delay}
+	tc := torrent.NewDefaultClientConfig()
+	tc.DataDir = r.dataDir
+	tc.DefaultStorage = r.storage
+	tc.ListenPort = 0
+	tc.NoDHT = true
+	tc.DisableTrackers = true
+	tc.NoDefaultPortForwarding = true
+	if e.client, err = torrent.NewClient(tc); err != nil {
+		t.Fatal(err)
+	}
+	if e.lruCache, err = lrucache.NewLRU(1<<30, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	return e, id
+}
+
+func TestResumeLayer(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		stall StallConfig
+		delay time.Duration
+	}{
+		{"restart", StallConfig{}, 0},
+		// hashing pieces on disk longer than stall timeout isn't a stall
+		{"long verification", StallConfig{StallTimeout: time.Second}, 2500 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "eagleclient")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			e, id := newResumeEngine(t, root, tc.stall, tc.delay)
+			defer e.client.Close()
+
+			if err := e.resumeDownloads(); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				if entry, ok := e.lruCache.Peek(id); ok && entry.Completed {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("expected layer downloaded by resuming")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err := e.verifyLayer(id); err != nil {
+				t.Fatalf("expected data kept, got %v", err)
+			}
+			if _, err := os.Stat(e.GetTorrentFilePath(id)); err != nil {
+				t.Fatalf("expected metainfo kept as torrent, got %v", err)
+			}
+			if _, err := os.Stat(e.GetPartialTorrentFilePath(id)); !os.IsNotExist(err) {
+				t.Fatalf("expected partial metainfo renamed, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/duyanghao/eagle/pkg/constants"
+	log "github.com/sirupsen/logrus"
+)
+
+// SeedingPolicy stops seeding cached layers once any of its thresholds is
+// reached. Data of layers stays in cache, and seeding resumes when a layer
+// is pulled locally again.
+type SeedingPolicy struct {
+	// stop after uploading MaxRatio times size of layer since seeding started
+	MaxRatio float64
+	// stop after layer is neither uploaded nor pulled locally for IdleTime
+	IdleTime time.Duration
+	// stop once tracker scrape reports more than MinSeeders seeders, by
+	// chance, see stopBySeeders
+	MinSeeders int
+	// interval between two checks, constants.DefaultRetentionInterval by default
+	Interval time.Duration
+}
+
+func (p *SeedingPolicy) enabled() bool {
+	return p != nil && (p.MaxRatio > 0 || p.IdleTime > 0 || p.MinSeeders > 0)
+}
+
+// stopBySeeders tells if a node should stop seeding a layer with seeders in
+// swarm, given x drawn from [0, 1). Nodes scrape the same tracker at about
+// the same time and see the same seeders, so rather than all of them, each
+// stops by the chance of half of the seeders in excess of MinSeeders plus a
+// margin, and the swarm shrinks towards MinSeeders round by round.
+func (p *SeedingPolicy) stopBySeeders(seeders int, x float64) bool {
+	excess := seeders - p.MinSeeders - constants.DefaultSeedersMargin
+	if p.MinSeeders <= 0 || excess <= 0 {
+		return false
+	}
+	return x < float64(excess)/float64(2*seeders)
+}
+
+// seedState tracks activity of a layer being seeded
+type seedState struct {
+	uploaded   int64
+	lastActive time.Time // last time it was uploaded or pulled locally
+}
+
+// retention applies seeding policy to layers being seeded
+type retention struct {
+	*BtEngine
+	policy *SeedingPolicy
+	client *http.Client
+
+	mu      sync.Mutex
+	states  map[string]*seedState
+	stopped map[string]bool // layers cached but not seeded
+	rand    *rand.Rand
+}
+
+func newRetention(e *BtEngine, policy *SeedingPolicy) *retention {
+	return &retention{
+		BtEngine: e,
+		policy:   policy,
+		client:   &http.Client{Timeout: constants.DefaultAnnounceTimeout},
+		states:   make(map[string]*seedState),
+		stopped:  make(map[string]bool),
+		// nodes must not draw the same numbers
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (r *retention) run() {
+	interval := r.policy.Interval
+	if interval <= 0 {
+		interval = constants.DefaultRetentionInterval
+	}
+	for {
+		time.Sleep(interval)
+		r.check()
+	}
+}
+
+// check stops seeding layers reaching any threshold of policy.
+func (r *retention) check() {
+	seeding := make(map[string]*torrent.Torrent)
+	for id, tt := range r.torrents() {
+		if entry, exist := r.lruCache.Peek(id); exist && entry.Completed && tt.Info() != nil && tt.Seeding() {
+			seeding[id] = tt
+		}
+	}
+	var seeders map[string]int
+	if r.policy.MinSeeders > 0 {
+		seeders = r.scrape(seeding)
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.states {
+		if seeding[id] == nil {
+			delete(r.states, id)
+		}
+	}
+	for id, tt := range seeding {
+		stats := tt.Stats()
+		uploaded := stats.BytesWrittenData.Int64()
+		s, ok := r.states[id]
+		if !ok {
+			s = &seedState{lastActive: now}
+			r.states[id] = s
+		}
+		if uploaded > s.uploaded {
+			s.uploaded, s.lastActive = uploaded, now
+		}
+		var reason string
+		switch {
+		case r.policy.MaxRatio > 0 && float64(uploaded) >= r.policy.MaxRatio*float64(tt.Info().TotalLength()):
+			reason = fmt.Sprintf("uploaded %d bytes, ratio %.2f reached", uploaded, r.policy.MaxRatio)
+		case r.policy.IdleTime > 0 && now.Sub(s.lastActive) >= r.policy.IdleTime:
+			reason = fmt.Sprintf("idle since %v", s.lastActive)
+		case r.policy.stopBySeeders(seeders[tt.InfoHash().HexString()], r.rand.Float64()):
+			reason = fmt.Sprintf("%d seeders in swarm", seeders[tt.InfoHash().HexString()])
+		default:
+			continue
+		}
+		log.Infof("Stop seeding layer %s: %s", id, reason)
+		delete(r.states, id)
+		r.stopped[id] = true
+		// drop torrent only, data stays in cache
+		r.deleteTorrent(id)
+		r.indexChanged()
+	}
+}
+
+// isStopped tells if seeding of layer id has been stopped.
+func (r *retention) isStopped(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped[id]
+}
+
+// restoreStopped records seeding of layer id stopped before restart.
+func (r *retention) restoreStopped(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped[id] = true
+}
+
+// torrents returns layers being seeded or downloaded with their torrents.
+func (r *retention) torrents() map[string]*torrent.Torrent {
+	r.RLock()
+	defer r.RUnlock()
+	torrents := make(map[string]*torrent.Torrent, len(r.idInfos))
+	for id, tt := range r.idInfos {
+		torrents[id] = tt
+	}
+	return torrents
+}
+
+// resume starts seeding layer id pulled locally again if its seeding has
+// been stopped, or keeps it active otherwise.
+func (r *retention) resume(id string) {
+	r.mu.Lock()
+	stopped := r.stopped[id]
+	delete(r.stopped, id)
+	if s, ok := r.states[id]; ok {
+		s.lastActive = time.Now()
+	}
+	r.mu.Unlock()
+	if !stopped {
+		return
+	}
+	r.indexChanged()
+	log.Infof("Resume seeding layer %s pulled locally", id)
+	if err := r.StartSeed(id); err != nil {
+		log.Errorf("Resume seeding layer %s failed: %v", id, err)
+	}
+}
+
+// forget drops records of layer id removed from cache.
+func (r *retention) forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.states, id)
+	delete(r.stopped, id)
+}
+
+// scrape returns seeders of torrents reported by their trackers, by hex
+// infohash. Torrents of a tracker are scraped in batches, and the most
+// seeders reported by any tracker are taken.
+func (r *retention) scrape(torrents map[string]*torrent.Torrent) map[string]int {
+	batches := make(map[string][]string)
+	for _, tt := range torrents {
+		mi := tt.Metainfo()
+		for tr := range mi.UpvertedAnnounceList().DistinctValues() {
+			batches[tr] = append(batches[tr], tt.InfoHash().AsString())
+		}
+	}
+	seeders := make(map[string]int)
+	for tr, hashes := range batches {
+		for len(hashes) > 0 {
+			n := len(hashes)
+			if n > constants.DefaultScrapeBatch {
+				n = constants.DefaultScrapeBatch
+			}
+			files, err := r.scrapeTracker(tr, hashes[:n])
+			hashes = hashes[n:]
+			if err != nil {
+				log.Warnf("Scrape tracker %s failed: %v", tr, err)
+				continue
+			}
+			for h, f := range files {
+				hex := fmt.Sprintf("%x", h)
+				if f.Complete > seeders[hex] {
+					seeders[hex] = f.Complete
+				}
+			}
+		}
+	}
+	return seeders
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type scrapeResponse struct {
+	Files         map[string]scrapeFile `bencode:"files"`
+	FailureReason string                `bencode:"failure reason"`
+}
+
+// scrapeTracker scrapes http tracker announced at announce, by convention
+// of replacing last "announce" of its path with "scrape".
+func (r *retention) scrapeTracker(announce string, hashes []string) (map[string]scrapeFile, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	for _, h := range hashes {
+		q.Add("info_hash", h)
+	}
+	u.RawQuery = q.Encode()
+	resp, err := r.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var sr scrapeResponse
+	if err := bencode.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, fmt.Errorf("decode scrape response: %v", err)
+	}
+	if sr.FailureReason != "" {
+		return nil, fmt.Errorf("tracker failure: %s", sr.FailureReason)
+	}
+	return sr.Files, nil
+}
+
+func scrapeURL(announce string) (*url.URL, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scrape of %s tracker is not supported", u.Scheme)
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, fmt.Errorf("tracker doesn't support scrape")
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	return u, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestScrapeURL(t *testing.T) {
+	for announce, want := range map[string]string{
+		"http://tracker:8000/announce":         "http://tracker:8000/scrape",
+		"http://tracker:8000/x/announce.php":   "http://tracker:8000/x/scrape.php",
+		"http://tracker:8000/announce?key=abc": "http://tracker:8000/scrape?key=abc",
+		"http://tracker:8000/a":                "",
+		"udp://tracker:8000/announce":          "",
+	} {
+		u, err := scrapeURL(announce)
+		if want == "" {
+			if err == nil {
+				t.Errorf("got scrape url %s of %s, want error", u, announce)
+			}
+			continue
+		}
+		if err != nil || u.String() != want {
+			t.Errorf("got scrape url %v, %v of %s, want %s", u, err, announce, want)
+		}
+	}
+}
+
+func TestScrapeTracker(t *testing.T) {
+	h := metainfo.NewHashFromHex("0123456789abcdef0123456789abcdef01234567")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || r.URL.Query().Get("info_hash") != h.AsString() {
+			t.Errorf("got scrape request %s", r.URL)
+		}
+		bencode.NewEncoder(w).Encode(scrapeResponse{Files: map[string]scrapeFile{
+			h.AsString(): {Complete: 3, Incomplete: 1},
+		}})
+	}))
+	defer srv.Close()
+
+	r := newRetention(nil, &SeedingPolicy{MinSeeders: 3})
+	files, err := r.scrapeTracker(srv.URL+"/announce", []string{h.AsString()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := files[h.AsString()].Complete; got != 3 {
+		t.Fatalf("got %d seeders, want 3", got)
+	}
+}
+
+func TestStopBySeeders(t *testing.T) {
+	p := &SeedingPolicy{MinSeeders: 3}
+	for _, seeders := range []int{0, 3, 5} {
+		if p.stopBySeeders(seeders, 0) {
+			t.Errorf("expected seeding kept with %d seeders", seeders)
+		}
+	}
+
+	// nodes seeing the same swarm don't all stop at once, and the swarm
+	// doesn't fall below MinSeeders
+	rnd := rand.New(rand.NewSource(1))
+	for round, seeders := 0, 100; round < 20; round++ {
+		remaining := seeders
+		for i := 0; i < seeders; i++ {
+			if p.stopBySeeders(seeders, rnd.Float64()) {
+				remaining--
+			}
+		}
+		if remaining < p.MinSeeders || round == 0 && (remaining == 0 || remaining == seeders) {
+			t.Fatalf("round %d: %d of %d seeders remaining", round, remaining, seeders)
+		}
+		seeders = remaining
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/torrent/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Placement policies of new layers among cache roots
+const (
+	// place layer into root with the most free space
+	PlacementFreeSpace = "freeSpace"
+	// place layer into root chosen by hash of its digest
+	PlacementHash = "hash"
+)
+
+// CacheRoot is a cache directory with its own size limit, e.g. on a disk.
+type CacheRoot struct {
+	Dir       string
+	LimitSize int64
+}
+
+type cacheRoot struct {
+	CacheRoot
+	dataDir    string
+	torrentDir string
+	storage    storage.ClientImplCloser
+}
+
+func newCacheRoots(roots []CacheRoot) []*cacheRoot {
+	var rs []*cacheRoot
+	for _, r := range roots {
+		rs = append(rs, &cacheRoot{
+			CacheRoot:  r,
+			dataDir:    path.Join(r.Dir, "data"),
+			torrentDir: path.Join(r.Dir, "torrents"),
+		})
+	}
+	return rs
+}
+
+// rootOf returns cache root of layer id, placing it if it is new.
+func (e *BtEngine) rootOf(id string) *cacheRoot {
+	if r := e.assignedRoot(id); r != nil {
+		return r
+	}
+	// placing asks cache of usage of roots, so do it without holding lock
+	r := e.place(id)
+	e.rootsLock.Lock()
+	defer e.rootsLock.Unlock()
+	if assigned, ok := e.layerRoots[id]; ok {
+		return assigned
+	}
+	e.layerRoots[id] = r
+	return r
+}
+
+func (e *BtEngine) assignedRoot(id string) *cacheRoot {
+	e.rootsLock.Lock()
+	defer e.rootsLock.Unlock()
+	return e.layerRoots[id]
+}
+
+func (e *BtEngine) setRoot(id string, r *cacheRoot) {
+	e.rootsLock.Lock()
+	defer e.rootsLock.Unlock()
+	e.layerRoots[id] = r
+}
+
+func (e *BtEngine) forgetRoot(id string) {
+	e.rootsLock.Lock()
+	defer e.rootsLock.Unlock()
+	delete(e.layerRoots, id)
+}
+
+// cacheGroup is group of layer id in lruCache, which is its cache root.
+func (e *BtEngine) cacheGroup(id string) string {
+	if r := e.assignedRoot(id); r != nil {
+		return r.Dir
+	}
+	return e.roots[0].Dir
+}
+
+// place chooses cache root of new layer id by placement policy.
+func (e *BtEngine) place(id string) *cacheRoot {
+	if len(e.roots) == 1 {
+		return e.roots[0]
+	}
+	if e.config.Placement == PlacementHash {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return e.roots[h.Sum32()%uint32(len(e.roots))]
+	}
+	var (
+		best     *cacheRoot
+		bestFree int64
+	)
+	for _, r := range e.roots {
+		free := r.LimitSize
+		if e.lruCache != nil {
+			free -= e.lruCache.GroupSize(r.Dir)
+		}
+		if disk := diskFree(r.dataDir); disk >= 0 && disk < free {
+			free = disk
+		}
+		if best == nil || free > bestFree {
+			best, bestFree = r, free
+		}
+	}
+	return best
+}
+
+// scanLayers returns layer files of all cache roots, and records their
+// roots. Copies of a layer found in more than one root are removed but the
+// first one.
+func (e *BtEngine) scanLayers() ([]os.FileInfo, error) {
+	var layers []os.FileInfo
+	for _, r := range e.roots {
+		files, err := ioutil.ReadDir(r.dataDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".layer" {
+				continue
+			}
+			id := strings.TrimSuffix(f.Name(), ".layer")
+			if other := e.assignedRoot(id); other != nil && other != r {
+				log.Warnf("Layer %s is found in both %s and %s, remove the latter", id, other.Dir, r.Dir)
+				os.Remove(path.Join(r.dataDir, f.Name()))
+				os.Remove(path.Join(r.torrentDir, id+".torrent"))
+				continue
+			}
+			e.setRoot(id, r)
+			layers = append(layers, f)
+		}
+	}
+	return layers, nil
+}
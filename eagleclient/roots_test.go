@@ -0,0 +1,65 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/duyanghao/eagle/pkg/utils/lrucache"
+)
+
+func TestCacheRoots(t *testing.T) {
+	dir := t.TempDir()
+	roots := []CacheRoot{{Dir: path.Join(dir, "a"), LimitSize: 100}, {Dir: path.Join(dir, "b"), LimitSize: 30}}
+	e := NewBtEngine(dir, nil, nil, &Config{Roots: roots})
+	var err error
+	e.lruCache, err = lrucache.NewLRU(130, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.lruCache.SetGroups(e.cacheGroup, map[string]int64{roots[0].Dir: 100, roots[1].Dir: 30})
+
+	// new layers go to root with the most free space within its limit
+	if r := e.rootOf("l1"); r.Dir != roots[0].Dir {
+		t.Fatalf("got root %s of l1, want %s", r.Dir, roots[0].Dir)
+	}
+	now := time.Now()
+	e.lruCache.Restore("l1", 80, now.Add(-time.Hour), false)
+	if r := e.rootOf("l2"); r.Dir != roots[1].Dir {
+		t.Fatalf("got root %s of l2, want %s", r.Dir, roots[1].Dir)
+	}
+	if got, want := e.GetFilePath("l2"), path.Join(roots[1].Dir, "data", "l2.layer"); got != want {
+		t.Fatalf("got path %s of l2, want %s", got, want)
+	}
+
+	// exceeding limit of a root evicts its own layers only
+	e.lruCache.Restore("l2", 20, now.Add(-2*time.Hour), false)
+	e.setRoot("l3", e.roots[1])
+	e.lruCache.Restore("l3", 20, now, false)
+	if keys, want := e.lruCache.Keys(), []string{"l3", "l1"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got keys %v, want %v", keys, want)
+	}
+	if size := e.lruCache.GroupSize(roots[1].Dir); size != 20 {
+		t.Fatalf("got size %d of %s, want 20", size, roots[1].Dir)
+	}
+
+	// hash placement is stable
+	e.config.Placement = PlacementHash
+	if e.place("l4") != e.place("l4") {
+		t.Fatal("got different roots of l4 by hash")
+	}
+}
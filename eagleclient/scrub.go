@@ -0,0 +1,98 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	log "github.com/sirupsen/logrus"
+)
+
+// scrubSource implements scrubber.Source for layers cached in data directories of cache roots.
+type scrubSource struct {
+	*BtEngine
+}
+
+func (e scrubSource) Blobs() ([]string, error) {
+	var ids []string
+	for _, r := range e.roots {
+		files, err := ioutil.ReadDir(r.dataDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".layer" {
+				continue
+			}
+			id := strings.TrimSuffix(f.Name(), ".layer")
+			// skip layers in progress
+			if entry, exist := e.lruCache.Peek(id); exist && entry.Completed {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (e scrubSource) Open(id string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(e.GetFilePath(id))
+	if err != nil {
+		return nil, 0, backenderrors.FromOS(id, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, backenderrors.FromOS(id, err)
+	}
+	return f, fi.Size(), nil
+}
+
+func (e scrubSource) Stat(id string) (int64, error) {
+	fi, err := os.Stat(e.GetFilePath(id))
+	if err != nil {
+		return 0, backenderrors.FromOS(id, err)
+	}
+	return fi.Size(), nil
+}
+
+func (e scrubSource) Info(id string) (*metainfo.Info, error) {
+	mi, err := metainfo.LoadFromFile(e.GetTorrentFilePath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, id, err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, id, err)
+	}
+	return &info, nil
+}
+
+// Quarantine stops seeding corrupt layer and removes it, so that it is
+// downloaded again on next pull.
+func (e scrubSource) Quarantine(id string, reason error) {
+	log.Errorf("Quarantine corrupt layer %s: %v", id, reason)
+	// evicting from lruCache drops torrent and removes files as well
+	if !e.lruCache.Remove(id) {
+		e.DeleteTorrent(id)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons of aborting a download
+const (
+	AbortNoProgress    = "no_progress"
+	AbortLowThroughput = "low_throughput"
+	AbortDeadline      = "deadline"
+)
+
+// abortStats records number of aborted downloads per reason
+var abortStats = expvar.NewMap("eagleclient_download_aborts")
+
+// AbortError is returned when a download is aborted by stall detection. It is
+// of backenderrors.ErrUnavailable kind, so that blob is fetched from origin.
+type AbortError struct {
+	ID     string
+	Reason string
+	Detail string
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("download of layer %s aborted for %s: %s", e.ID, e.Reason, e.Detail)
+}
+
+func (e *AbortError) Unwrap() error {
+	return backenderrors.ErrUnavailable
+}
+
+// StallConfig defines when a download is considered stalled
+type StallConfig struct {
+	// abort if no bytes arrive for StallTimeout
+	StallTimeout time.Duration
+	// abort if throughput over the last ThroughputWindow stays below
+	// MinThroughput bytes per second, disabled if MinThroughput is 0
+	MinThroughput    int64
+	ThroughputWindow time.Duration
+	// abort if download doesn't complete within MaxDownloadTime, disabled if 0
+	MaxDownloadTime time.Duration
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// stallDetector tracks progress of a download and tells whether it stalls.
+type stallDetector struct {
+	config       StallConfig
+	start        time.Time
+	lastProgress time.Time
+	lastBytes    int64
+	samples      []progressSample // samples within throughput window, oldest first
+}
+
+func newStallDetector(config StallConfig, start time.Time) *stallDetector {
+	return &stallDetector{
+		config:       config,
+		start:        start,
+		lastProgress: start,
+		samples:      []progressSample{{at: start}},
+	}
+}
+
+// check records completed bytes at now, and returns reason and detail of
+// aborting the download, or an empty reason if it is progressing.
+func (d *stallDetector) check(now time.Time, completed int64) (string, string) {
+	if completed > d.lastBytes {
+		d.lastBytes, d.lastProgress = completed, now
+	}
+	if d.config.MaxDownloadTime > 0 && now.Sub(d.start) >= d.config.MaxDownloadTime {
+		return AbortDeadline, fmt.Sprintf("not completed within %s", d.config.MaxDownloadTime)
+	}
+	if d.config.StallTimeout > 0 && now.Sub(d.lastProgress) >= d.config.StallTimeout {
+		return AbortNoProgress, fmt.Sprintf("no bytes arrived for %s", now.Sub(d.lastProgress))
+	}
+	if d.config.MinThroughput <= 0 || d.config.ThroughputWindow <= 0 {
+		return "", ""
+	}
+	d.samples = append(d.samples, progressSample{at: now, bytes: completed})
+	// keep the latest sample which is at least a window old as base
+	for len(d.samples) > 1 && now.Sub(d.samples[1].at) >= d.config.ThroughputWindow {
+		d.samples = d.samples[1:]
+	}
+	base := d.samples[0]
+	elapsed := now.Sub(base.at)
+	if elapsed < d.config.ThroughputWindow {
+		return "", ""
+	}
+	if rate := float64(completed-base.bytes) / elapsed.Seconds(); rate < float64(d.config.MinThroughput) {
+		return AbortLowThroughput, fmt.Sprintf("%.0f bytes/s over %s below %d bytes/s", rate, elapsed, d.config.MinThroughput)
+	}
+	return "", ""
+}
+
+// watchProgress watches progress of layer being downloaded until ctx is
+// done. Once the download stalls, abort error is sent to aborted and the
+// download is canceled.
+func (e *BtEngine) watchProgress(ctx context.Context, id string, cancel context.CancelFunc, aborted chan<- error) {
+	detector := newStallDetector(e.config.Stall, time.Now())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var completed int64
+			if tt := e.getTorrent(id); tt != nil && tt.Info() != nil {
+				completed = tt.BytesCompleted()
+			}
+			reason, detail := detector.check(now, completed)
+			if reason == "" {
+				continue
+			}
+			err := &AbortError{ID: id, Reason: reason, Detail: detail}
+			log.Errorf("Abort download of layer %s: %v", id, err)
+			abortStats.Add(reason, 1)
+			aborted <- err
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStallDetector(t *testing.T) {
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	d := newStallDetector(StallConfig{StallTimeout: 10 * time.Second}, start)
+	if reason, _ := d.check(at(9), 0); reason != "" {
+		t.Fatalf("expected no abort before stall timeout, got %s", reason)
+	}
+	if reason, _ := d.check(at(15), 100); reason != "" {
+		t.Fatalf("expected progress to reset stall timeout, got %s", reason)
+	}
+	if reason, _ := d.check(at(25), 100); reason != AbortNoProgress {
+		t.Fatalf("expected %s, got %q", AbortNoProgress, reason)
+	}
+
+	d = newStallDetector(StallConfig{MinThroughput: 100, ThroughputWindow: 10 * time.Second}, start)
+	for s := 1; s <= 20; s++ {
+		// 150 bytes/s for 10s, then 50 bytes/s
+		bytes := int64(150 * s)
+		if s > 10 {
+			bytes = 1500 + int64(50*(s-10))
+		}
+		reason, _ := d.check(at(s), bytes)
+		if s <= 15 && reason != "" {
+			t.Fatalf("expected no abort at %ds, got %s", s, reason)
+		}
+		if s == 20 && reason != AbortLowThroughput {
+			t.Fatalf("expected %s at %ds, got %q", AbortLowThroughput, s, reason)
+		}
+	}
+
+	d = newStallDetector(StallConfig{StallTimeout: time.Hour, MaxDownloadTime: time.Minute}, start)
+	if reason, _ := d.check(at(60), 1<<30); reason != AbortDeadline {
+		t.Fatalf("expected %s, got %q", AbortDeadline, reason)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	distdigests "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// LayerReader reads content of a layer, which may still be downloading.
+type LayerReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// OpenLayer returns reader of layer and its size. Cached layers are read
+// from local file, otherwise the layer is downloaded in background and the
+// reader is returned as soon as metainfo of layer is loaded. Reads block
+// until the pieces covering them are downloaded, and pieces just ahead of
+// read position are prioritised. Layer is kept in cache until the reader
+// is closed.
+func (e *BtEngine) OpenLayer(req *http.Request, blobUrl string) (LayerReader, int64, error) {
+	digest := blobUrl[strings.LastIndex(blobUrl, "/")+1:]
+	id := distdigests.Digest(digest).Encoded()
+	if err := e.checkRejected(id); err != nil {
+		return nil, -1, err
+	}
+	if entry, exist := e.lruCache.Get(id); exist && entry.Completed {
+		if f, size, err := e.openLayerFile(id); err == nil {
+			log.Infof("layer: %s has been cached, stream it from local file", id)
+			e.resumeSeeding(id)
+			return f, size, nil
+		}
+	}
+
+	// wait for torrent before starting download, so that it isn't missed
+	added, cancel := e.waitTorrent(id)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.downloadLayerSync(req, blobUrl)
+		done <- err
+	}()
+	var (
+		tt      *torrent.Torrent
+		gotInfo <-chan struct{}
+	)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return nil, -1, err
+			}
+			return e.openLayerFile(id)
+		case tt = <-added:
+			added, gotInfo = nil, tt.GotInfo()
+		case <-gotInfo:
+			r, ok := e.newLayerReader(id, tt, done)
+			if !ok {
+				// torrent of layer removed while in use, wait for download
+				gotInfo = nil
+				continue
+			}
+			log.Infof("stream layer: %s while it's being downloaded", id)
+			return r, tt.Info().TotalLength(), nil
+		}
+	}
+}
+
+// openLayerFile opens file of cached layer id, which is kept from eviction
+// until the file is closed.
+func (e *BtEngine) openLayerFile(id string) (LayerReader, int64, error) {
+	entry, exist := e.lruCache.Acquire(id)
+	if !exist {
+		return nil, -1, fmt.Errorf("layer %s is not cached", id)
+	}
+	release := e.releaser(id)
+	if !entry.Completed {
+		release()
+		return nil, -1, fmt.Errorf("layer %s is not cached", id)
+	}
+	f, err := os.Open(e.GetFilePath(id))
+	if err != nil {
+		release()
+		return nil, -1, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		release()
+		return nil, -1, err
+	}
+	return &layerFile{File: f, release: release}, fi.Size(), nil
+}
+
+// newLayerReader returns reader of layer id being downloaded by tt, which is
+// kept in cache until the reader is closed. Returns false if layer isn't
+// in cache, e.g. it is being removed.
+func (e *BtEngine) newLayerReader(id string, tt *torrent.Torrent, done <-chan error) (LayerReader, bool) {
+	if _, exist := e.lruCache.Acquire(id); !exist {
+		return nil, false
+	}
+	r := tt.NewReader()
+	r.SetResponsive()
+	r.SetReadahead(e.config.StreamReadahead)
+	return &streamReader{Reader: r, done: done, release: e.releaser(id)}, true
+}
+
+// releaser returns func releasing layer id acquired in cache, which does
+// nothing once it has been called.
+func (e *BtEngine) releaser(id string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { e.lruCache.Release(id) })
+	}
+}
+
+// layerFile reads file of cached layer, releasing the layer once closed.
+type layerFile struct {
+	*os.File
+	release func()
+}
+
+func (f *layerFile) Close() error {
+	defer f.release()
+	return f.File.Close()
+}
+
+// streamReader reads layer being downloaded. Reaching end of layer doesn't
+// complete reading until the download completes, so that layer failing
+// verification ends up with an error rather than a successful response.
+type streamReader struct {
+	torrent.Reader
+	done     <-chan error
+	finished bool
+	err      error
+	release  func()
+}
+
+func (r *streamReader) Close() error {
+	defer r.release()
+	return r.Reader.Close()
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	return r.ReadContext(context.Background(), b)
+}
+
+func (r *streamReader) ReadContext(ctx context.Context, b []byte) (int, error) {
+	n, err := r.Reader.ReadContext(ctx, b)
+	if err != io.EOF {
+		return n, err
+	}
+	if !r.finished {
+		select {
+		case r.err = <-r.done:
+			r.finished = true
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+	if r.err != nil {
+		return n, r.err
+	}
+	return n, io.EOF
+}
+
+func (e *BtEngine) getTorrent(id string) *torrent.Torrent {
+	e.RLock()
+	defer e.RUnlock()
+	return e.idInfos[id]
+}
+
+// waitTorrent returns channel receiving torrent of layer id once it's added,
+// or right away if it exists, and func to stop waiting.
+func (e *BtEngine) waitTorrent(id string) (<-chan *torrent.Torrent, func()) {
+	w := make(chan *torrent.Torrent, 1)
+	e.Lock()
+	defer e.Unlock()
+	if tt, ok := e.idInfos[id]; ok {
+		w <- tt
+		return w, func() {}
+	}
+	if e.torrentWaits == nil {
+		e.torrentWaits = make(map[string][]chan *torrent.Torrent)
+	}
+	e.torrentWaits[id] = append(e.torrentWaits[id], w)
+	return w, func() {
+		e.Lock()
+		defer e.Unlock()
+		waits := e.torrentWaits[id]
+		for i := range waits {
+			if waits[i] == w {
+				waits = append(waits[:i], waits[i+1:]...)
+				break
+			}
+		}
+		if len(waits) == 0 {
+			delete(e.torrentWaits, id)
+		} else {
+			e.torrentWaits[id] = waits
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+func TestWaitTorrent(t *testing.T) {
+	e := &BtEngine{idInfos: make(map[string]*torrent.Torrent)}
+	added, cancel := e.waitTorrent("a")
+	defer cancel()
+	_, cancelB := e.waitTorrent("b")
+	cancelB()
+	if _, ok := e.torrentWaits["b"]; ok {
+		t.Fatal("expected cancelled waiter removed")
+	}
+
+	tt := &torrent.Torrent{}
+	go e.addTorrent("a", tt)
+	select {
+	case got := <-added:
+		if got != tt {
+			t.Fatalf("got torrent %p, want %p", got, tt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected waiter notified of added torrent")
+	}
+
+	// torrent existing already is returned right away
+	added, cancel = e.waitTorrent("a")
+	defer cancel()
+	if got := <-added; got != tt {
+		t.Fatalf("got torrent %p, want %p", got, tt)
+	}
+}
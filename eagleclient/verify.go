@@ -0,0 +1,120 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"github.com/duyanghao/eagle/pkg/constants"
+	pb "github.com/duyanghao/eagle/proto/metainfo"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DigestMismatchError is returned when content of a downloaded layer doesn't
+// match the digest it was requested by, e.g. the torrent served by seeder
+// was bad. It is of backenderrors.ErrCorrupt kind.
+type DigestMismatchError struct {
+	ID     string
+	Actual string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("content digest sha256:%s of layer %s mismatches", e.Actual, e.ID)
+}
+
+func (e *DigestMismatchError) Unwrap() error {
+	return backenderrors.ErrCorrupt
+}
+
+// IsDigestMismatch returns true if err is caused by digest mismatch of layer.
+func IsDigestMismatch(err error) bool {
+	var e *DigestMismatchError
+	return errors.As(err, &e)
+}
+
+// verifyLayer checks sha256 of layer file against its id.
+func (e *BtEngine) verifyLayer(id string) error {
+	f, err := os.Open(e.GetFilePath(id))
+	if err != nil {
+		return backenderrors.FromOS(id, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != id {
+		return &DigestMismatchError{ID: id, Actual: sum}
+	}
+	return nil
+}
+
+type rejection struct {
+	err   error
+	until time.Time
+}
+
+// rejectLayer remembers that layer id failed digest verification, so that it
+// is pulled from origin directly for a while, since seeder would serve the
+// same content again. Seeder is asked to verify its copy of layer and fetch
+// it from origin again if corrupt.
+func (e *BtEngine) rejectLayer(req *http.Request, id string, err error) {
+	e.rejectedLock.Lock()
+	if e.rejected == nil {
+		e.rejected = make(map[string]rejection)
+	}
+	e.rejected[id] = rejection{err: err, until: time.Now().Add(constants.DefaultRejectionTTL)}
+	e.rejectedLock.Unlock()
+	log.Errorf("Layer %s failed digest verification, pull it from origin for %s", id, constants.DefaultRejectionTTL)
+
+	if e.metaInfoClient == nil {
+		return
+	}
+	go func() {
+		// seeder goes on verifying and fetching layer after deadline
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := e.metaInfoClient.GetMetaInfo(ctx, &pb.MetaInfoRequest{Url: req.URL.Path, Refetch: true})
+		if err != nil && status.Code(err) != codes.DeadlineExceeded {
+			log.Warnf("Ask seeder to refetch layer %s failed: %v", id, err)
+		}
+	}()
+}
+
+// checkRejected returns error of layer id if it failed digest verification
+// recently.
+func (e *BtEngine) checkRejected(id string) error {
+	e.rejectedLock.Lock()
+	defer e.rejectedLock.Unlock()
+	r, ok := e.rejected[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(r.until) {
+		delete(e.rejected, id)
+		return nil
+	}
+	return r.err
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package eagleclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	pb "github.com/duyanghao/eagle/proto/metainfo"
+	"google.golang.org/grpc"
+)
+
+func TestVerifyLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "eagleclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	e := NewBtEngine(root, nil, nil, nil)
+	if err := os.MkdirAll(e.roots[0].dataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("layer"))
+	id := hex.EncodeToString(sum[:])
+	if err := ioutil.WriteFile(e.GetFilePath(id), []byte("layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.verifyLayer(id); err != nil {
+		t.Fatalf("expected layer to be verified, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(e.GetFilePath(id), []byte("poisoned"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = e.verifyLayer(id)
+	if !IsDigestMismatch(err) || !backenderrors.IsCorrupt(err) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+	if backenderrors.IsRetryable(err) {
+		t.Fatal("expected digest mismatch not to be retryable")
+	}
+}
+
+type refetchClient chan *pb.MetaInfoRequest
+
+func (c refetchClient) GetMetaInfo(ctx context.Context, in *pb.MetaInfoRequest, opts ...grpc.CallOption) (*pb.MetaInfoReply, error) {
+	c <- in
+	return &pb.MetaInfoReply{}, nil
+}
+
+func TestRejectLayer(t *testing.T) {
+	requests := make(refetchClient, 1)
+	e := &BtEngine{metaInfoClient: requests}
+	id := "0123"
+	if err := e.checkRejected(id); err != nil {
+		t.Fatalf("expected layer not rejected, got %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://registry/v2/foo/blobs/sha256:"+id, nil)
+	e.rejectLayer(req, id, &DigestMismatchError{ID: id, Actual: "4567"})
+	if err := e.checkRejected(id); !IsDigestMismatch(err) {
+		t.Fatalf("expected digest mismatch of rejected layer, got %v", err)
+	}
+	select {
+	case in := <-requests:
+		if !in.Refetch || in.Url != req.URL.Path {
+			t.Fatalf("got request %+v, want refetch of %s", in, req.URL.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected seeder asked to refetch layer")
+	}
+
+	// rejection expires
+	e.rejected[id] = rejection{err: e.rejected[id].err, until: time.Now().Add(-time.Second)}
+	if err := e.checkRejected(id); err != nil {
+		t.Fatalf("expected rejection expired, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/anacrolix/torrent v1.15.0
 	github.com/coreos/etcd v3.3.20+incompatible // indirect
 	github.com/golang/protobuf v1.4.0
+	github.com/klauspost/compress v1.10.11
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/opencontainers/go-digest v1.0.0-rc1
 	github.com/pborman/uuid v1.2.0 // indirect
@@ -16,6 +17,5 @@ require (
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	//google.golang.org/grpc v1.19.0
 	google.golang.org/grpc v1.23.1
-	gopkg.in/cheggaaa/pb.v1 v1.0.28
 	gopkg.in/yaml.v2 v2.2.7
 )
@@ -0,0 +1,103 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backenderrors
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBlobNotFound is returned when a blob doesn't exist in storage backend.
+	ErrBlobNotFound = errors.New("blob not found")
+	// ErrBlobExist is returned when a blob to be created exists already.
+	ErrBlobExist = errors.New("blob already exists")
+	// ErrQuotaExceeded is returned when storage backend runs out of space or quota.
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrUnavailable is returned when storage backend can't serve the request
+	// temporarily, e.g. network failures or timeouts. Callers may retry later.
+	ErrUnavailable = errors.New("storage backend unavailable")
+	// ErrCorrupt is returned when content of a blob is found damaged.
+	ErrCorrupt = errors.New("blob corrupted")
+	// ErrInternal is returned when storage backend fails permanently for
+	// reasons other than above, e.g. permission denied or read-only file system.
+	ErrInternal = errors.New("storage backend internal error")
+)
+
+// Error describes a failed operation of storage backend. Kind is one of
+// the errors above, so that callers can check it through errors.Is, while
+// the underlying Err is still reachable through errors.Is and errors.As.
+type Error struct {
+	Kind error
+	Name string
+	Err  error
+}
+
+// New returns an Error of kind for operation on name caused by err.
+func New(kind error, name string, err error) error {
+	return &Error{Kind: kind, Name: name, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.Name, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Name, e.Kind, e.Err)
+}
+
+// Is reports whether target is kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsNotFound returns true if err is ErrBlobNotFound.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrBlobNotFound)
+}
+
+// IsExist returns true if err is ErrBlobExist.
+func IsExist(err error) bool {
+	return errors.Is(err, ErrBlobExist)
+}
+
+// IsQuotaExceeded returns true if err is ErrQuotaExceeded.
+func IsQuotaExceeded(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded)
+}
+
+// IsUnavailable returns true if err is ErrUnavailable.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
+// IsCorrupt returns true if err is ErrCorrupt.
+func IsCorrupt(err error) bool {
+	return errors.Is(err, ErrCorrupt)
+}
+
+// IsInternal returns true if err is ErrInternal.
+func IsInternal(err error) bool {
+	return errors.Is(err, ErrInternal)
+}
+
+// IsRetryable returns true if the operation failed with err may succeed when
+// retried against the same backend.
+func IsRetryable(err error) bool {
+	return IsUnavailable(err)
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backenderrors
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		kind error
+		code codes.Code
+	}{
+		{ErrBlobNotFound, codes.NotFound},
+		{ErrBlobExist, codes.AlreadyExists},
+		{ErrQuotaExceeded, codes.ResourceExhausted},
+		{ErrUnavailable, codes.Unavailable},
+		{ErrCorrupt, codes.DataLoss},
+		{ErrInternal, codes.Internal},
+	} {
+		s := ToStatus(New(tc.kind, "blob", errors.New("cause")))
+		if got := status.Code(s); got != tc.code {
+			t.Errorf("%v: got code %s, want %s", tc.kind, got, tc.code)
+		}
+		if err := FromStatus("blob", s); !errors.Is(err, tc.kind) {
+			t.Errorf("%v: got %v after round trip", tc.kind, err)
+		}
+	}
+}
+
+func TestStatusUnknown(t *testing.T) {
+	if got := status.Code(ToStatus(errors.New("plain"))); got != codes.Unknown {
+		t.Fatalf("got code %s of plain error, want %s", got, codes.Unknown)
+	}
+	s := status.Error(codes.PermissionDenied, "denied")
+	if err := FromStatus("blob", s); err != s {
+		t.Fatalf("got %v, want status error unchanged", err)
+	}
+	// status errors are passed through
+	if err := ToStatus(s); err != s {
+		t.Fatalf("got %v, want status error unchanged", err)
+	}
+	if ToStatus(nil) != nil || FromStatus("blob", nil) != nil {
+		t.Fatal("expected nil error to stay nil")
+	}
+}
+
+func TestErrorKeepsCause(t *testing.T) {
+	err := New(ErrBlobNotFound, "blob", os.ErrNotExist)
+	if !IsNotFound(err) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected both kind and cause of %v", err)
+	}
+	if errors.Is(err, ErrUnavailable) {
+		t.Fatalf("unexpected kind of %v", err)
+	}
+	if IsRetryable(New(ErrQuotaExceeded, "blob", nil)) || !IsRetryable(New(ErrUnavailable, "blob", nil)) {
+		t.Fatal("expected only unavailable errors to be retryable")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backenderrors
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ToStatus converts err into a gRPC status error carrying the code of its kind.
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(code(err), err.Error())
+}
+
+func code(err error) codes.Code {
+	switch {
+	case IsNotFound(err):
+		return codes.NotFound
+	case IsExist(err):
+		return codes.AlreadyExists
+	case IsQuotaExceeded(err):
+		return codes.ResourceExhausted
+	case IsUnavailable(err):
+		return codes.Unavailable
+	case IsCorrupt(err):
+		return codes.DataLoss
+	case IsInternal(err):
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// FromStatus converts a gRPC status error back into an Error of relevant kind
+// for operation on name. Errors without known code are returned unchanged.
+func FromStatus(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	var kind error
+	switch s.Code() {
+	case codes.NotFound:
+		kind = ErrBlobNotFound
+	case codes.AlreadyExists:
+		kind = ErrBlobExist
+	case codes.ResourceExhausted:
+		kind = ErrQuotaExceeded
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		kind = ErrUnavailable
+	case codes.DataLoss:
+		kind = ErrCorrupt
+	case codes.Internal:
+		kind = ErrInternal
+	default:
+		return err
+	}
+	return New(kind, name, errors.New(s.Message()))
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backenderrors
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// FromOS converts error of file system operation on name into backend error.
+func FromOS(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var kind error
+	switch {
+	case os.IsNotExist(err):
+		kind = ErrBlobNotFound
+	case os.IsExist(err):
+		kind = ErrBlobExist
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		kind = ErrQuotaExceeded
+	case errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EBUSY),
+		errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		kind = ErrUnavailable
+	default:
+		kind = ErrInternal
+	}
+	return New(kind, name, err)
+}
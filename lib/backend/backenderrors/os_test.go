@@ -0,0 +1,48 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backenderrors
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFromOS(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		kind      error
+		retryable bool
+	}{
+		{os.ErrNotExist, ErrBlobNotFound, false},
+		{os.ErrExist, ErrBlobExist, false},
+		{syscall.ENOSPC, ErrQuotaExceeded, false},
+		{syscall.EMFILE, ErrUnavailable, true},
+		{syscall.EACCES, ErrInternal, false},
+		{syscall.EISDIR, ErrInternal, false},
+		{syscall.EROFS, ErrInternal, false},
+	} {
+		err := FromOS("blob", &os.PathError{Op: "open", Path: "blob", Err: tc.err})
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%v: got %v, want kind %v", tc.err, err, tc.kind)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: cause is lost in %v", tc.err, err)
+		}
+		if got := IsRetryable(err); got != tc.retryable {
+			t.Errorf("%v: got retryable %t, want %t", tc.err, got, tc.retryable)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DecodeConfig decodes raw config into out, which is the schema declared by
+// backend or middleware. Unknown fields are rejected so that typos in
+// configuration are reported instead of being silently ignored.
+func DecodeConfig(raw interface{}, out interface{}) error {
+	if raw == nil {
+		return nil
+	}
+	confBytes, err := yaml.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("marshal config: %s", err)
+	}
+	if err := yaml.UnmarshalStrict(confBytes, out); err != nil {
+		return fmt.Errorf("unmarshal config: %s", err)
+	}
+	return nil
+}
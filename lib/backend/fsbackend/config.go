@@ -17,4 +17,5 @@ package fsbackend
 // parameters and authetication credentials
 type Config struct {
 	RootDirectory string `yaml:"rootDirectory"` // filesystem root directory
+	Layout        string `yaml:"layout"`        // blob layout under root directory: flat(default) or sharded
 }
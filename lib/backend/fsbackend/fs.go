@@ -16,23 +16,17 @@ package fsbackend
 import (
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 )
 
 // Create creates name and returns io.Writer
 func (fs *Storage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error {
-	tFile, err := os.Create(name)
-	if err != nil {
-		return err
-	}
-	defer tFile.Close()
-
-	if err = info.Write(tFile); err != nil {
-		return err
-	}
-	return nil
+	return backenderrors.FromOS(name, fs.writeFile(name, info.Write))
 }
 
 // Stat is useful when we need to quickly know if a blob exists (and maybe
@@ -41,7 +35,7 @@ func (fs *Storage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) erro
 func (fs *Storage) Stat(name string) (*backend.FileInfo, error) {
 	f, err := os.Lstat(name)
 	if err != nil {
-		return nil, err
+		return nil, backenderrors.FromOS(name, err)
 	}
 	return &backend.FileInfo{
 		Name:   f.Name(),
@@ -51,31 +45,53 @@ func (fs *Storage) Stat(name string) (*backend.FileInfo, error) {
 
 // Upload writes data to name file
 func (fs *Storage) Upload(name string, data []byte) error {
-	return ioutil.WriteFile(name, data, 0644)
+	return backenderrors.FromOS(name, fs.writeFile(name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}))
 }
 
 // Download reads file content from name
 func (fs *Storage) Download(name string) ([]byte, error) {
 	content, err := ioutil.ReadFile(name)
 	if err != nil {
-		return nil, err
+		return nil, backenderrors.FromOS(name, err)
 	}
 	return content, nil
 }
 
+// DownloadRange reads length bytes of file content from name starting at offset
+func (fs *Storage) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, backenderrors.FromOS(name, err)
+	}
+	defer f.Close()
+	content := make([]byte, length)
+	n, err := f.ReadAt(content, offset)
+	if err != nil && err != io.EOF {
+		return nil, backenderrors.FromOS(name, err)
+	}
+	return content[:n], nil
+}
+
 // Delete removes name file
 func (fs *Storage) Delete(name string) error {
-	return os.Remove(name)
+	return backenderrors.FromOS(name, os.Remove(name))
 }
 
 // List lists fileEntries whose names start with prefix.
 func (fs *Storage) List(prefix string) ([]*backend.FileInfo, error) {
-	files, err := ioutil.ReadDir(prefix)
+	files, err := fs.listDir(prefix)
 	if err != nil {
-		return nil, err
+		return nil, backenderrors.FromOS(prefix, err)
 	}
 	var infos []*backend.FileInfo
 	for _, f := range files {
+		// skip temporary files of in-flight writes
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
 		infos = append(infos, &backend.FileInfo{
 			Name:   f.Name(),
 			Length: f.Size(),
@@ -86,12 +102,12 @@ func (fs *Storage) List(prefix string) ([]*backend.FileInfo, error) {
 
 // GetFilePath returns data file path
 func (fs *Storage) GetFilePath(id string) string {
-	return path.Join(fs.config.RootDirectory, "data", id+".layer")
+	return fs.resolve(fs.GetDataDir(), id, _layerSuffix)
 }
 
 // GetTorrentFilePath returns torrent file path
 func (fs *Storage) GetTorrentFilePath(id string) string {
-	return path.Join(fs.config.RootDirectory, "torrents", id+".torrent")
+	return fs.resolve(fs.GetTorrentDir(), id, _torrentSuffix)
 }
 
 func (fs *Storage) GetDataDir() string {
@@ -0,0 +1,209 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fsbackend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_journalFile = "journal"
+	_tmpSuffix   = ".tmp"
+
+	_opBegin  = "begin"
+	_opCommit = "commit"
+)
+
+// record is an entry of intent journal. Every write is recorded as begin
+// before its temporary file is created and as commit after the temporary
+// file has been renamed into place.
+type record struct {
+	Op   string `json:"op"`
+	Tmp  string `json:"tmp"`
+	Name string `json:"name,omitempty"`
+}
+
+// journal is an append-only intent journal of in-flight writes, which is
+// truncated whenever no write is in flight so that it stays small.
+type journal struct {
+	sync.Mutex
+	path    string
+	f       *os.File
+	pending int
+}
+
+func newJournal(root string) *journal {
+	return &journal{path: path.Join(root, _journalFile)}
+}
+
+func (j *journal) append(r record, sync bool) error {
+	if j.f == nil {
+		f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		j.f = f
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+// begin durably records the intent of writing name through tmp.
+func (j *journal) begin(tmp, name string) error {
+	j.Lock()
+	defer j.Unlock()
+	if err := j.append(record{Op: _opBegin, Tmp: tmp, Name: name}, true); err != nil {
+		return fmt.Errorf("journal write of %s: %v", name, err)
+	}
+	j.pending++
+	return nil
+}
+
+// commit records completion of the write through tmp. It doesn't need to be
+// durable, since replaying a committed write only removes a missing file.
+func (j *journal) commit(tmp string) {
+	j.Lock()
+	defer j.Unlock()
+	j.pending--
+	if j.pending > 0 {
+		if err := j.append(record{Op: _opCommit, Tmp: tmp}, false); err != nil {
+			log.Errorf("Commit journal of %s failed: %v", tmp, err)
+		}
+		return
+	}
+	if err := j.f.Truncate(0); err != nil {
+		log.Errorf("Truncate journal %s failed: %v", j.path, err)
+	}
+}
+
+// replay removes temporary files of writes which were in flight when the
+// process stopped. Since temporary files are synced before being renamed,
+// destinations are either absent or complete and are kept as they are.
+func (j *journal) replay() error {
+	j.Lock()
+	defer j.Unlock()
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	inflight := make(map[string]string)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// torn record of the last write is ignored, its file was never created
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			log.Warnf("Skip corrupted journal record %q: %v", line, err)
+			continue
+		}
+		switch r.Op {
+		case _opBegin:
+			inflight[r.Tmp] = r.Name
+		case _opCommit:
+			delete(inflight, r.Tmp)
+		}
+	}
+	f.Close()
+	for tmp, name := range inflight {
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove incomplete write %s of %s: %v", tmp, name, err)
+		}
+		log.Warnf("Removed incomplete write %s of %s", tmp, name)
+	}
+	if len(inflight) > 0 {
+		log.Infof("Replay journal %s completed, %d incomplete writes removed", j.path, len(inflight))
+	}
+	return os.Truncate(j.path, 0)
+}
+
+var _tmpSeq uint64
+
+// tmpPath returns a unique temporary path next to name, which is hidden
+// from listing since it starts with a dot.
+func tmpPath(name string) string {
+	seq := atomic.AddUint64(&_tmpSeq, 1)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(seq, 36)
+	return path.Join(path.Dir(name), "."+path.Base(name)+"."+suffix+_tmpSuffix)
+}
+
+// writeFile writes name crash-consistently: content is written into a
+// temporary file, synced and renamed into place, and the directory is
+// synced so that the rename survives power loss.
+func (fs *Storage) writeFile(name string, write func(w io.Writer) error) error {
+	dir := path.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := tmpPath(name)
+	if err := fs.journal.begin(tmp, name); err != nil {
+		return err
+	}
+	defer fs.journal.commit(tmp)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
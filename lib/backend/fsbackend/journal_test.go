@@ -0,0 +1,57 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fsbackend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRecoverRemovesIncompleteWrites(t *testing.T) {
+	s, cleanup := newTestStorage(t, LayoutFlat)
+	defer cleanup()
+	done := s.GetFilePath(testID)
+	if err := s.Upload(done, []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate crash in the middle of writing another blob
+	name := s.GetFilePath("fedcba")
+	tmp := tmpPath(name)
+	if err := s.journal.begin(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tmp, []byte("lay"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := s.List(s.GetDataDir())
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("expected temporary file to be hidden, got %+v, %v", infos, err)
+	}
+
+	f := &factory{}
+	if _, err := f.Create(Config{RootDirectory: s.config.RootDirectory}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected incomplete write to be removed, got %v", err)
+	}
+	if data, err := ioutil.ReadFile(done); err != nil || string(data) != "layer" {
+		t.Fatalf("expected completed write to be kept, got %q, %v", data, err)
+	}
+	if fi, err := os.Stat(s.journal.path); err != nil || fi.Size() != 0 {
+		t.Fatalf("expected journal to be truncated, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fsbackend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LayoutFlat keeps every blob as data/<hex>.layer and every torrent as
+	// torrents/<hex>.torrent
+	LayoutFlat = "flat"
+	// LayoutSharded keeps every blob as data/sha256/ab/cd/<hex> and every torrent
+	// as torrents/sha256/ab/cd/<hex>
+	LayoutSharded = "sharded"
+
+	_layerSuffix   = ".layer"
+	_torrentSuffix = ".torrent"
+	_algorithm     = "sha256"
+)
+
+func validateLayout(layout string) error {
+	switch layout {
+	case "", LayoutFlat, LayoutSharded:
+		return nil
+	}
+	return fmt.Errorf("invalid fs layout %q, must be one of %s or %s", layout, LayoutFlat, LayoutSharded)
+}
+
+// Layout returns layout of blobs, LayoutFlat by default.
+func (fs *Storage) Layout() string {
+	if fs.sharded() {
+		return LayoutSharded
+	}
+	return LayoutFlat
+}
+
+func (fs *Storage) sharded() bool {
+	return fs.config.Layout == LayoutSharded
+}
+
+// flatPath returns path of id under the flat layout of dir
+func flatPath(dir, id, suffix string) string {
+	return path.Join(dir, id+suffix)
+}
+
+// shardedPath returns path of id under the sharded layout of dir
+func shardedPath(dir, id string) string {
+	if len(id) < 4 {
+		return path.Join(dir, _algorithm, id)
+	}
+	return path.Join(dir, _algorithm, id[:2], id[2:4], id)
+}
+
+// resolve returns the location of id under dir. With the sharded layout the
+// flat location is still honoured as long as the blob hasn't been migrated,
+// so that blobs stay reachable while the migration is in progress.
+func (fs *Storage) resolve(dir, id, suffix string) string {
+	if !fs.sharded() {
+		return flatPath(dir, id, suffix)
+	}
+	sp := shardedPath(dir, id)
+	if _, err := os.Lstat(sp); err == nil {
+		return sp
+	}
+	fp := flatPath(dir, id, suffix)
+	if _, err := os.Lstat(fp); err == nil {
+		return fp
+	}
+	return sp
+}
+
+// listDir lists regular files under dir. Sharded directories are walked
+// recursively, while the flat top level is read as well so that blobs
+// which haven't been migrated yet are still listed. Migration of blobs is
+// held off while listing, so that every blob is listed exactly once.
+func (fs *Storage) listDir(dir string) ([]os.FileInfo, error) {
+	if !fs.sharded() {
+		return ioutil.ReadDir(dir)
+	}
+	fs.migration.RLock()
+	defer fs.migration.RUnlock()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() {
+			infos = append(infos, f)
+		}
+	}
+	root := path.Join(dir, _algorithm)
+	err = filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !f.IsDir() {
+			infos = append(infos, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// repairMigration completes blobs whose data was migrated into the sharded
+// layout while their torrent was not, e.g. when the process stopped in
+// between, so that data and torrent of a blob are always in the same layout
+// once storage is created.
+func (fs *Storage) repairMigration() error {
+	dataDir, torrentDir := fs.GetDataDir(), fs.GetTorrentDir()
+	files, err := ioutil.ReadDir(torrentDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), _torrentSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), _torrentSuffix)
+		if _, err := os.Lstat(shardedPath(dataDir, id)); err != nil {
+			continue
+		}
+		log.Infof("Complete interrupted migration of %s to %s layout", id, LayoutSharded)
+		if err := moveFile(flatPath(torrentDir, id, _torrentSuffix), shardedPath(torrentDir, id)); err != nil {
+			return fmt.Errorf("migrate torrent of %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// migrate moves blobs and torrents of the flat layout into the sharded one.
+// Data and torrent of a blob are moved as a unit, data first, while listing
+// is held off. Each entry is moved by rename, so readers either see the old
+// or the new location, and resolve picks up whichever exists.
+func (fs *Storage) migrate() {
+	dataDir := fs.GetDataDir()
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		log.Errorf("Read data directory %s for layout migration failed: %v", dataDir, err)
+		return
+	}
+	var migrated int
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), _layerSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), _layerSuffix)
+		if err := fs.migrateBlob(id); err != nil {
+			log.Errorf("Migrate %s to %s layout failed: %v", id, LayoutSharded, err)
+			continue
+		}
+		migrated++
+	}
+	log.Infof("Migrate %d blobs of %s to %s layout completed", migrated, fs.config.RootDirectory, LayoutSharded)
+}
+
+// migrateBlob moves data and torrent of id into the sharded layout. Data is
+// moved first, since it decides whether the blob exists, and a torrent left
+// behind is moved by repairMigration on next start.
+func (fs *Storage) migrateBlob(id string) error {
+	fs.migration.Lock()
+	defer fs.migration.Unlock()
+	dataDir, torrentDir := fs.GetDataDir(), fs.GetTorrentDir()
+	if err := moveFile(flatPath(dataDir, id, _layerSuffix), shardedPath(dataDir, id)); err != nil {
+		return fmt.Errorf("move data: %v", err)
+	}
+	if err := moveFile(flatPath(torrentDir, id, _torrentSuffix), shardedPath(torrentDir, id)); err != nil {
+		return fmt.Errorf("move torrent: %v", err)
+	}
+	return nil
+}
+
+// moveFile renames src into dst, creating parent directories of dst.
+// A missing src is not an error since it may be created lazily.
+func moveFile(src, dst string) error {
+	if _, err := os.Lstat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fsbackend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const testID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func newTestStorage(t *testing.T, layout string) (*Storage, func()) {
+	root, err := ioutil.TempDir("", "fsbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := NewStorage(Config{RootDirectory: root, Layout: layout})
+	for _, dir := range []string{s.GetDataDir(), s.GetTorrentDir()} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, func() { os.RemoveAll(root) }
+}
+
+func TestShardedLayoutResolvesFlatBlobsUntilMigrated(t *testing.T) {
+	flat, cleanup := newTestStorage(t, LayoutFlat)
+	defer cleanup()
+	if err := flat.Upload(flat.GetFilePath(testID), []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := NewStorage(Config{RootDirectory: flat.config.RootDirectory, Layout: LayoutSharded})
+	flatFile := path.Join(s.GetDataDir(), testID+".layer")
+	if got := s.GetFilePath(testID); got != flatFile {
+		t.Fatalf("expected unmigrated blob at %s, got %s", flatFile, got)
+	}
+
+	s.migrate()
+
+	shardedFile := path.Join(s.GetDataDir(), "sha256", "01", "23", testID)
+	if got := s.GetFilePath(testID); got != shardedFile {
+		t.Fatalf("expected migrated blob at %s, got %s", shardedFile, got)
+	}
+	data, err := s.Download(s.GetFilePath(testID))
+	if err != nil || string(data) != "layer" {
+		t.Fatalf("expected migrated content, got %q, %v", data, err)
+	}
+	infos, err := s.List(s.GetDataDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != testID {
+		t.Fatalf("expected one sharded entry, got %+v", infos)
+	}
+}
+
+func TestShardedLayoutPlacesNewBlobs(t *testing.T) {
+	s, cleanup := newTestStorage(t, LayoutSharded)
+	defer cleanup()
+	expected := path.Join(s.GetTorrentDir(), "sha256", "01", "23", testID)
+	if got := s.GetTorrentFilePath(testID); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	if err := s.Upload(s.GetFilePath(testID), []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(path.Join(s.GetDataDir(), "sha256", "01", "23", testID)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationKeepsBlobsListedOnce(t *testing.T) {
+	flat, cleanup := newTestStorage(t, LayoutFlat)
+	defer cleanup()
+	const n = 50
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%064x", i)
+		if err := flat.Upload(flat.GetFilePath(id), []byte("layer")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, _ := NewStorage(Config{RootDirectory: flat.config.RootDirectory, Layout: LayoutSharded})
+	done := make(chan struct{})
+	go func() {
+		s.migrate()
+		close(done)
+	}()
+	for migrating := true; migrating; {
+		select {
+		case <-done:
+			migrating = false
+		default:
+		}
+		infos, err := s.List(s.GetDataDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != n {
+			t.Fatalf("listed %d blobs while migrating, want %d", len(infos), n)
+		}
+	}
+}
+
+func TestRepairInterruptedMigration(t *testing.T) {
+	s, cleanup := newTestStorage(t, LayoutSharded)
+	defer cleanup()
+	// data was migrated while torrent was not
+	if err := s.Upload(shardedPath(s.GetDataDir(), testID), []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	flatTorrent := flatPath(s.GetTorrentDir(), testID, _torrentSuffix)
+	if err := s.Upload(flatTorrent, []byte("torrent")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repairMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.GetTorrentFilePath(testID), shardedPath(s.GetTorrentDir(), testID); got != want {
+		t.Fatalf("got torrent at %s, want %s", got, want)
+	}
+	if _, err := os.Lstat(flatTorrent); !os.IsNotExist(err) {
+		t.Fatalf("flat torrent is left: %v", err)
+	}
+}
@@ -15,9 +15,11 @@ package fsbackend
 
 import (
 	"errors"
-	"github.com/duyanghao/eagle/lib/backend"
-	"gopkg.in/yaml.v2"
+	"fmt"
 	"os"
+	"sync"
+
+	"github.com/duyanghao/eagle/lib/backend"
 )
 
 const _fs = "fs"
@@ -31,13 +33,9 @@ type factory struct{}
 func (f *factory) Create(
 	confRaw interface{}, authConfRaw interface{}) (backend.Storage, error) {
 
-	confBytes, err := yaml.Marshal(confRaw)
+	config, err := decodeConfig(confRaw)
 	if err != nil {
-		return nil, errors.New("marshal fs config")
-	}
-	var config Config
-	if err := yaml.Unmarshal(confBytes, &config); err != nil {
-		return nil, errors.New("unmarshal fs config")
+		return nil, err
 	}
 	storage, err := NewStorage(config)
 	if err != nil {
@@ -51,12 +49,49 @@ func (f *factory) Create(
 	if err := os.MkdirAll(storage.GetTorrentDir(), 0700); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+
+	// Remove incomplete writes before anything is read
+	if err := storage.Recover(); err != nil {
+		return nil, err
+	}
+
+	// Move blobs of flat layout into sharded layout in background,
+	// blobs are resolved from both layouts meanwhile
+	if storage.sharded() {
+		if err := storage.repairMigration(); err != nil {
+			return nil, fmt.Errorf("repair %s layout migration: %s", LayoutSharded, err)
+		}
+		go storage.migrate()
+	}
 	return storage, nil
 }
 
+func (f *factory) Validate(confRaw interface{}, authConfRaw interface{}) error {
+	_, err := decodeConfig(confRaw)
+	return err
+}
+
+// decodeConfig decodes and validates fs config, fs backend needs no credentials.
+func decodeConfig(confRaw interface{}) (Config, error) {
+	var config Config
+	if err := backend.DecodeConfig(confRaw, &config); err != nil {
+		return config, fmt.Errorf("decode fs config: %s", err)
+	}
+	if config.RootDirectory == "" {
+		return config, errors.New("rootDirectory of fs is required")
+	}
+	if err := validateLayout(config.Layout); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
 // Client implements a backend.Storage for FileSystem.
 type Storage struct {
-	config Config
+	config  Config
+	journal *journal
+	// held by listing, and exclusively by migrating a blob
+	migration sync.RWMutex
 }
 
 // Option allows setting optional Client parameters.
@@ -71,9 +106,20 @@ func WithS3(config Config) Option {
 func NewStorage(
 	config Config, opts ...Option) (*Storage, error) {
 
-	storage := &Storage{config}
+	storage := &Storage{config: config}
 	for _, opt := range opts {
 		opt(storage)
 	}
+	storage.journal = newJournal(storage.config.RootDirectory)
 	return storage, nil
 }
+
+// Recover replays intent journal under root directory, removing writes
+// which were in flight when the process stopped. It must be called before
+// any write.
+func (fs *Storage) Recover() error {
+	if err := fs.journal.replay(); err != nil {
+		return fmt.Errorf("replay fs journal: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"fmt"
+	"io"
+)
+
+// MiddlewareConfig declares a middleware of storage backend chain.
+type MiddlewareConfig struct {
+	Name   string      `yaml:"name"`
+	Config interface{} `yaml:"config,omitempty"`
+}
+
+var _middlewares = make(map[string]MiddlewareFactory)
+
+// MiddlewareFactory wraps Storage with a middleware given config.
+type MiddlewareFactory interface {
+	Wrap(s Storage, config interface{}) (Storage, error)
+}
+
+// RegisterMiddleware registers new MiddlewareFactory with corresponding middleware name.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	_middlewares[name] = factory
+}
+
+// getMiddlewareFactory returns middleware factory given middleware name.
+func getMiddlewareFactory(name string) (MiddlewareFactory, error) {
+	factory, ok := _middlewares[name]
+	if !ok {
+		return nil, fmt.Errorf("no backend middleware defined with name %s", name)
+	}
+	return factory, nil
+}
+
+// Chain wraps s with middlewares in order, so that the first middleware is
+// the outermost one, e.g. [metrics, retry, timeout] -> s means metrics
+// observes retried calls, and each attempt is bounded by timeout.
+//
+// Middlewares holding resources, e.g. background goroutines, implement
+// io.Closer. The returned Storage implements io.Closer as well if any of
+// them does, closing all of them, since outer middlewares hide it.
+func Chain(s Storage, middlewares []MiddlewareConfig) (Storage, error) {
+	var closers closers
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		m := middlewares[i]
+		factory, err := getMiddlewareFactory(m.Name)
+		if err != nil {
+			closers.Close()
+			return nil, err
+		}
+		s, err = factory.Wrap(s, m.Config)
+		if err != nil {
+			closers.Close()
+			return nil, fmt.Errorf("wrap backend middleware %s: %s", m.Name, err)
+		}
+		if c, ok := s.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+	if len(closers) == 0 {
+		return s, nil
+	}
+	return &closingStorage{Storage: s, closers: closers}, nil
+}
+
+type closers []io.Closer
+
+// Close closes all of c, returning the first error.
+func (c closers) Close() error {
+	var first error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// closingStorage exposes Close of middlewares hidden by outer ones.
+type closingStorage struct {
+	Storage
+	closers closers
+}
+
+func (s *closingStorage) Close() error {
+	return s.closers.Close()
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+)
+
+const _cache = "cache"
+
+func init() {
+	backend.RegisterMiddleware(_cache, &cacheFactory{})
+}
+
+// CacheConfig defines parameters of metadata cache middleware
+type CacheConfig struct {
+	TTL  time.Duration `yaml:"ttl"`  // lifetime of cached Stat result
+	Size int           `yaml:"size"` // max number of cached Stat results
+}
+
+type cacheFactory struct{}
+
+func (f *cacheFactory) Wrap(s backend.Storage, confRaw interface{}) (backend.Storage, error) {
+	config := CacheConfig{TTL: 30 * time.Second, Size: 10000}
+	if err := decodeConfig(confRaw, &config); err != nil {
+		return nil, err
+	}
+	if config.TTL <= 0 || config.Size <= 0 {
+		return nil, errors.New("ttl and size of cache must be positive")
+	}
+	return &cacheStorage{
+		Storage: s,
+		config:  config,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}, nil
+}
+
+type statEntry struct {
+	name    string
+	info    backend.FileInfo
+	expires time.Time
+}
+
+// cacheStorage caches successful Stat results for a while. Entries are
+// invalidated by writes and deletes through the same Storage.
+type cacheStorage struct {
+	backend.Storage
+	config CacheConfig
+
+	sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func (c *cacheStorage) get(name string) (*backend.FileInfo, bool) {
+	c.Lock()
+	defer c.Unlock()
+	ent, ok := c.items[name]
+	if !ok {
+		return nil, false
+	}
+	e := ent.Value.(*statEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(ent)
+		delete(c.items, name)
+		return nil, false
+	}
+	c.lru.MoveToFront(ent)
+	info := e.info
+	return &info, true
+}
+
+func (c *cacheStorage) add(name string, info *backend.FileInfo) {
+	c.Lock()
+	defer c.Unlock()
+	e := &statEntry{name: name, info: *info, expires: time.Now().Add(c.config.TTL)}
+	if ent, ok := c.items[name]; ok {
+		ent.Value = e
+		c.lru.MoveToFront(ent)
+		return
+	}
+	c.items[name] = c.lru.PushFront(e)
+	if c.lru.Len() > c.config.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*statEntry).name)
+	}
+}
+
+func (c *cacheStorage) invalidate(name string) {
+	c.Lock()
+	defer c.Unlock()
+	if ent, ok := c.items[name]; ok {
+		c.lru.Remove(ent)
+		delete(c.items, name)
+	}
+}
+
+func (c *cacheStorage) Stat(name string) (*backend.FileInfo, error) {
+	if info, ok := c.get(name); ok {
+		return info, nil
+	}
+	info, err := c.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	c.add(name, info)
+	return info, nil
+}
+
+func (c *cacheStorage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error {
+	defer c.invalidate(name)
+	return c.Storage.CreateWithMetaInfo(name, info)
+}
+
+func (c *cacheStorage) Upload(name string, data []byte) error {
+	defer c.invalidate(name)
+	return c.Storage.Upload(name, data)
+}
+
+func (c *cacheStorage) Delete(name string) error {
+	defer c.invalidate(name)
+	return c.Storage.Delete(name)
+}
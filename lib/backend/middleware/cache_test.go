@@ -0,0 +1,104 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+func TestCache(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// write changes blob through cache, or behind it if nil
+		write func(s backend.Storage) error
+		// length is the one seen by Stat after write
+		length int64
+		calls  int
+	}{
+		{"cached", nil, 4, 1},
+		{"upload", func(s backend.Storage) error { return s.Upload("blob", []byte("changed")) }, 7, 2},
+		{"create", func(s backend.Storage) error { return s.CreateWithMetaInfo("blob", &metainfo.MetaInfo{}) }, 0, 2},
+		{"delete", func(s backend.Storage) error { return s.Delete("blob") }, -1, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := newFaultStorage()
+			fs.Upload("blob", []byte("data"))
+			s, err := (&cacheFactory{}).Wrap(fs, map[string]interface{}{"ttl": "1m"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Stat("blob"); err != nil {
+				t.Fatal(err)
+			}
+			if tc.write != nil {
+				if err := tc.write(s); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				fs.Upload("blob", []byte("changed behind cache"))
+			}
+			fi, err := s.Stat("blob")
+			switch {
+			case tc.length < 0:
+				if !backenderrors.IsNotFound(err) {
+					t.Fatalf("got %+v, %v, want not found", fi, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case tc.length > 0 && fi.Length != tc.length:
+				t.Fatalf("got length %d, want %d", fi.Length, tc.length)
+			}
+			if got := fs.statCalls(); got != tc.calls {
+				t.Fatalf("got %d backend calls, want %d", got, tc.calls)
+			}
+		})
+	}
+}
+
+func TestCacheExpiryAndSize(t *testing.T) {
+	fs := newFaultStorage()
+	fs.Upload("a", []byte("a"))
+	fs.Upload("b", []byte("b"))
+	s, err := (&cacheFactory{}).Wrap(fs, map[string]interface{}{"ttl": "50ms", "size": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Stat("a")
+	s.Stat("a")
+	if got := fs.statCalls(); got != 1 {
+		t.Fatalf("got %d backend calls, want 1", got)
+	}
+	// b pushes a out of cache
+	s.Stat("b")
+	s.Stat("a")
+	if got := fs.statCalls(); got != 3 {
+		t.Fatalf("got %d backend calls after eviction, want 3", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	s.Stat("a")
+	if got := fs.statCalls(); got != 4 {
+		t.Fatalf("got %d backend calls after expiry, want 4", got)
+	}
+	// errors are not cached
+	s.Stat("missing")
+	s.Stat("missing")
+	if got := fs.statCalls(); got != 6 {
+		t.Fatalf("got %d backend calls of missing blob, want 6", got)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"github.com/klauspost/compress/zstd"
+)
+
+const _compression = "compression"
+
+func init() {
+	backend.RegisterMiddleware(_compression, &compressionFactory{})
+}
+
+// CompressionConfig defines parameters of compression middleware
+type CompressionConfig struct {
+	FrameSize int    `yaml:"frameSize"` // uncompressed size of each independently compressed frame
+	Level     string `yaml:"level"`     // zstd level: fastest, default, better or best
+}
+
+type compressionFactory struct{}
+
+func (f *compressionFactory) Wrap(s backend.Storage, confRaw interface{}) (backend.Storage, error) {
+	config := CompressionConfig{FrameSize: 1024 * 1024, Level: "default"}
+	if err := decodeConfig(confRaw, &config); err != nil {
+		return nil, err
+	}
+	if config.FrameSize <= 0 {
+		return nil, errors.New("frameSize of compression must be positive")
+	}
+	// larger frames are rejected as corrupt when read back
+	if config.FrameSize > _maxZstdFrameSize {
+		return nil, fmt.Errorf("frameSize of compression must not exceed %d", _maxZstdFrameSize)
+	}
+	found, level := zstd.EncoderLevelFromString(config.Level)
+	if !found {
+		return nil, fmt.Errorf("invalid compression level %q", config.Level)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &compressionStorage{
+		Storage:   s,
+		encoder:   encoder,
+		decoder:   decoder,
+		frameSize: config.FrameSize,
+		headers:   make(map[string]*zstdHeader),
+	}, nil
+}
+
+// Compressed blob layout:
+//
+//   magic(8) | frame size(4) | logical size(8) | frame count(4) | compressed frame sizes(4 each) | frames
+//
+// Data is compressed in independent zstd frames of frame size, so that a
+// range is read by decompressing only the frames covering it, located by
+// the frame index in header.
+const (
+	_zstdMagic        = "EGLZST01"
+	_zstdFixedLen     = len(_zstdMagic) + 4 + 8 + 4
+	_maxZstdFrameSize = 64 * 1024 * 1024
+)
+
+type zstdHeader struct {
+	frameSize int64
+	size      int64
+	offsets   []int64 // offsets of frames in blob, followed by end of the last frame
+}
+
+// parseZstdHeader parses fixed part of header, returning nil if data isn't
+// compressed, and the length of frame index following it.
+func parseZstdHeader(data []byte) (*zstdHeader, int, error) {
+	if !bytes.HasPrefix(data, []byte(_zstdMagic)) {
+		return nil, 0, nil
+	}
+	if len(data) < _zstdFixedLen {
+		return nil, 0, errors.New("short compression header")
+	}
+	p := len(_zstdMagic)
+	h := &zstdHeader{frameSize: int64(binary.BigEndian.Uint32(data[p:]))}
+	p += 4
+	h.size = int64(binary.BigEndian.Uint64(data[p:]))
+	p += 8
+	count := int64(binary.BigEndian.Uint32(data[p:]))
+	if h.frameSize == 0 || h.frameSize > _maxZstdFrameSize || count != (h.size+h.frameSize-1)/h.frameSize {
+		return nil, 0, errors.New("invalid compression header")
+	}
+	return h, int(count) * 4, nil
+}
+
+// parseIndex fills frame offsets of h from frame index, checking that frames
+// are not empty and end within blob of blobSize bytes.
+func (h *zstdHeader) parseIndex(index []byte, blobSize int64) error {
+	count := len(index) / 4
+	h.offsets = make([]int64, count+1)
+	h.offsets[0] = int64(_zstdFixedLen + len(index))
+	for i := 0; i < count; i++ {
+		n := int64(binary.BigEndian.Uint32(index[i*4:]))
+		if n == 0 {
+			return fmt.Errorf("empty frame %d in compression index", i)
+		}
+		h.offsets[i+1] = h.offsets[i] + n
+	}
+	if end := h.offsets[count]; end > blobSize {
+		return fmt.Errorf("compression index ends at %d beyond blob size %d", end, blobSize)
+	}
+	return nil
+}
+
+// compressionStorage compresses blobs uploaded into backend and decompresses
+// them on download, while Stat reports logical size so that callers, e.g.
+// LRU accounting of seeder, see original byte count. Blobs without
+// compression header, e.g. torrents or blobs which don't shrink, are passed
+// through as they are.
+type compressionStorage struct {
+	backend.Storage
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+	frameSize int
+
+	sync.RWMutex
+	headers map[string]*zstdHeader // blob name -> header, nil for uncompressed blob
+}
+
+// compress returns compressed data, or data itself if it doesn't shrink.
+func (c *compressionStorage) compress(data []byte) []byte {
+	frameSize := int64(c.frameSize)
+	size := int64(len(data))
+	count := (size + frameSize - 1) / frameSize
+	frames := make([][]byte, count)
+	total := _zstdFixedLen + 4*int(count)
+	for i := int64(0); i < count; i++ {
+		end := (i + 1) * frameSize
+		if end > size {
+			end = size
+		}
+		frames[i] = c.encoder.EncodeAll(data[i*frameSize:end], nil)
+		total += len(frames[i])
+	}
+	if total >= len(data) {
+		return data
+	}
+	out := make([]byte, 0, total)
+	buf := bytes.NewBuffer(out)
+	buf.WriteString(_zstdMagic)
+	binary.Write(buf, binary.BigEndian, uint32(frameSize))
+	binary.Write(buf, binary.BigEndian, uint64(size))
+	binary.Write(buf, binary.BigEndian, uint32(count))
+	for _, f := range frames {
+		binary.Write(buf, binary.BigEndian, uint32(len(f)))
+	}
+	for _, f := range frames {
+		buf.Write(f)
+	}
+	return buf.Bytes()
+}
+
+// decompress decompresses consecutive frames starting from frame index first.
+func (c *compressionStorage) decompress(name string, h *zstdHeader, first int64, data []byte) ([]byte, error) {
+	var out []byte
+	for i := first; len(data) > 0; i++ {
+		if i >= int64(len(h.offsets)-1) {
+			return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("trailing data of compressed blob"))
+		}
+		n := h.offsets[i+1] - h.offsets[i]
+		if int64(len(data)) < n {
+			return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("truncated compressed blob"))
+		}
+		var err error
+		out, err = c.decoder.DecodeAll(data[:n], out)
+		if err != nil {
+			return nil, backenderrors.New(backenderrors.ErrCorrupt, name, fmt.Errorf("decompress frame %d: %v", i, err))
+		}
+		data = data[n:]
+	}
+	return out, nil
+}
+
+// header returns header of name, reading it from backend if not cached.
+func (c *compressionStorage) header(name string) (*zstdHeader, error) {
+	c.RLock()
+	h, ok := c.headers[name]
+	c.RUnlock()
+	if ok {
+		return h, nil
+	}
+	data, err := c.Storage.DownloadRange(name, 0, int64(_zstdFixedLen))
+	if err != nil {
+		return nil, err
+	}
+	h, indexLen, err := parseZstdHeader(data)
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	if h != nil {
+		index, err := c.Storage.DownloadRange(name, int64(_zstdFixedLen), int64(indexLen))
+		if err != nil {
+			return nil, err
+		}
+		if len(index) != indexLen {
+			return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("short compression header"))
+		}
+		fi, err := c.Storage.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.parseIndex(index, fi.Length); err != nil {
+			return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+		}
+	}
+	c.Lock()
+	if len(c.headers) >= _maxHeaders {
+		c.headers = make(map[string]*zstdHeader)
+	}
+	c.headers[name] = h
+	c.Unlock()
+	return h, nil
+}
+
+func (c *compressionStorage) forget(name string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.headers, name)
+}
+
+// Stat returns logical size of compressed blob.
+func (c *compressionStorage) Stat(name string) (*backend.FileInfo, error) {
+	fi, err := c.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := c.header(name)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return fi, nil
+	}
+	return &backend.FileInfo{Name: fi.Name, Length: h.size}, nil
+}
+
+func (c *compressionStorage) Upload(name string, data []byte) error {
+	defer c.forget(name)
+	return c.Storage.Upload(name, c.compress(data))
+}
+
+func (c *compressionStorage) Download(name string) ([]byte, error) {
+	data, err := c.Storage.Download(name)
+	if err != nil {
+		return nil, err
+	}
+	h, indexLen, err := parseZstdHeader(data)
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	if h == nil {
+		return data, nil
+	}
+	if len(data) < _zstdFixedLen+indexLen {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("short compression header"))
+	}
+	if err := h.parseIndex(data[_zstdFixedLen:_zstdFixedLen+indexLen], int64(len(data))); err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	plain, err := c.decompress(name, h, 0, data[_zstdFixedLen+indexLen:])
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plain)) != h.size {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("truncated compressed blob"))
+	}
+	return plain, nil
+}
+
+// DownloadRange downloads and decompresses only the frames covering the range.
+func (c *compressionStorage) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	h, err := c.header(name)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return c.Storage.DownloadRange(name, offset, length)
+	}
+	if offset+length > h.size {
+		length = h.size - offset
+	}
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	first, last := offset/h.frameSize, (offset+length-1)/h.frameSize
+	start, end := h.offsets[first], h.offsets[last+1]
+	data, err := c.Storage.DownloadRange(name, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.decompress(name, h, first, data)
+	if err != nil {
+		return nil, err
+	}
+	skip := offset - first*h.frameSize
+	if int64(len(plain)) < skip+length {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("truncated compressed blob"))
+	}
+	return plain[skip : skip+length], nil
+}
+
+func (c *compressionStorage) Delete(name string) error {
+	defer c.forget(name)
+	return c.Storage.Delete(name)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	mem := newMemStorage()
+	s, err := backend.Chain(mem, []backend.MiddlewareConfig{{
+		Name:   _compression,
+		Config: map[string]interface{}{"frameSize": 1000},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uncompressed tar-like content with plenty of redundancy
+	plain := bytes.Repeat([]byte("usr/lib/libfoo.so.1\x00"), 230)
+	if err := s.Upload("data/blob", plain); err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.blobs["data/blob"]) >= len(plain)/2 {
+		t.Fatalf("expected backend to hold compressed blob, got %d bytes", len(mem.blobs["data/blob"]))
+	}
+
+	fi, err := s.Stat("data/blob")
+	if err != nil || fi.Length != int64(len(plain)) {
+		t.Fatalf("expected logical size %d, got %+v, %v", len(plain), fi, err)
+	}
+	data, err := s.Download("data/blob")
+	if err != nil || !bytes.Equal(data, plain) {
+		t.Fatalf("expected original content from download, got error %v", err)
+	}
+	for _, r := range [][2]int64{{0, 10}, {995, 10}, {1000, 1000}, {4500, 500}, {2500, 2000}} {
+		data, err := s.DownloadRange("data/blob", r[0], r[1])
+		end := r[0] + r[1]
+		if end > int64(len(plain)) {
+			end = int64(len(plain))
+		}
+		if err != nil || !bytes.Equal(data, plain[r[0]:end]) {
+			t.Fatalf("unexpected content of range %v, error %v", r, err)
+		}
+	}
+
+	// truncate compressed blob
+	mem.blobs["data/blob"] = mem.blobs["data/blob"][:len(mem.blobs["data/blob"])-5]
+	if _, err := s.Download("data/blob"); !backenderrors.IsCorrupt(err) {
+		t.Fatalf("expected corrupt error, got %v", err)
+	}
+
+	// incompressible blobs are stored as they are
+	random := make([]byte, 3000)
+	rand.Read(random)
+	if err := s.Upload("data/random", random); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem.blobs["data/random"], random) {
+		t.Fatal("expected incompressible blob passed through")
+	}
+	if data, err := s.DownloadRange("data/random", 2990, 20); err != nil || !bytes.Equal(data, random[2990:]) {
+		t.Fatalf("unexpected content of passed through range, error %v", err)
+	}
+}
+
+func TestCompressionCorruptIndex(t *testing.T) {
+	plain := bytes.Repeat([]byte("usr/lib/libfoo.so.1\x00"), 230)
+	for _, tc := range []struct {
+		name  string
+		entry uint32 // compressed size of the second frame in index
+	}{
+		{"empty frame", 0},
+		{"beyond blob", 1 << 30},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := newMemStorage()
+			s, err := (&compressionFactory{}).Wrap(mem, map[string]interface{}{"frameSize": 1000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Upload("data/blob", plain); err != nil {
+				t.Fatal(err)
+			}
+			binary.BigEndian.PutUint32(mem.blobs["data/blob"][_zstdFixedLen+4:], tc.entry)
+			if _, err := s.DownloadRange("data/blob", 2500, 100); !backenderrors.IsCorrupt(err) {
+				t.Fatalf("expected corrupt error of range, got %v", err)
+			}
+			if _, err := s.Download("data/blob"); !backenderrors.IsCorrupt(err) {
+				t.Fatalf("expected corrupt error of download, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config map[string]interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{}, true},
+		{map[string]interface{}{"frameSize": _maxZstdFrameSize}, true},
+		{map[string]interface{}{"frameSize": 0}, false},
+		{map[string]interface{}{"frameSize": _maxZstdFrameSize + 1}, false},
+		{map[string]interface{}{"level": "unknown"}, false},
+	} {
+		if _, err := (&compressionFactory{}).Wrap(newMemStorage(), tc.config); (err == nil) != tc.valid {
+			t.Errorf("config %v: got error %v, want valid %t", tc.config, err, tc.valid)
+		}
+	}
+}
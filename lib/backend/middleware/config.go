@@ -0,0 +1,30 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package middleware provides decorators of backend.Storage, which are
+// declared as a chain in configuration and built by backend.GetStorageBackend.
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/duyanghao/eagle/lib/backend"
+)
+
+// decodeConfig decodes raw config of middleware into out.
+func decodeConfig(raw interface{}, out interface{}) error {
+	if err := backend.DecodeConfig(raw, out); err != nil {
+		return fmt.Errorf("decode middleware config: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+const _encryption = "encryption"
+
+func init() {
+	backend.RegisterMiddleware(_encryption, &encryptionFactory{})
+}
+
+// EncryptionConfig defines parameters of encryption middleware
+type EncryptionConfig struct {
+	KeyFile        string        `yaml:"keyFile"`        // path of key file
+	ChunkSize      int           `yaml:"chunkSize"`      // plaintext size of each encrypted chunk
+	ReloadInterval time.Duration `yaml:"reloadInterval"` // interval of checking key file for rotation
+}
+
+type encryptionFactory struct{}
+
+func (f *encryptionFactory) Wrap(s backend.Storage, confRaw interface{}) (backend.Storage, error) {
+	config := EncryptionConfig{ChunkSize: 64 * 1024, ReloadInterval: time.Minute}
+	if err := decodeConfig(confRaw, &config); err != nil {
+		return nil, err
+	}
+	if config.KeyFile == "" {
+		return nil, errors.New("keyFile of encryption is required")
+	}
+	if config.ChunkSize <= 0 || config.ReloadInterval <= 0 {
+		return nil, errors.New("chunkSize and reloadInterval of encryption must be positive")
+	}
+	// chunk size is stored in header as uint32
+	if int64(config.ChunkSize) > math.MaxUint32 {
+		return nil, fmt.Errorf("chunkSize of encryption must not exceed %d", uint32(math.MaxUint32))
+	}
+	keys, err := newKeyring(config.KeyFile, config.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionStorage{
+		Storage:   s,
+		keys:      keys,
+		chunkSize: config.ChunkSize,
+		headers:   make(map[string]*encHeader),
+	}, nil
+}
+
+// Encrypted blob layout:
+//
+//   magic(8) | key id length(1) | key id | chunk size(4) | plaintext size(8) | nonce prefix(8) | chunks
+//
+// Plaintext is sealed with AES-GCM in chunks of chunk size, so that a range
+// is read by decrypting only the chunks covering it. Nonce of each chunk is
+// nonce prefix followed by chunk index, and the header is authenticated as
+// additional data of every chunk.
+const (
+	_encMagic       = "EGLENC01"
+	_noncePrefixLen = 8
+	_maxHeaderLen   = len(_encMagic) + 1 + 255 + 4 + 8 + _noncePrefixLen
+	_maxHeaders     = 100000
+)
+
+type encHeader struct {
+	raw         []byte
+	keyID       string
+	chunkSize   int64
+	size        int64
+	noncePrefix []byte
+}
+
+func (h *encHeader) chunkOffset(aead cipher.AEAD, index int64) int64 {
+	return int64(len(h.raw)) + index*(h.chunkSize+int64(aead.Overhead()))
+}
+
+func (h *encHeader) nonce(index int64) []byte {
+	nonce := make([]byte, _noncePrefixLen+4)
+	copy(nonce, h.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[_noncePrefixLen:], uint32(index))
+	return nonce
+}
+
+// parseHeader returns header of encrypted blob, or nil if data isn't encrypted.
+func parseHeader(data []byte) (*encHeader, error) {
+	if !bytes.HasPrefix(data, []byte(_encMagic)) {
+		return nil, nil
+	}
+	p := len(_encMagic)
+	if len(data) < p+1 {
+		return nil, errors.New("short encryption header")
+	}
+	idLen := int(data[p])
+	p++
+	if len(data) < p+idLen+4+8+_noncePrefixLen {
+		return nil, errors.New("short encryption header")
+	}
+	h := &encHeader{keyID: string(data[p : p+idLen])}
+	p += idLen
+	h.chunkSize = int64(binary.BigEndian.Uint32(data[p:]))
+	p += 4
+	h.size = int64(binary.BigEndian.Uint64(data[p:]))
+	p += 8
+	h.noncePrefix = data[p : p+_noncePrefixLen]
+	p += _noncePrefixLen
+	h.raw = data[:p]
+	if h.chunkSize == 0 {
+		return nil, errors.New("invalid chunk size in encryption header")
+	}
+	return h, nil
+}
+
+// encryptionStorage encrypts blobs uploaded into backend and decrypts them
+// on download, so that backend holds ciphertext only while callers, e.g.
+// torrent and piece hashes of seeder, work on plaintext. Blobs without
+// encryption header, e.g. torrents or blobs stored before encryption is
+// enabled, are passed through as they are.
+type encryptionStorage struct {
+	backend.Storage
+	keys      *keyring
+	chunkSize int
+
+	sync.RWMutex
+	headers map[string]*encHeader // blob name -> header, nil for plaintext blob
+}
+
+// Close stops reloading key file.
+func (e *encryptionStorage) Close() error {
+	e.keys.close()
+	return nil
+}
+
+func (e *encryptionStorage) encrypt(data []byte) ([]byte, error) {
+	keyID, aead := e.keys.activeKey()
+	h := &encHeader{keyID: keyID, chunkSize: int64(e.chunkSize), size: int64(len(data))}
+	h.noncePrefix = make([]byte, _noncePrefixLen)
+	if _, err := rand.Read(h.noncePrefix); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(_encMagic)
+	buf.WriteByte(byte(len(keyID)))
+	buf.WriteString(keyID)
+	binary.Write(&buf, binary.BigEndian, uint32(h.chunkSize))
+	binary.Write(&buf, binary.BigEndian, uint64(h.size))
+	buf.Write(h.noncePrefix)
+	h.raw = buf.Bytes()
+
+	numChunks := (h.size + h.chunkSize - 1) / h.chunkSize
+	out := make([]byte, len(h.raw), h.chunkOffset(aead, numChunks))
+	copy(out, h.raw)
+	for i := int64(0); i < numChunks; i++ {
+		end := (i + 1) * h.chunkSize
+		if end > h.size {
+			end = h.size
+		}
+		out = aead.Seal(out, h.nonce(i), data[i*h.chunkSize:end], h.raw)
+	}
+	return out, nil
+}
+
+// decrypt decrypts consecutive chunks starting from chunk index first.
+func (e *encryptionStorage) decrypt(name string, h *encHeader, first int64, data []byte) ([]byte, error) {
+	aead, err := e.keys.key(h.keyID)
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	sealedSize := int(h.chunkSize) + aead.Overhead()
+	var out []byte
+	for i := first; len(data) > 0; i++ {
+		n := sealedSize
+		if len(data) < n {
+			n = len(data)
+		}
+		out, err = aead.Open(out, h.nonce(i), data[:n], h.raw)
+		if err != nil {
+			return nil, backenderrors.New(backenderrors.ErrCorrupt, name, fmt.Errorf("decrypt chunk %d: %v", i, err))
+		}
+		data = data[n:]
+	}
+	return out, nil
+}
+
+// header returns header of name, reading it from backend if not cached.
+func (e *encryptionStorage) header(name string) (*encHeader, error) {
+	e.RLock()
+	h, ok := e.headers[name]
+	e.RUnlock()
+	if ok {
+		return h, nil
+	}
+	data, err := e.Storage.DownloadRange(name, 0, int64(_maxHeaderLen))
+	if err != nil {
+		return nil, err
+	}
+	if h, err = parseHeader(data); err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	e.Lock()
+	if len(e.headers) >= _maxHeaders {
+		e.headers = make(map[string]*encHeader)
+	}
+	e.headers[name] = h
+	e.Unlock()
+	return h, nil
+}
+
+func (e *encryptionStorage) forget(name string) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.headers, name)
+}
+
+// Stat returns plaintext size of encrypted blob.
+func (e *encryptionStorage) Stat(name string) (*backend.FileInfo, error) {
+	fi, err := e.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := e.header(name)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return fi, nil
+	}
+	return &backend.FileInfo{Name: fi.Name, Length: h.size}, nil
+}
+
+func (e *encryptionStorage) Upload(name string, data []byte) error {
+	defer e.forget(name)
+	sealed, err := e.encrypt(data)
+	if err != nil {
+		return err
+	}
+	return e.Storage.Upload(name, sealed)
+}
+
+func (e *encryptionStorage) Download(name string) ([]byte, error) {
+	data, err := e.Storage.Download(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseHeader(data)
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	if h == nil {
+		return data, nil
+	}
+	plain, err := e.decrypt(name, h, 0, data[len(h.raw):])
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plain)) != h.size {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("truncated encrypted blob"))
+	}
+	return plain, nil
+}
+
+// DownloadRange downloads and decrypts only the chunks covering the range.
+func (e *encryptionStorage) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	h, err := e.header(name)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return e.Storage.DownloadRange(name, offset, length)
+	}
+	if offset+length > h.size {
+		length = h.size - offset
+	}
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	aead, err := e.keys.key(h.keyID)
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, err)
+	}
+	first, last := offset/h.chunkSize, (offset+length-1)/h.chunkSize
+	start, end := h.chunkOffset(aead, first), h.chunkOffset(aead, last+1)
+	data, err := e.Storage.DownloadRange(name, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := e.decrypt(name, h, first, data)
+	if err != nil {
+		return nil, err
+	}
+	skip := offset - first*h.chunkSize
+	if int64(len(plain)) < skip+length {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, name, errors.New("truncated encrypted blob"))
+	}
+	return plain[skip : skip+length], nil
+}
+
+func (e *encryptionStorage) Delete(name string) error {
+	defer e.forget(name)
+	return e.Storage.Delete(name)
+}
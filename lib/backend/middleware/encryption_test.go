@@ -0,0 +1,240 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+// memStorage is an in-memory backend.Storage for tests.
+type memStorage struct {
+	sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{blobs: make(map[string][]byte)}
+}
+
+func (m *memStorage) get(name string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, backenderrors.New(backenderrors.ErrBlobNotFound, name, nil)
+	}
+	return data, nil
+}
+
+func (m *memStorage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error {
+	var buf bytes.Buffer
+	if err := info.Write(&buf); err != nil {
+		return err
+	}
+	return m.Upload(name, buf.Bytes())
+}
+
+func (m *memStorage) Stat(name string) (*backend.FileInfo, error) {
+	data, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &backend.FileInfo{Name: path.Base(name), Length: int64(len(data))}, nil
+}
+
+func (m *memStorage) Upload(name string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.blobs[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memStorage) Download(name string) ([]byte, error) {
+	return m.get(name)
+}
+
+func (m *memStorage) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	data, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset+length > int64(len(data)) {
+		length = int64(len(data)) - offset
+	}
+	return data[offset : offset+length], nil
+}
+
+func (m *memStorage) Delete(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.blobs, name)
+	return nil
+}
+
+func (m *memStorage) List(prefix string) ([]*backend.FileInfo, error) { return nil, nil }
+func (m *memStorage) GetFilePath(id string) string                    { return "data/" + id }
+func (m *memStorage) GetTorrentFilePath(id string) string             { return "torrents/" + id }
+func (m *memStorage) GetDataDir() string                              { return "data" }
+func (m *memStorage) GetTorrentDir() string                           { return "torrents" }
+
+func writeKeyFile(t *testing.T, dir, active string, ids ...string) string {
+	content := fmt.Sprintf("active: %s\nkeys:\n", active)
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		content += fmt.Sprintf("  %s: %s\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+	f := path.Join(dir, "keys.yaml")
+	if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := newMemStorage()
+	s, err := backend.Chain(mem, []backend.MiddlewareConfig{{
+		Name:   _encryption,
+		Config: map[string]interface{}{"keyFile": writeKeyFile(t, dir, "k1", "k1"), "chunkSize": 1000},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(io.Closer).Close()
+
+	plain := make([]byte, 4500)
+	rand.Read(plain)
+	if err := s.Upload("data/blob", plain); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(mem.blobs["data/blob"], plain[:100]) {
+		t.Fatal("expected backend to hold ciphertext only")
+	}
+
+	fi, err := s.Stat("data/blob")
+	if err != nil || fi.Length != int64(len(plain)) {
+		t.Fatalf("expected plaintext size %d, got %+v, %v", len(plain), fi, err)
+	}
+	data, err := s.Download("data/blob")
+	if err != nil || !bytes.Equal(data, plain) {
+		t.Fatalf("expected plaintext from download, got error %v", err)
+	}
+	for _, r := range [][2]int64{{0, 10}, {995, 10}, {1000, 1000}, {4400, 500}, {2500, 2000}} {
+		data, err := s.DownloadRange("data/blob", r[0], r[1])
+		end := r[0] + r[1]
+		if end > int64(len(plain)) {
+			end = int64(len(plain))
+		}
+		if err != nil || !bytes.Equal(data, plain[r[0]:end]) {
+			t.Fatalf("unexpected content of range %v, error %v", r, err)
+		}
+	}
+
+	// tamper ciphertext
+	mem.blobs["data/blob"][len(mem.blobs["data/blob"])-1] ^= 0xff
+	if _, err := s.DownloadRange("data/blob", 4400, 10); !backenderrors.IsCorrupt(err) {
+		t.Fatalf("expected corrupt error, got %v", err)
+	}
+
+	// plaintext blobs, e.g. torrents, are passed through
+	mem.Upload("torrents/blob", []byte("d4:infoe"))
+	if data, err := s.Download("torrents/blob"); err != nil || string(data) != "d4:infoe" {
+		t.Fatalf("expected plaintext passed through, got %q, %v", data, err)
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := writeKeyFile(t, dir, "k1", "k1")
+
+	for _, tc := range []struct {
+		config map[string]interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{"keyFile": keyFile}, true},
+		{map[string]interface{}{}, false},
+		{map[string]interface{}{"keyFile": keyFile, "chunkSize": 0}, false},
+		{map[string]interface{}{"keyFile": keyFile, "chunkSize": int64(math.MaxUint32) + 1}, false},
+		{map[string]interface{}{"keyFile": keyFile, "reloadInterval": "-1s"}, false},
+	} {
+		s, err := (&encryptionFactory{}).Wrap(newMemStorage(), tc.config)
+		if (err == nil) != tc.valid {
+			t.Errorf("config %v: got error %v, want valid %t", tc.config, err, tc.valid)
+		}
+		if err == nil {
+			s.(io.Closer).Close()
+		}
+	}
+}
+
+func TestEncryptionClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := writeKeyFile(t, dir, "k1", "k1")
+
+	s, err := (&encryptionFactory{}).Wrap(newMemStorage(), map[string]interface{}{"keyFile": keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.(*encryptionStorage).keys.stop:
+	default:
+		t.Fatal("expected reloading key file stopped")
+	}
+
+	// encryption hidden by metrics is closed through chain
+	s, err = backend.Chain(newMemStorage(), []backend.MiddlewareConfig{
+		{Name: _metrics, Config: map[string]interface{}{"name": "test_encryption_close"}},
+		{Name: _encryption, Config: map[string]interface{}{"keyFile": keyFile}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := s.(io.Closer); !ok || c.Close() != nil {
+		t.Fatal("expected chain closing encryption")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// keyFile is the content of key file, e.g.
+//
+//   active: key-2020-06
+//   keys:
+//     key-2020-05: <base64 encoded AES key>
+//     key-2020-06: <base64 encoded AES key>
+//
+// New blobs are encrypted with the active key, while retired keys are kept
+// to decrypt blobs encrypted before rotation.
+type keyFile struct {
+	Active string            `yaml:"active"`
+	Keys   map[string]string `yaml:"keys"`
+}
+
+// keyring holds keys loaded from key file, and reloads them whenever
+// the file is modified until it is closed.
+type keyring struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	active  string
+	keys    map[string]cipher.AEAD
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newKeyring(path string, reloadInterval time.Duration) (*keyring, error) {
+	k := &keyring{path: path, stop: make(chan struct{})}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(reloadInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-ticker.C:
+				if err := k.reload(); err != nil {
+					log.Errorf("Reload key file %s failed: %v", path, err)
+				}
+			}
+		}
+	}()
+	return k, nil
+}
+
+// close stops reloading key file.
+func (k *keyring) close() {
+	k.stopOnce.Do(func() { close(k.stop) })
+}
+
+func (k *keyring) reload() error {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	k.RLock()
+	unchanged := fi.ModTime().Equal(k.modTime)
+	k.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var f keyFile
+	if err := yaml.UnmarshalStrict(content, &f); err != nil {
+		return fmt.Errorf("parse key file: %v", err)
+	}
+	if len(f.Keys[f.Active]) == 0 {
+		return fmt.Errorf("active key %q not found in key file", f.Active)
+	}
+	keys := make(map[string]cipher.AEAD, len(f.Keys))
+	for id, encoded := range f.Keys {
+		if len(id) == 0 || len(id) > 255 {
+			return fmt.Errorf("invalid key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("decode key %s: %v", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("load key %s: %v", id, err)
+		}
+		if keys[id], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("load key %s: %v", id, err)
+		}
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	k.modTime = fi.ModTime()
+	k.active = f.Active
+	k.keys = keys
+	log.Infof("Load key file %s with %d keys, active key: %s", k.path, len(keys), f.Active)
+	return nil
+}
+
+// activeKey returns id and cipher of the key to encrypt new blobs.
+func (k *keyring) activeKey() (string, cipher.AEAD) {
+	k.RLock()
+	defer k.RUnlock()
+	return k.active, k.keys[k.active]
+}
+
+// key returns cipher of the key with id.
+func (k *keyring) key(id string) (cipher.AEAD, error) {
+	k.RLock()
+	defer k.RUnlock()
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found in key file", id)
+	}
+	return aead, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+const _metrics = "metrics"
+
+func init() {
+	backend.RegisterMiddleware(_metrics, &metricsFactory{})
+}
+
+// MetricsConfig defines parameters of metrics middleware
+type MetricsConfig struct {
+	Name string `yaml:"name"` // name of published expvar variable
+}
+
+type metricsFactory struct{}
+
+func (f *metricsFactory) Wrap(s backend.Storage, confRaw interface{}) (backend.Storage, error) {
+	config := MetricsConfig{Name: "storage_backend"}
+	if err := decodeConfig(confRaw, &config); err != nil {
+		return nil, err
+	}
+	return &metricsStorage{Storage: s, vars: publishMap(config.Name)}, nil
+}
+
+var publishLock sync.Mutex
+
+// publishMap returns expvar map published as name, creating it if necessary.
+func publishMap(name string) *expvar.Map {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	return expvar.NewMap(name)
+}
+
+// metricsStorage records calls, errors per kind and latency of each
+// operation as expvar variables, e.g. Stat.calls, Stat.errors.not_found
+// and Stat.latency_us.
+type metricsStorage struct {
+	backend.Storage
+	vars *expvar.Map
+}
+
+func (m *metricsStorage) observe(op string, start time.Time, err error) {
+	m.vars.Add(op+".calls", 1)
+	m.vars.Add(op+".latency_us", time.Since(start).Nanoseconds()/1000)
+	if err != nil {
+		m.vars.Add(op+".errors."+errorKind(err), 1)
+	}
+}
+
+func errorKind(err error) string {
+	switch {
+	case backenderrors.IsNotFound(err):
+		return "not_found"
+	case backenderrors.IsExist(err):
+		return "already_exists"
+	case backenderrors.IsQuotaExceeded(err):
+		return "quota_exceeded"
+	case backenderrors.IsUnavailable(err):
+		return "unavailable"
+	case backenderrors.IsCorrupt(err):
+		return "corrupt"
+	case backenderrors.IsInternal(err):
+		return "internal"
+	}
+	return "unknown"
+}
+
+func (m *metricsStorage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) (err error) {
+	defer func(start time.Time) { m.observe("CreateWithMetaInfo", start, err) }(time.Now())
+	return m.Storage.CreateWithMetaInfo(name, info)
+}
+
+func (m *metricsStorage) Stat(name string) (fi *backend.FileInfo, err error) {
+	defer func(start time.Time) { m.observe("Stat", start, err) }(time.Now())
+	return m.Storage.Stat(name)
+}
+
+func (m *metricsStorage) Upload(name string, data []byte) (err error) {
+	defer func(start time.Time) { m.observe("Upload", start, err) }(time.Now())
+	return m.Storage.Upload(name, data)
+}
+
+func (m *metricsStorage) Download(name string) (data []byte, err error) {
+	defer func(start time.Time) { m.observe("Download", start, err) }(time.Now())
+	return m.Storage.Download(name)
+}
+
+func (m *metricsStorage) DownloadRange(name string, offset, length int64) (data []byte, err error) {
+	defer func(start time.Time) { m.observe("DownloadRange", start, err) }(time.Now())
+	return m.Storage.DownloadRange(name, offset, length)
+}
+
+func (m *metricsStorage) Delete(name string) (err error) {
+	defer func(start time.Time) { m.observe("Delete", start, err) }(time.Now())
+	return m.Storage.Delete(name)
+}
+
+func (m *metricsStorage) List(prefix string) (infos []*backend.FileInfo, err error) {
+	defer func(start time.Time) { m.observe("List", start, err) }(time.Now())
+	return m.Storage.List(prefix)
+}
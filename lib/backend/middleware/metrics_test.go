@@ -0,0 +1,86 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+func TestMetrics(t *testing.T) {
+	fs := newFaultStorage(backenderrors.New(backenderrors.ErrBlobNotFound, "blob", nil))
+	fs.Upload("blob", []byte("data"))
+	s, err := (&metricsFactory{}).Wrap(fs, map[string]interface{}{"name": "test_metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Stat("blob")
+	s.Stat("blob")
+	vars := expvar.Get("test_metrics").(*expvar.Map)
+	for key, want := range map[string]string{"Stat.calls": "2", "Stat.errors.not_found": "1"} {
+		if got := vars.Get(key); got == nil || got.String() != want {
+			t.Errorf("got %s of %v, want %s", key, got, want)
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	unavailable := backenderrors.New(backenderrors.ErrUnavailable, "blob", nil)
+	for _, tc := range []struct {
+		name        string
+		middlewares []string
+		calls       string
+		errors      string
+	}{
+		// metrics outside retry observes one call of retried attempts
+		{"metrics outer", []string{_metrics, _retry}, "1", ""},
+		// metrics inside retry observes each attempt
+		{"metrics inner", []string{_retry, _metrics}, "2", "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := newFaultStorage(unavailable)
+			fs.Upload("blob", []byte("data"))
+			name := "test_chain_" + tc.middlewares[0]
+			var configs []backend.MiddlewareConfig
+			for _, m := range tc.middlewares {
+				config := map[string]interface{}{"name": name}
+				if m == _retry {
+					config = map[string]interface{}{"initialBackoff": "1ms"}
+				}
+				configs = append(configs, backend.MiddlewareConfig{Name: m, Config: config})
+			}
+			s, err := backend.Chain(fs, configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Stat("blob"); err != nil {
+				t.Fatal(err)
+			}
+			vars := expvar.Get(name).(*expvar.Map)
+			if got := vars.Get("Stat.calls"); got == nil || got.String() != tc.calls {
+				t.Errorf("got Stat.calls %v, want %s", got, tc.calls)
+			}
+			got := vars.Get("Stat.errors.unavailable")
+			if (tc.errors == "") != (got == nil) || got != nil && got.String() != tc.errors {
+				t.Errorf("got Stat.errors.unavailable %v, want %q", got, tc.errors)
+			}
+		})
+	}
+	if _, err := backend.Chain(newMemStorage(), []backend.MiddlewareConfig{{Name: "unknown"}}); err == nil {
+		t.Fatal("expected error of unknown middleware")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"errors"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+const _retry = "retry"
+
+func init() {
+	backend.RegisterMiddleware(_retry, &retryFactory{})
+}
+
+// RetryConfig defines parameters of retry middleware
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`    // attempts of each call including the first one
+	InitialBackoff time.Duration `yaml:"initialBackoff"` // backoff before the first retry
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`     // upper bound of exponential backoff
+}
+
+func (c *RetryConfig) applyDefaults() {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 3
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 2 * time.Second
+	}
+}
+
+type retryFactory struct{}
+
+func (f *retryFactory) Wrap(s backend.Storage, confRaw interface{}) (backend.Storage, error) {
+	var config RetryConfig
+	if err := decodeConfig(confRaw, &config); err != nil {
+		return nil, err
+	}
+	config.applyDefaults()
+	if config.MaxAttempts < 1 {
+		return nil, errors.New("maxAttempts of retry must be positive")
+	}
+	return &retryStorage{Storage: s, config: config, sleep: time.Sleep}, nil
+}
+
+// retryStorage retries calls failed with retryable backend errors,
+// backing off exponentially between attempts.
+type retryStorage struct {
+	backend.Storage
+	config RetryConfig
+	sleep  func(time.Duration)
+}
+
+func (r *retryStorage) do(f func() error) error {
+	backoff := r.config.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || !backenderrors.IsRetryable(err) || attempt >= r.config.MaxAttempts {
+			return err
+		}
+		r.sleep(backoff)
+		if backoff *= 2; backoff > r.config.MaxBackoff {
+			backoff = r.config.MaxBackoff
+		}
+	}
+}
+
+func (r *retryStorage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error {
+	return r.do(func() error { return r.Storage.CreateWithMetaInfo(name, info) })
+}
+
+func (r *retryStorage) Stat(name string) (fi *backend.FileInfo, err error) {
+	err = r.do(func() error {
+		fi, err = r.Storage.Stat(name)
+		return err
+	})
+	return
+}
+
+func (r *retryStorage) Upload(name string, data []byte) error {
+	return r.do(func() error { return r.Storage.Upload(name, data) })
+}
+
+func (r *retryStorage) Download(name string) (data []byte, err error) {
+	err = r.do(func() error {
+		data, err = r.Storage.Download(name)
+		return err
+	})
+	return
+}
+
+func (r *retryStorage) DownloadRange(name string, offset, length int64) (data []byte, err error) {
+	err = r.do(func() error {
+		data, err = r.Storage.DownloadRange(name, offset, length)
+		return err
+	})
+	return
+}
+
+func (r *retryStorage) Delete(name string) error {
+	return r.do(func() error { return r.Storage.Delete(name) })
+}
+
+func (r *retryStorage) List(prefix string) (infos []*backend.FileInfo, err error) {
+	err = r.do(func() error {
+		infos, err = r.Storage.List(prefix)
+		return err
+	})
+	return
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+// faultStorage is a memStorage failing Stat calls with errs in turn, and
+// delaying each call by delay.
+type faultStorage struct {
+	*memStorage
+	delay time.Duration
+
+	mu    sync.Mutex
+	errs  []error
+	stats int
+
+	running, maxRunning int // concurrent Stat calls
+}
+
+func newFaultStorage(errs ...error) *faultStorage {
+	return &faultStorage{memStorage: newMemStorage(), errs: errs}
+}
+
+func (f *faultStorage) Stat(name string) (*backend.FileInfo, error) {
+	f.mu.Lock()
+	if f.running++; f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+	f.mu.Unlock()
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	f.running--
+	f.stats++
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return f.memStorage.Stat(name)
+}
+
+func (f *faultStorage) statCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := backenderrors.New(backenderrors.ErrUnavailable, "blob", nil)
+	plain := errors.New("plain")
+	for _, tc := range []struct {
+		name    string
+		errs    []error
+		calls   int
+		wantErr error
+	}{
+		{"success", nil, 1, nil},
+		{"recovered", []error{unavailable, unavailable}, 3, nil},
+		{"exhausted", []error{unavailable, unavailable, unavailable, unavailable}, 3, backenderrors.ErrUnavailable},
+		{"not found", []error{backenderrors.New(backenderrors.ErrBlobNotFound, "blob", nil)}, 1, backenderrors.ErrBlobNotFound},
+		{"quota exceeded", []error{backenderrors.New(backenderrors.ErrQuotaExceeded, "blob", nil)}, 1, backenderrors.ErrQuotaExceeded},
+		{"corrupt", []error{backenderrors.New(backenderrors.ErrCorrupt, "blob", nil)}, 1, backenderrors.ErrCorrupt},
+		{"internal", []error{backenderrors.New(backenderrors.ErrInternal, "blob", nil)}, 1, backenderrors.ErrInternal},
+		{"plain error", []error{plain}, 1, plain},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := newFaultStorage(tc.errs...)
+			fs.Upload("blob", []byte("data"))
+			s, err := (&retryFactory{}).Wrap(fs, map[string]interface{}{"maxAttempts": 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.(*retryStorage).sleep = func(time.Duration) {}
+			_, err = s.Stat("blob")
+			if got := fs.statCalls(); got != tc.calls {
+				t.Errorf("got %d calls, want %d", got, tc.calls)
+			}
+			if tc.wantErr == nil && err != nil || tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("got error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	unavailable := backenderrors.New(backenderrors.ErrUnavailable, "blob", nil)
+	fs := newFaultStorage(unavailable, unavailable, unavailable, unavailable, unavailable)
+	s, err := (&retryFactory{}).Wrap(fs, map[string]interface{}{
+		"maxAttempts": 6, "initialBackoff": "100ms", "maxBackoff": "300ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backoffs []time.Duration
+	s.(*retryStorage).sleep = func(d time.Duration) { backoffs = append(backoffs, d) }
+	fs.Upload("blob", []byte("data"))
+	if _, err := s.Stat("blob"); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	if !reflect.DeepEqual(backoffs, want) {
+		t.Fatalf("got backoffs %v, want %v", backoffs, want)
+	}
+}
+
+func TestRetryConfig(t *testing.T) {
+	s, err := (&retryFactory{}).Wrap(newMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.(*retryStorage).config, (RetryConfig{3, 100 * time.Millisecond, 2 * time.Second}); got != want {
+		t.Fatalf("got default config %+v, want %+v", got, want)
+	}
+	if _, err := (&retryFactory{}).Wrap(newMemStorage(), map[string]interface{}{"maxAttempts": -1}); err == nil {
+		t.Fatal("expected error of negative maxAttempts")
+	}
+	if _, err := (&retryFactory{}).Wrap(newMemStorage(), map[string]interface{}{"maxAttempt": 1}); err == nil {
+		t.Fatal("expected error of unknown field")
+	}
+}
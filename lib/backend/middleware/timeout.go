@@ -0,0 +1,186 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+const _timeout = "timeout"
+
+func init() {
+	backend.RegisterMiddleware(_timeout, &timeoutFactory{})
+}
+
+// TimeoutConfig defines parameters of timeout middleware
+type TimeoutConfig struct {
+	Timeout time.Duration `yaml:"timeout"` // deadline of each call
+}
+
+type timeoutFactory struct{}
+
+func (f *timeoutFactory) Wrap(s backend.Storage, confRaw interface{}) (backend.Storage, error) {
+	config := TimeoutConfig{Timeout: 30 * time.Second}
+	if err := decodeConfig(confRaw, &config); err != nil {
+		return nil, err
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	return &timeoutStorage{Storage: s, timeout: config.Timeout, abandoned: make(map[string]*abandonedCalls)}, nil
+}
+
+// timeoutStorage bounds each call with a deadline. Storage has no means of
+// cancellation, so a call exceeding the deadline keeps running in background
+// while ErrUnavailable is returned to caller. Such calls are leaked until
+// they return, and new calls on the same name wait for them within their
+// own deadline, so that e.g. an Upload retried by retry middleware doesn't
+// interleave with the abandoned one, and at most one call per name piles up.
+type timeoutStorage struct {
+	backend.Storage
+	timeout time.Duration
+
+	mu        sync.Mutex
+	abandoned map[string]*abandonedCalls
+}
+
+// abandonedCalls tracks calls on a name still running after their deadline.
+type abandonedCalls struct {
+	n    int
+	done chan struct{} // closed once all of them return
+}
+
+func (t *timeoutStorage) do(name string, f func() error) error {
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	t.mu.Lock()
+	calls := t.abandoned[name]
+	t.mu.Unlock()
+	if calls != nil {
+		select {
+		case <-calls.done:
+		case <-timer.C:
+			return backenderrors.New(backenderrors.ErrUnavailable, name,
+				fmt.Errorf("previous call still running after %s", t.timeout))
+		}
+	}
+
+	var finished, abandoned bool
+	errChan := make(chan error, 1)
+	go func() {
+		err := f()
+		t.mu.Lock()
+		finished = true
+		if abandoned {
+			t.release(name)
+		}
+		t.mu.Unlock()
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if finished {
+		return <-errChan
+	}
+	abandoned = true
+	if calls = t.abandoned[name]; calls == nil {
+		calls = &abandonedCalls{done: make(chan struct{})}
+		t.abandoned[name] = calls
+	}
+	calls.n++
+	return backenderrors.New(backenderrors.ErrUnavailable, name, fmt.Errorf("timeout after %s", t.timeout))
+}
+
+// release marks an abandoned call on name returned, t.mu must be held.
+func (t *timeoutStorage) release(name string) {
+	calls := t.abandoned[name]
+	if calls.n--; calls.n == 0 {
+		delete(t.abandoned, name)
+		close(calls.done)
+	}
+}
+
+func (t *timeoutStorage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error {
+	return t.do(name, func() error { return t.Storage.CreateWithMetaInfo(name, info) })
+}
+
+func (t *timeoutStorage) Stat(name string) (*backend.FileInfo, error) {
+	var fi *backend.FileInfo
+	err := t.do(name, func() (err error) {
+		fi, err = t.Storage.Stat(name)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (t *timeoutStorage) Upload(name string, data []byte) error {
+	return t.do(name, func() error { return t.Storage.Upload(name, data) })
+}
+
+func (t *timeoutStorage) Download(name string) ([]byte, error) {
+	var data []byte
+	err := t.do(name, func() (err error) {
+		data, err = t.Storage.Download(name)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (t *timeoutStorage) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	var data []byte
+	err := t.do(name, func() (err error) {
+		data, err = t.Storage.DownloadRange(name, offset, length)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (t *timeoutStorage) Delete(name string) error {
+	return t.do(name, func() error { return t.Storage.Delete(name) })
+}
+
+func (t *timeoutStorage) List(prefix string) ([]*backend.FileInfo, error) {
+	var infos []*backend.FileInfo
+	err := t.do(prefix, func() (err error) {
+		infos, err = t.Storage.List(prefix)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
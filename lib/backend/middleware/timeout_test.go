@@ -0,0 +1,86 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+func TestTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		delay   time.Duration
+		expired bool
+	}{
+		{"in time", 0, false},
+		{"expired", 200 * time.Millisecond, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := newFaultStorage()
+			fs.delay = tc.delay
+			fs.Upload("blob", []byte("data"))
+			s, err := (&timeoutFactory{}).Wrap(fs, map[string]interface{}{"timeout": "50ms"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			fi, err := s.Stat("blob")
+			if tc.expired {
+				if !backenderrors.IsUnavailable(err) {
+					t.Fatalf("got %v, want unavailable error", err)
+				}
+				if elapsed := time.Since(start); elapsed >= tc.delay {
+					t.Fatalf("expected call to return at deadline, took %s", elapsed)
+				}
+				return
+			}
+			if err != nil || fi.Length != 4 {
+				t.Fatalf("got %+v, %v", fi, err)
+			}
+		})
+	}
+	if _, err := (&timeoutFactory{}).Wrap(newMemStorage(), map[string]interface{}{"timeout": "-1s"}); err == nil {
+		t.Fatal("expected error of negative timeout")
+	}
+}
+
+func TestTimeoutAbandonedCall(t *testing.T) {
+	fs := newFaultStorage()
+	fs.delay = 250 * time.Millisecond
+	fs.Upload("blob", []byte("data"))
+	s, err := (&timeoutFactory{}).Wrap(fs, map[string]interface{}{"timeout": "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first call is abandoned at 100ms and returns at 250ms, the second
+	// one gives up waiting for it at 200ms, and the third one starts only
+	// after it at 250ms
+	for i := 0; i < 3; i++ {
+		if _, err := s.Stat("blob"); !backenderrors.IsUnavailable(err) {
+			t.Fatalf("call %d: got %v, want unavailable error", i, err)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.stats != 2 || fs.maxRunning != 1 {
+		t.Fatalf("got %d calls, %d at most running at once, want 2 calls one by one", fs.stats, fs.maxRunning)
+	}
+	if len(s.(*timeoutStorage).abandoned) != 0 {
+		t.Fatal("expected no abandoned calls left")
+	}
+}
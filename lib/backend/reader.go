@@ -0,0 +1,57 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import "io"
+
+const _readChunkSize = 4 * 1024 * 1024
+
+// rangeReader reads content of a blob sequentially through DownloadRange.
+type rangeReader struct {
+	s      Storage
+	name   string
+	offset int64
+	size   int64
+	buf    []byte
+}
+
+// NewReader returns an io.Reader of size bytes of name, which downloads
+// content by ranges instead of loading the whole blob into memory.
+func NewReader(s Storage, name string, size int64) io.Reader {
+	return &rangeReader{s: s, name: name, size: size}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		length := r.size - r.offset
+		if length > _readChunkSize {
+			length = _readChunkSize
+		}
+		data, err := r.s.DownloadRange(r.name, r.offset, length)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.offset += int64(len(data))
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
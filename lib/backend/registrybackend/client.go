@@ -0,0 +1,221 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package registrybackend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+func (s *Storage) baseURL() *url.URL {
+	scheme := "https"
+	if s.config.Insecure {
+		scheme = "http"
+	}
+	return &url.URL{Scheme: scheme, Host: s.config.Address}
+}
+
+func (s *Storage) blobURL(digest string) string {
+	u := s.baseURL()
+	u.Path = fmt.Sprintf("/v2/%s/blobs/%s", s.config.Repository, digest)
+	return u.String()
+}
+
+func (s *Storage) uploadURL() string {
+	u := s.baseURL()
+	u.Path = fmt.Sprintf("/v2/%s/blobs/uploads/", s.config.Repository)
+	return u.String()
+}
+
+// resolveLocation resolves Location header of upload response, which may be relative.
+func (s *Storage) resolveLocation(resp *http.Response) (*url.URL, error) {
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || loc.String() == "" {
+		return nil, fmt.Errorf("invalid upload location %q", resp.Header.Get("Location"))
+	}
+	return s.baseURL().ResolveReference(loc), nil
+}
+
+// do sends request built by newReq. If registry challenges the request, it
+// is authorized by the challenge and sent once again, so newReq must be
+// able to build the request repeatedly.
+func (s *Storage) do(name string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		if token := s.tokens.get(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if s.auth.Username != "" {
+			req.SetBasicAuth(s.auth.Username, s.auth.Password)
+		}
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, backenderrors.New(backenderrors.ErrUnavailable, name, err)
+		}
+		return resp, nil
+	}
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := s.tokens.refresh(s.httpClient, challenge, s.auth, s.config.Repository); err != nil {
+		return nil, fmt.Errorf("authorize request of %s: %v", name, err)
+	}
+	return send()
+}
+
+// statusError converts unexpected response of registry into backend error.
+func statusError(name string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	err := fmt.Errorf("registry rsp status: %s, body: %s", resp.Status, strings.TrimSpace(string(body)))
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return backenderrors.New(backenderrors.ErrBlobNotFound, name, err)
+	case resp.StatusCode == http.StatusRequestEntityTooLarge || resp.StatusCode == http.StatusInsufficientStorage:
+		return backenderrors.New(backenderrors.ErrQuotaExceeded, name, err)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return backenderrors.New(backenderrors.ErrUnavailable, name, err)
+	}
+	return err
+}
+
+// tokenCache keeps bearer token issued by token server of registry.
+type tokenCache struct {
+	sync.RWMutex
+	token string
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{}
+}
+
+func (t *tokenCache) get() string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.token
+}
+
+// refresh requests a new bearer token as challenged by registry.
+func (t *tokenCache) refresh(client *http.Client, challenge string, auth AuthConfig, repository string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if auth.Username == "" {
+			return errors.New("registry requires basic authentication")
+		}
+		return errors.New("registry rejected basic authentication")
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid realm of challenge %q", challenge)
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull,push,delete", repository)
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token server rsp status: %s", resp.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("decode token: %v", err)
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return errors.New("empty token issued")
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.token = token
+	return nil
+}
+
+// parseChallenge parses WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.example.com/token",service="registry",scope="repository:foo:pull"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i < 0 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package registrybackend
+
+// Config defines docker registry specific
+// parameters and authetication credentials
+type Config struct {
+	Address       string `yaml:"address"`       // registry address, e.g. registry.example.com:5000
+	Repository    string `yaml:"repository"`    // cache repository which blobs are uploaded into
+	Insecure      bool   `yaml:"insecure"`      // access registry through plain http
+	ChunkSize     int64  `yaml:"chunkSize"`     // chunk size of blob upload
+	RootDirectory string `yaml:"rootDirectory"` // local directory of torrents
+}
+
+// AuthConfig defines credentials of registry, used both for basic
+// authentication and for requesting bearer tokens
+type AuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
@@ -0,0 +1,269 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package registrybackend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+const _digestPrefix = "sha256:"
+
+// isBlob returns true if name refers to a blob in registry rather than a local torrent.
+func isBlob(name string) bool {
+	return strings.HasPrefix(name, _digestPrefix)
+}
+
+// CreateWithMetaInfo creates torrent with meta info in local file system
+func (s *Storage) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error {
+	return s.torrents.CreateWithMetaInfo(name, info)
+}
+
+// Stat sends HEAD request of blob
+func (s *Storage) Stat(name string) (*backend.FileInfo, error) {
+	if !isBlob(name) {
+		return s.torrents.Stat(name)
+	}
+	resp, err := s.do(name, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, s.blobURL(name), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(name, resp)
+	}
+	return &backend.FileInfo{
+		Name:   name,
+		Length: resp.ContentLength,
+	}, nil
+}
+
+// Upload uploads data into cache repository by chunks. Blobs in registry are
+// content addressable, so data must match the digest of name.
+func (s *Storage) Upload(name string, data []byte) error {
+	if !isBlob(name) {
+		return s.torrents.Upload(name, data)
+	}
+	sum := sha256.Sum256(data)
+	if digest := _digestPrefix + hex.EncodeToString(sum[:]); digest != name {
+		return backenderrors.New(backenderrors.ErrCorrupt, name, fmt.Errorf("content digest %s mismatches", digest))
+	}
+	if _, err := s.Stat(name); err == nil {
+		// same content exists already
+		return nil
+	}
+
+	// start upload session
+	resp, err := s.do(name, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, s.uploadURL(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return statusError(name, resp)
+	}
+	location, err := s.resolveLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	// upload chunks
+	for offset := int64(0); offset < int64(len(data)); offset += s.config.ChunkSize {
+		end := offset + s.config.ChunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		chunk := data[offset:end]
+		resp, err := s.do(name, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPatch, location.String(), bytes.NewReader(chunk))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, end-1))
+			req.ContentLength = int64(len(chunk))
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return statusError(name, resp)
+		}
+		if location, err = s.resolveLocation(resp); err != nil {
+			return err
+		}
+	}
+
+	// complete upload
+	q := location.Query()
+	q.Set("digest", name)
+	location.RawQuery = q.Encode()
+	resp, err = s.do(name, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPut, location.String(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(name, resp)
+	}
+	return nil
+}
+
+// Download sends GET request of blob
+func (s *Storage) Download(name string) ([]byte, error) {
+	if !isBlob(name) {
+		return s.torrents.Download(name)
+	}
+	resp, err := s.do(name, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, s.blobURL(name), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(name, resp)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrUnavailable, name, err)
+	}
+	return content, nil
+}
+
+// DownloadRange sends ranged GET request of blob
+func (s *Storage) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	if !isBlob(name) {
+		return s.torrents.DownloadRange(name, offset, length)
+	}
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	resp, err := s.do(name, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, s.blobURL(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// range is ignored by registry, skip to offset
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil && err != io.EOF {
+			return nil, backenderrors.New(backenderrors.ErrUnavailable, name, err)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return []byte{}, nil
+	default:
+		return nil, statusError(name, resp)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrUnavailable, name, err)
+	}
+	return content, nil
+}
+
+// Delete sends DELETE request of blob, which requires deletion
+// to be enabled in registry
+func (s *Storage) Delete(name string) error {
+	if !isBlob(name) {
+		return s.torrents.Delete(name)
+	}
+	resp, err := s.do(name, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, s.blobURL(name), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return statusError(name, resp)
+	}
+	return nil
+}
+
+// List lists entries whose names start with prefix. Registry can't list
+// blobs of a repository, so blobs of data directory are listed by torrents
+// created for them, with lengths from their torrents.
+func (s *Storage) List(prefix string) ([]*backend.FileInfo, error) {
+	if prefix != s.GetDataDir() {
+		return s.torrents.List(prefix)
+	}
+	torrents, err := s.torrents.List(s.GetTorrentDir())
+	if err != nil {
+		return nil, err
+	}
+	var infos []*backend.FileInfo
+	for _, t := range torrents {
+		id := strings.TrimSuffix(t.Name, path.Ext(t.Name))
+		mi, err := metainfo.LoadFromFile(s.GetTorrentFilePath(id))
+		if err != nil {
+			continue
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, &backend.FileInfo{
+			Name:   id,
+			Length: info.TotalLength(),
+		})
+	}
+	return infos, nil
+}
+
+// GetFilePath returns digest of blob
+func (s *Storage) GetFilePath(id string) string {
+	return _digestPrefix + id
+}
+
+// GetTorrentFilePath returns local torrent file path
+func (s *Storage) GetTorrentFilePath(id string) string {
+	return s.torrents.GetTorrentFilePath(id)
+}
+
+// GetDataDir returns reference of cache repository
+func (s *Storage) GetDataDir() string {
+	return s.config.Address + "/" + s.config.Repository
+}
+
+func (s *Storage) GetTorrentDir() string {
+	return s.torrents.GetTorrentDir()
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package registrybackend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+// fakeRegistry is an in-process stand-in of blob API of docker registry
+type fakeRegistry struct {
+	sync.Mutex
+	blobs    map[string][]byte
+	uploads  map[string][]byte
+	patches  int
+	username string
+	password string
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:   make(map[string][]byte),
+		uploads: make(map[string][]byte),
+	}
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	if r.username != "" {
+		if u, p, ok := req.BasicAuth(); !ok || u != r.username || p != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	const prefix = "/v2/cache/blobs/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rest := strings.TrimPrefix(req.URL.Path, prefix)
+	if strings.HasPrefix(rest, "uploads/") {
+		r.serveUpload(w, req, strings.TrimPrefix(rest, "uploads/"))
+		return
+	}
+	data, ok := r.blobs[rest]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case http.MethodGet:
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			if start >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(r.blobs, rest)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		id = strconv.Itoa(len(r.uploads) + 1)
+		r.uploads[id] = nil
+	case http.MethodPatch:
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != len(r.uploads[id]) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		r.uploads[id] = append(r.uploads[id], body...)
+		r.patches++
+	case http.MethodPut:
+		digest := req.URL.Query().Get("digest")
+		sum := sha256.Sum256(r.uploads[id])
+		if digest != "sha256:"+hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[digest] = r.uploads[id]
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.Header().Set("Location", "/v2/cache/blobs/uploads/"+id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func newTestStorage(t *testing.T, registry *fakeRegistry, auth AuthConfig) (*Storage, func()) {
+	server := httptest.NewServer(registry)
+	root, err := ioutil.TempDir("", "registrybackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL)
+	s, err := NewStorage(Config{
+		Address:       u.Host,
+		Repository:    "cache",
+		Insecure:      true,
+		ChunkSize:     4,
+		RootDirectory: root,
+	}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		server.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadAndDownloadBlob(t *testing.T) {
+	registry := newFakeRegistry()
+	s, cleanup := newTestStorage(t, registry, AuthConfig{})
+	defer cleanup()
+
+	data := []byte("0123456789")
+	name := s.GetFilePath(digestOf(data))
+	if err := s.Upload(name, data); err != nil {
+		t.Fatal(err)
+	}
+	if registry.patches != 3 {
+		t.Fatalf("expected 3 chunks uploaded, got %d", registry.patches)
+	}
+	info, err := s.Stat(name)
+	if err != nil || info.Length != int64(len(data)) {
+		t.Fatalf("expected length %d, got %+v, %v", len(data), info, err)
+	}
+	got, err := s.Download(name)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q, %v", data, got, err)
+	}
+	got, err = s.DownloadRange(name, 8, 5)
+	if err != nil || string(got) != "89" {
+		t.Fatalf("expected tail of blob, got %q, %v", got, err)
+	}
+	got, err = s.DownloadRange(name, 10, 5)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("expected empty range past end, got %q, %v", got, err)
+	}
+
+	if err := s.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(name); !backenderrors.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestUploadRejectsMismatchedDigest(t *testing.T) {
+	s, cleanup := newTestStorage(t, newFakeRegistry(), AuthConfig{})
+	defer cleanup()
+	if err := s.Upload(s.GetFilePath(digestOf([]byte("a"))), []byte("b")); !backenderrors.IsCorrupt(err) {
+		t.Fatalf("expected corrupt error, got %v", err)
+	}
+}
+
+func TestBasicAuthentication(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	data := []byte("layer")
+	registry.blobs["sha256:"+digestOf(data)] = data
+
+	s, cleanup := newTestStorage(t, registry, AuthConfig{Username: "user", Password: "secret"})
+	defer cleanup()
+	if got, err := s.Download(s.GetFilePath(digestOf(data))); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q, %v", data, got, err)
+	}
+
+	anonymous, cleanup := newTestStorage(t, registry, AuthConfig{})
+	defer cleanup()
+	anonymous.config.Address = s.config.Address
+	if _, err := anonymous.Download(anonymous.GetFilePath(digestOf(data))); err == nil {
+		t.Fatal("expected anonymous request to be rejected")
+	}
+}
+
+func TestFactoryValidatesSchema(t *testing.T) {
+	config := map[string]interface{}{
+		"address":       "registry.example.com",
+		"repository":    "cache",
+		"rootDirectory": "/tmp",
+	}
+	f := &factory{}
+	if err := f.Validate(config, map[string]interface{}{"username": "user"}); err != nil {
+		t.Fatal(err)
+	}
+	config["chunksize"] = 1
+	if err := f.Validate(config, nil); err == nil {
+		t.Fatal("expected unknown field to be rejected")
+	}
+	delete(config, "chunksize")
+	delete(config, "repository")
+	if err := f.Validate(config, nil); err == nil {
+		t.Fatal("expected missing repository to be rejected")
+	}
+}
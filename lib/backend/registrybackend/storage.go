@@ -0,0 +1,139 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package registrybackend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/fsbackend"
+)
+
+const _registry = "registry"
+
+const _defaultChunkSize = 32 * 1024 * 1024
+
+func init() {
+	backend.Register(_registry, &factory{})
+}
+
+type factory struct{}
+
+func (f *factory) Create(
+	confRaw interface{}, authConfRaw interface{}) (backend.Storage, error) {
+
+	config, auth, err := decodeConfig(confRaw, authConfRaw)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := NewStorage(config, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create torrent directory
+	if err := os.MkdirAll(storage.GetTorrentDir(), 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if err := storage.torrents.Recover(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (f *factory) Validate(confRaw interface{}, authConfRaw interface{}) error {
+	_, _, err := decodeConfig(confRaw, authConfRaw)
+	return err
+}
+
+// decodeConfig decodes and validates registry config and credentials.
+func decodeConfig(confRaw interface{}, authConfRaw interface{}) (Config, AuthConfig, error) {
+	var config Config
+	var auth AuthConfig
+	if err := backend.DecodeConfig(confRaw, &config); err != nil {
+		return config, auth, fmt.Errorf("decode registry config: %s", err)
+	}
+	if err := backend.DecodeConfig(authConfRaw, &auth); err != nil {
+		return config, auth, fmt.Errorf("decode registry auth config: %s", err)
+	}
+	if config.Address == "" || config.Repository == "" || config.RootDirectory == "" {
+		return config, auth, errors.New("address, repository and rootDirectory of registry are required")
+	}
+	if config.ChunkSize < 0 {
+		return config, auth, fmt.Errorf("invalid chunkSize %d of registry", config.ChunkSize)
+	}
+	return config, auth, nil
+}
+
+// Storage implements a backend.Storage on top of blob API of docker registry.
+// Blobs are kept in the cache repository of registry, while torrents are
+// kept in local file system since they are not content addressable.
+type Storage struct {
+	config     Config
+	auth       AuthConfig
+	httpClient *http.Client
+	tokens     *tokenCache
+	torrents   *fsbackend.Storage
+}
+
+// Option allows setting optional Storage parameters.
+type Option func(storage *Storage)
+
+// WithHTTPClient configures a Storage with a custom http client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(storage *Storage) { storage.httpClient = client }
+}
+
+// NewStorage creates a new Storage for docker registry.
+func NewStorage(
+	config Config, auth AuthConfig, opts ...Option) (*Storage, error) {
+
+	if config.Address == "" || config.Repository == "" || config.RootDirectory == "" {
+		return nil, errors.New("address, repository and rootDirectory of registry are required")
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = _defaultChunkSize
+	}
+	torrents, err := fsbackend.NewStorage(fsbackend.Config{RootDirectory: config.RootDirectory})
+	if err != nil {
+		return nil, fmt.Errorf("create torrent storage: %s", err)
+	}
+	storage := &Storage{
+		config: config,
+		auth:   auth,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		tokens:   newTokenCache(),
+		torrents: torrents,
+	}
+	for _, opt := range opts {
+		opt(storage)
+	}
+	return storage, nil
+}
@@ -28,6 +28,11 @@ var _factories = make(map[string]StorageFactory)
 // StorageFactory creates backend client given name.
 type StorageFactory interface {
 	Create(config interface{}, authConfig interface{}) (Storage, error)
+
+	// Validate checks config and authConfig against the schema declared by
+	// backend without creating it, so that misconfiguration is reported
+	// when configuration is loaded.
+	Validate(config interface{}, authConfig interface{}) error
 }
 
 // Register registers new Factory with corresponding backend client name.
@@ -44,7 +49,21 @@ func getFactory(name string) (StorageFactory, error) {
 	return factory, nil
 }
 
-func GetStorageBackend(name string, config interface{}, authConfig interface{}) (Storage, error) {
+// ValidateStorageBackend validates config and authConfig of backend storage given name.
+func ValidateStorageBackend(name string, config interface{}, authConfig interface{}) error {
+	factory, err := getFactory(name)
+	if err != nil {
+		return err
+	}
+	if err := factory.Validate(config, authConfig); err != nil {
+		return fmt.Errorf("invalid %s backend config: %s", name, err)
+	}
+	return nil
+}
+
+// GetStorageBackend creates backend storage given name, and wraps it with
+// middlewares declared in order.
+func GetStorageBackend(name string, config interface{}, authConfig interface{}, middlewares ...MiddlewareConfig) (Storage, error) {
 	factory, err := getFactory(name)
 	if err != nil {
 		return nil, fmt.Errorf("get backend storage factory: %s", err)
@@ -53,13 +72,19 @@ func GetStorageBackend(name string, config interface{}, authConfig interface{})
 	if err != nil {
 		return nil, fmt.Errorf("create backend storage: %s", err)
 	}
+	s, err = Chain(s, middlewares)
+	if err != nil {
+		return nil, fmt.Errorf("chain backend storage middlewares: %s", err)
+	}
 	return s, nil
 }
 
 // Storage defines an interface for accessing blobs on a remote storage backend.
 //
 // Implementations of Storage must be thread-safe, since they are cached and
-// used concurrently by Manager.
+// used concurrently by Manager. Failed operations should return errors of
+// backenderrors kinds, so that callers can decide whether to retry, fall
+// back or fail fast regardless of backend.
 type Storage interface {
 	// Create creates torrent with meta info
 	CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error
@@ -76,6 +101,10 @@ type Storage interface {
 	// backenderrors.ErrBlobNotFound when the blob was not found.
 	Download(name string) ([]byte, error)
 
+	// DownloadRange downloads length bytes of name starting at offset. Fewer
+	// bytes are returned only if the end of blob is reached.
+	DownloadRange(name string, offset, length int64) ([]byte, error)
+
 	// Delete removes relevant name
 	Delete(name string) error
 
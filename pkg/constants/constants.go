@@ -13,9 +13,37 @@
 // limitations under the License.
 package constants
 
+import "time"
+
 const (
 	DefaultRateLimitBurst      = 4 * 1024 * 1024   // default 4Mb
 	DefaultUploadRateLimit     = 100 * 1024 * 1024 // 100Mb/s
 	DefaultDownloadRateLimit   = 100 * 1024 * 1024 // 100Mb/s
 	DefaultMetaInfoPieceLength = 4 * 1024 * 1024   // default 4Mb
+	DefaultStreamReadahead     = 16 * 1024 * 1024  // default 16Mb
+	DefaultPrefetchConcurrency = 4                 // download 4 layers at a time when prefetching image
+	DefaultPieceCacheSize      = 64 * 1024 * 1024  // cache 64Mb of pieces read from seeder storage backend
+)
+
+const (
+	DefaultStallTimeout     = 30 * time.Second // abort download if no bytes arrive for 30s
+	DefaultThroughputWindow = 60 * time.Second // measure throughput over 60s
+)
+
+const (
+	DefaultAnnounceInterval    = 60 * time.Second // announce interval if tracker doesn't tell
+	DefaultMinAnnounceInterval = 10 * time.Second // announce no more frequently than 10s
+	DefaultAnnounceTimeout     = 15 * time.Second // timeout of each announce
+	DefaultLSDInterval         = 60 * time.Second // announce to LAN every 60s
+	DefaultLocalityCheck       = 5 * time.Second  // check whether peers nearby serve a download every 5s
+	DefaultProgressLogInterval = 10 * time.Second // log progress of each download every 10s
+	DefaultIndexSaveInterval   = 30 * time.Second // save recency of cached layers every 30s
+	DefaultRetentionInterval   = 5 * time.Minute  // check seeding policy every 5m
+	DefaultRejectionTTL        = 10 * time.Minute // pull layer failed digest verification from origin for 10m
+)
+
+const (
+	DefaultScrapeBatch   = 50 // scrape at most 50 torrents in a request
+	DefaultSeedersMargin = 2  // keep seeding until seeders exceed minSeeders by 2
+	DefaultRestoreLimit  = 4  // verify at most 4 cached layers at once on startup
 )
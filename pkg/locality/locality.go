@@ -0,0 +1,176 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package locality
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Distance between two nodes in topology, the smaller the closer.
+const (
+	SameRack = iota
+	SameIDC
+	SameRegion
+	Remote
+)
+
+// Labels locates a node in topology. Empty labels are unknown and never match.
+type Labels struct {
+	Region string `yaml:"region,omitempty"`
+	IDC    string `yaml:"idc,omitempty"`
+	Rack   string `yaml:"rack,omitempty"`
+}
+
+// Distance returns distance between l and o.
+func (l Labels) Distance(o Labels) int {
+	if l.Region == "" || l.Region != o.Region {
+		return Remote
+	}
+	if l.IDC == "" || l.IDC != o.IDC {
+		return SameRegion
+	}
+	if l.Rack == "" || l.Rack != o.Rack {
+		return SameIDC
+	}
+	return SameRack
+}
+
+// Subnet assigns labels to addresses within CIDR.
+type Subnet struct {
+	CIDR   string `yaml:"cidr"`
+	Labels `yaml:",inline"`
+}
+
+type Config struct {
+	// labels of local node, resolved from addresses of local interfaces if not set
+	Self    Labels   `yaml:"self,omitempty"`
+	Subnets []Subnet `yaml:"subnets,omitempty"`
+	// max peers outside local IDC added to each torrent, unlimited if not set
+	MaxCrossIDCPeers int `yaml:"maxCrossIDCPeers,omitempty"`
+}
+
+// Validate checks CIDRs of subnets.
+func (c *Config) Validate() error {
+	for _, s := range c.Subnets {
+		if _, _, err := net.ParseCIDR(s.CIDR); err != nil {
+			return fmt.Errorf("invalid subnet %q: %v", s.CIDR, err)
+		}
+	}
+	if c.MaxCrossIDCPeers < 0 {
+		return fmt.Errorf("invalid maxCrossIDCPeers %d", c.MaxCrossIDCPeers)
+	}
+	return nil
+}
+
+type subnet struct {
+	ipNet  *net.IPNet
+	labels Labels
+}
+
+// Topology labels addresses by subnets and ranks peers by their distance
+// from local node.
+type Topology struct {
+	self        Labels
+	subnets     []subnet
+	maxCrossIDC int
+}
+
+// New creates Topology from c.
+func New(c *Config) (*Topology, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	t := &Topology{self: c.Self, maxCrossIDC: c.MaxCrossIDCPeers}
+	for _, s := range c.Subnets {
+		_, ipNet, _ := net.ParseCIDR(s.CIDR)
+		t.subnets = append(t.subnets, subnet{ipNet: ipNet, labels: s.Labels})
+	}
+	// the most specific subnet wins
+	sort.SliceStable(t.subnets, func(i, j int) bool {
+		oi, _ := t.subnets[i].ipNet.Mask.Size()
+		oj, _ := t.subnets[j].ipNet.Mask.Size()
+		return oi > oj
+	})
+	if t.self == (Labels{}) {
+		t.self = t.resolveSelf()
+	}
+	return t, nil
+}
+
+func (t *Topology) resolveSelf() Labels {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return Labels{}
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if l := t.Lookup(ipNet.IP); l != (Labels{}) {
+				return l
+			}
+		}
+	}
+	return Labels{}
+}
+
+// Self returns labels of local node.
+func (t *Topology) Self() Labels {
+	return t.self
+}
+
+// Lookup returns labels of ip, empty if ip is not within any subnet.
+func (t *Topology) Lookup(ip net.IP) Labels {
+	for _, s := range t.subnets {
+		if s.ipNet.Contains(ip) {
+			return s.labels
+		}
+	}
+	return Labels{}
+}
+
+// Distance returns distance between local node and ip.
+func (t *Topology) Distance(ip net.IP) int {
+	return t.self.Distance(t.Lookup(ip))
+}
+
+// Select orders ips from the closest to the farthest, and keeps all of them
+// within local IDC while at most MaxCrossIDCPeers of the others. It returns
+// indexes of selected ips, so that callers can select their own peer types.
+func (t *Topology) Select(ips []net.IP) []int {
+	idx := make([]int, len(ips))
+	dist := make([]int, len(ips))
+	for i, ip := range ips {
+		idx[i] = i
+		dist[i] = t.Distance(ip)
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return dist[idx[i]] < dist[idx[j]]
+	})
+	if t.maxCrossIDC <= 0 {
+		return idx
+	}
+	selected := idx[:0]
+	cross := 0
+	for _, i := range idx {
+		if dist[i] > SameIDC {
+			if cross >= t.maxCrossIDC {
+				continue
+			}
+			cross++
+		}
+		selected = append(selected, i)
+	}
+	return selected
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package locality
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func newTestTopology(t *testing.T, maxCrossIDC int) *Topology {
+	topo, err := New(&Config{
+		Self: Labels{Region: "bj", IDC: "idc1", Rack: "r1"},
+		Subnets: []Subnet{
+			{CIDR: "10.1.0.0/16", Labels: Labels{Region: "bj", IDC: "idc1"}},
+			{CIDR: "10.1.1.0/24", Labels: Labels{Region: "bj", IDC: "idc1", Rack: "r1"}},
+			{CIDR: "10.2.0.0/16", Labels: Labels{Region: "bj", IDC: "idc2"}},
+			{CIDR: "10.3.0.0/16", Labels: Labels{Region: "sh", IDC: "idc3"}},
+		},
+		MaxCrossIDCPeers: maxCrossIDC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topo
+}
+
+func TestDistance(t *testing.T) {
+	topo := newTestTopology(t, 0)
+	for ip, want := range map[string]int{
+		"10.1.1.5":  SameRack,
+		"10.1.2.5":  SameIDC,
+		"10.2.0.1":  SameRegion,
+		"10.3.0.1":  Remote,
+		"192.0.2.1": Remote,
+	} {
+		if got := topo.Distance(net.ParseIP(ip)); got != want {
+			t.Errorf("distance of %s: got %d, want %d", ip, got, want)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("10.2.0.1"),
+		net.ParseIP("10.1.2.5"),
+		net.ParseIP("10.3.0.1"),
+		net.ParseIP("10.1.1.5"),
+	}
+	if got, want := newTestTopology(t, 0).Select(ips), []int{4, 2, 1, 0, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unlimited: got %v, want %v", got, want)
+	}
+	if got, want := newTestTopology(t, 1).Select(ips), []int{4, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("max 1 cross idc peer: got %v, want %v", got, want)
+	}
+}
+
+func TestInvalidSubnet(t *testing.T) {
+	if _, err := New(&Config{Subnets: []Subnet{{CIDR: "10.1.0.0"}}}); err == nil {
+		t.Fatal("expected error of invalid cidr")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package peerauth authenticates peers of bt swarms by mutual TLS around
+// the peer wire protocol, so that only nodes holding certificates signed by
+// the cluster CA can join swarms.
+package peerauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	log "github.com/sirupsen/logrus"
+)
+
+// handshakeTimeout bounds TLS handshake of each peer connection dialed
+const handshakeTimeout = 10 * time.Second
+
+// rejected counts peer connections failing authentication
+var rejected = expvar.NewInt("peerauth_rejected")
+
+// Config of peer authentication. Each node presents its certificate signed
+// by CA, and accepts peers presenting certificates signed by the same CA.
+// Seeder and clients of a cluster must share the same CA.
+type Config struct {
+	CAFile   string `yaml:"caFile"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+func (c *Config) Validate() error {
+	if c.CAFile == "" || c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("caFile, certFile and keyFile are all required")
+	}
+	_, err := c.TLSConfig()
+	return err
+}
+
+// TLSConfig returns mutual TLS configuration of c. Peers are addressed by
+// IP, so their certificates are verified against CA without host names.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %v", err)
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("load CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no CA certificate found in %s", c.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+		// verify server certificate against CA in VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verify(rawCerts, pool)
+		},
+	}, nil
+}
+
+func verify(rawCerts [][]byte, pool *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// Apply disables built-in peer sockets and DHT of tc, which would accept
+// peers without authentication. Peers are served by Socket added to client.
+func Apply(tc *torrent.ClientConfig) {
+	tc.DisableTCP = true
+	tc.DisableUTP = true
+	tc.NoDHT = true
+}
+
+// Socket listens and dials peer connections authenticated by mutual TLS,
+// registered with torrent client as both listener and dialer.
+type Socket struct {
+	net.Listener
+	config *tls.Config
+	dialer net.Dialer
+}
+
+// Listen starts socket on port, and adds it to cl. Socket is not closed
+// with cl, which should be closed by caller.
+func Listen(cl *torrent.Client, c *Config, port int) (*Socket, error) {
+	s, err := newSocket(c, port)
+	if err != nil {
+		return nil, err
+	}
+	cl.AddDialer(s)
+	cl.AddListener(s)
+	log.Infof("Authenticate peers by mutual TLS on %s", s.Addr())
+	return s, nil
+}
+
+func newSocket(c *Config, port int) (*Socket, error) {
+	config, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return &Socket{Listener: l, config: config}, nil
+}
+
+// Accept returns connection whose TLS handshake is done on first read or
+// write, so that slow peers don't block accepting others.
+func (s *Socket) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &serverConn{Conn: tls.Server(conn, s.config)}, nil
+}
+
+// Dial connects to peer at addr, failing if either side is not authenticated.
+func (s *Socket) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	tc := tls.Client(conn, s.config)
+	tc.SetDeadline(deadline)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		rejected.Add(1)
+		log.Warnf("Reject peer %s: %v", addr, err)
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// LocalAddr is address of socket, whose network is that of dialed connections.
+func (s *Socket) LocalAddr() net.Addr {
+	return s.Listener.Addr()
+}
+
+// serverConn is accepted connection, rejecting peer failing TLS handshake.
+// Handshake is bounded by deadline of bt handshakes set by torrent client.
+type serverConn struct {
+	*tls.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *serverConn) handshake() error {
+	c.once.Do(func() {
+		if c.err = c.Conn.Handshake(); c.err != nil {
+			rejected.Add(1)
+			log.Warnf("Reject peer %s: %v", c.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
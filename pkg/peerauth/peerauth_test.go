@@ -0,0 +1,150 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package peerauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCA returns a CA certificate and its key
+func newCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newConfig writes CA and a node certificate signed by it into dir
+func newConfig(t *testing.T, dir string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, caPEM []byte) *Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		CAFile:   filepath.Join(dir, "ca.crt"),
+		CertFile: filepath.Join(dir, "node.crt"),
+		KeyFile:  filepath.Join(dir, "node.key"),
+	}
+	for name, data := range map[string][]byte{
+		c.CAFile:   caPEM,
+		c.CertFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		c.KeyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	} {
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSocket(t *testing.T) {
+	caCert, caKey, caPEM := newCA(t, "cluster")
+	server, err := newSocket(newConfig(t, t.TempDir(), caCert, caKey, caPEM), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 4)
+				if _, err := conn.Read(b); err == nil {
+					conn.Write(b)
+				}
+			}()
+		}
+	}()
+
+	// member of cluster
+	member, err := newSocket(newConfig(t, t.TempDir(), caCert, caKey, caPEM), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer member.Close()
+	conn, err := member.Dial(context.Background(), server.Addr().String())
+	if err != nil {
+		t.Fatalf("dial as member: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := conn.Read(b); err != nil || string(b) != "ping" {
+		t.Fatalf("got %q, %v from server", b, err)
+	}
+	conn.Close()
+
+	// node with certificate of another CA is rejected
+	otherCert, otherKey, otherPEM := newCA(t, "other")
+	other, err := newSocket(newConfig(t, t.TempDir(), otherCert, otherKey, otherPEM), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	before := rejected.Value()
+	if _, err := other.Dial(context.Background(), server.Addr().String()); err == nil {
+		t.Fatal("dial as outsider succeeded")
+	}
+	if rejected.Value() == before {
+		t.Fatal("rejection not counted")
+	}
+}
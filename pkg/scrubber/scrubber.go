@@ -0,0 +1,210 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scrubber
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const _readBufferSize = 1024 * 1024
+
+// Source provides stored blobs for Scrubber to verify.
+type Source interface {
+	// Blobs returns ids of completed blobs, which are sha256 hex digests of their content.
+	Blobs() ([]string, error)
+	// Open returns content and size of blob id.
+	Open(id string) (io.ReadCloser, int64, error)
+	// Stat returns current size of blob id.
+	Stat(id string) (int64, error)
+	// Info returns torrent info of blob id, or nil if blob has no torrent yet.
+	Info(id string) (*metainfo.Info, error)
+	// Quarantine stops serving blob id found corrupt.
+	Quarantine(id string, reason error)
+}
+
+type Config struct {
+	Interval  time.Duration // pause between two rounds of scrubbing
+	RateLimit int64         // bytes read per second
+}
+
+// Scrubber walks blobs of Source in background, verifies each of them against
+// its digest and piece hashes of its torrent, and quarantines corrupt ones.
+type Scrubber struct {
+	name    string
+	source  Source
+	config  Config
+	limiter *rate.Limiter
+	stats   *expvar.Map
+}
+
+func New(name string, source Source, config Config) *Scrubber {
+	limit := rate.Inf
+	if config.RateLimit > 0 {
+		limit = rate.Limit(config.RateLimit)
+	}
+	return &Scrubber{
+		name:    name,
+		source:  source,
+		config:  config,
+		limiter: rate.NewLimiter(limit, _readBufferSize),
+		stats:   expvar.NewMap("scrubber_" + name),
+	}
+}
+
+// Start runs scrubbing rounds in background.
+func (s *Scrubber) Start() {
+	go func() {
+		for {
+			time.Sleep(s.config.Interval)
+			s.scrub()
+		}
+	}()
+}
+
+func (s *Scrubber) scrub() {
+	ids, err := s.source.Blobs()
+	if err != nil {
+		log.Errorf("Scrubber %s list blobs failed: %v", s.name, err)
+		return
+	}
+	log.Infof("Scrubber %s start to verify %d blobs ...", s.name, len(ids))
+	var corrupted int
+	for _, id := range ids {
+		err := s.Verify(id)
+		if backenderrors.IsCorrupt(err) {
+			// blob may have been evicted and fetched again while reading,
+			// verify the current copy once more before quarantining it
+			err = s.Verify(id)
+		}
+		switch {
+		case err == nil:
+			s.stats.Add("verified", 1)
+		case backenderrors.IsCorrupt(err):
+			corrupted++
+			s.stats.Add("corrupted", 1)
+			log.Errorf("Scrubber %s found corrupt blob %s: %v, quarantine it", s.name, id, err)
+			s.source.Quarantine(id, err)
+		case backenderrors.IsNotFound(err):
+			// removed in the meantime
+		default:
+			s.stats.Add("errors", 1)
+			log.Warnf("Scrubber %s verify blob %s failed: %v", s.name, id, err)
+		}
+	}
+	s.stats.Add("rounds", 1)
+	log.Infof("Scrubber %s verified %d blobs, %d corrupted", s.name, len(ids), corrupted)
+}
+
+// Verify rechecks content of blob id against its digest and piece hashes,
+// mismatches are returned as backenderrors.ErrCorrupt.
+func (s *Scrubber) Verify(id string) error {
+	info, err := s.source.Info(id)
+	if err != nil {
+		return err
+	}
+	rc, size, err := s.source.Open(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if info != nil && info.TotalLength() != size {
+		return backenderrors.New(backenderrors.ErrCorrupt, id,
+			fmt.Errorf("size %d mismatches torrent length %d", size, info.TotalLength()))
+	}
+
+	digest := sha256.New()
+	var (
+		piece      hash.Hash
+		pieceIndex int
+		pieceLeft  int64
+	)
+	if info != nil && info.NumPieces() > 0 {
+		piece, pieceLeft = sha1.New(), info.Piece(0).Length()
+	}
+	buf := make([]byte, _readBufferSize)
+	var read int64
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			if err := s.limiter.WaitN(context.Background(), n); err != nil {
+				return err
+			}
+			read += int64(n)
+			digest.Write(buf[:n])
+			if piece != nil {
+				if err := verifyPieces(id, info, buf[:n], piece, &pieceIndex, &pieceLeft); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.stats.Add("bytes", read)
+	if read != size {
+		// blob removed or replaced while reading isn't corrupt
+		if current, err := s.source.Stat(id); err != nil || current != size {
+			return backenderrors.New(backenderrors.ErrBlobNotFound, id, fmt.Errorf("changed while reading"))
+		}
+		return backenderrors.New(backenderrors.ErrCorrupt, id, fmt.Errorf("read %d bytes of %d", read, size))
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != id {
+		return backenderrors.New(backenderrors.ErrCorrupt, id, fmt.Errorf("content digest %s mismatches", sum))
+	}
+	return nil
+}
+
+// verifyPieces feeds data into piece hash, and checks each piece once completed.
+func verifyPieces(id string, info *metainfo.Info, data []byte, piece hash.Hash, index *int, left *int64) error {
+	for len(data) > 0 {
+		n := int64(len(data))
+		if n > *left {
+			n = *left
+		}
+		piece.Write(data[:n])
+		data = data[n:]
+		if *left -= n; *left > 0 {
+			continue
+		}
+		var sum metainfo.Hash
+		copy(sum[:], piece.Sum(nil))
+		if expected := info.Piece(*index).Hash(); sum != expected {
+			return backenderrors.New(backenderrors.ErrCorrupt, id, fmt.Errorf("piece %d hash mismatches", *index))
+		}
+		piece.Reset()
+		if *index++; *index < info.NumPieces() {
+			*left = info.Piece(*index).Length()
+		} else if len(data) > 0 {
+			return backenderrors.New(backenderrors.ErrCorrupt, id, fmt.Errorf("content exceeds torrent length"))
+		}
+	}
+	return nil
+}
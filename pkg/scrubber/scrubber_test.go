@@ -0,0 +1,115 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scrubber
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+type memSource struct {
+	data        []byte
+	info        *metainfo.Info
+	quarantined []string
+	// replacing makes next Open read part of blob only, as if it was
+	// removed and fetched again meanwhile
+	replacing bool
+	size      int64
+}
+
+func (m *memSource) Blobs() ([]string, error) {
+	sum := sha256.Sum256(m.data)
+	return []string{hex.EncodeToString(sum[:])}, nil
+}
+
+func (m *memSource) Open(id string) (io.ReadCloser, int64, error) {
+	if m.replacing {
+		m.replacing = false
+		return ioutil.NopCloser(bytes.NewReader(m.data[:len(m.data)/2])), int64(len(m.data)), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(m.data)), int64(len(m.data)), nil
+}
+
+func (m *memSource) Stat(id string) (int64, error) {
+	if m.size > 0 {
+		return m.size, nil
+	}
+	return int64(len(m.data)), nil
+}
+
+func (m *memSource) Info(id string) (*metainfo.Info, error) {
+	return m.info, nil
+}
+
+func (m *memSource) Quarantine(id string, reason error) {
+	m.quarantined = append(m.quarantined, id)
+}
+
+func newMemSource(t *testing.T, size int) *memSource {
+	data := make([]byte, size)
+	rand.Read(data)
+	info := &metainfo.Info{PieceLength: 16 * 1024, Name: "blob", Length: int64(size)}
+	err := info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &memSource{data: data, info: info}
+}
+
+func TestVerify(t *testing.T) {
+	source := newMemSource(t, 3*1024*1024+100)
+	s := New("test-verify", source, Config{})
+	ids, _ := source.Blobs()
+	if err := s.Verify(ids[0]); err != nil {
+		t.Fatalf("expected intact blob, got %v", err)
+	}
+
+	source.data[2*1024*1024] ^= 0xff
+	if err := s.Verify(ids[0]); !backenderrors.IsCorrupt(err) {
+		t.Fatalf("expected corrupt blob, got %v", err)
+	}
+	s.scrub()
+	if len(source.quarantined) != 1 {
+		t.Fatalf("expected corrupt blob quarantined, got %v", source.quarantined)
+	}
+}
+
+func TestScrubReplacedBlob(t *testing.T) {
+	source := newMemSource(t, 3*1024*1024+100)
+	s := New("test-replaced", source, Config{})
+	ids, _ := source.Blobs()
+
+	// size changed while reading
+	source.replacing, source.size = true, 100
+	if err := s.Verify(ids[0]); !backenderrors.IsNotFound(err) {
+		t.Fatalf("expected blob changed while reading, got %v", err)
+	}
+
+	// fetched again with the same size while reading
+	source.replacing, source.size = true, 0
+	s.scrub()
+	if len(source.quarantined) != 0 {
+		t.Fatalf("expected fresh copy not quarantined, got %v", source.quarantined)
+	}
+}
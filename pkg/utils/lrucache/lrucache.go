@@ -18,11 +18,15 @@ import (
 	"errors"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"time"
 )
 
 // EvictCallback is used to get a callback when a cache entry is evicted
 type EvictCallback func(string)
 
+// GroupFunc returns group of key, whose size is limited separately.
+type GroupFunc func(string) string
+
 type LruCache struct {
 	sync.RWMutex
 	limitSize   int64
@@ -30,18 +34,32 @@ type LruCache struct {
 	evictList   *list.List
 	items       map[string]*list.Element
 	onEvict     EvictCallback
+
+	groupOf     GroupFunc
+	groupLimits map[string]int64
+	groupSizes  map[string]int64
+
+	maxAge       time.Duration
+	minResidency time.Duration
 }
 
 // Entry is used to hold a value in the evictList
 type entry struct {
 	key   string
 	value Entry
+	// removed while in use, evicted once released
+	doomed bool
 }
 
 type Entry struct {
-	Done      chan struct{}
-	Completed bool
-	Size      int64
+	Done       chan struct{}
+	Completed  bool
+	Size       int64
+	Pinned     bool      // pinned entry is never evicted
+	LastAccess time.Time // last time the completed entry was got
+	Group      string    // group the completed entry is accounted in
+	Added      time.Time // time the entry was completed
+	InUse      int       // readers of the entry, which is never evicted while read
 }
 
 // NewLRU constructs an LRU of the given size
@@ -54,23 +72,63 @@ func NewLRU(size int64, onEvict EvictCallback) (*LruCache, error) {
 		evictList: list.New(),
 		items:     make(map[string]*list.Element),
 		onEvict:   onEvict,
+		groupOf:   func(string) string { return "" },
 	}
 	return c, nil
 }
 
-// Get looks up a key's value from the cache
-func (c *LruCache) Get(key string) (Entry, bool) {
+// SetGroups limits size of each group of entries besides the whole cache,
+// with groupOf telling group of an entry once it is completed. Entries of a
+// group exceeding its limit are evicted from the oldest.
+func (c *LruCache) SetGroups(groupOf GroupFunc, limits map[string]int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.groupOf = groupOf
+	c.groupLimits = limits
+	c.groupSizes = make(map[string]int64)
+}
+
+// SetPolicy expires completed entries not accessed for maxAge, if it is
+// positive, and keeps entries from eviction for minResidency after they are
+// completed.
+func (c *LruCache) SetPolicy(maxAge, minResidency time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.maxAge = maxAge
+	c.minResidency = minResidency
+}
+
+// GroupSize returns current size of group.
+func (c *LruCache) GroupSize(group string) int64 {
 	c.RLock()
 	defer c.RUnlock()
+	return c.groupSizes[group]
+}
+
+// Get looks up a key's value from the cache
+func (c *LruCache) Get(key string) (Entry, bool) {
+	c.Lock()
+	defer c.Unlock()
 	if ent, ok := c.items[key]; ok {
 		if ent.Value.(*entry).value.Completed {
 			c.evictList.MoveToFront(ent)
+			ent.Value.(*entry).value.LastAccess = time.Now()
 		}
 		return ent.Value.(*entry).value, true
 	}
 	return Entry{}, false
 }
 
+// Peek looks up a key's value from the cache without updating its recency
+func (c *LruCache) Peek(key string) (Entry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if ent, ok := c.items[key]; ok {
+		return ent.Value.(*entry).value, true
+	}
+	return Entry{}, false
+}
+
 // Create if not exists. Returns true if the entry existed.
 func (c *LruCache) CreateIfNotExists(key string) (Entry, bool) {
 	c.Lock()
@@ -79,6 +137,7 @@ func (c *LruCache) CreateIfNotExists(key string) (Entry, bool) {
 	if ent, ok := c.items[key]; ok {
 		if ent.Value.(*entry).value.Completed {
 			c.evictList.MoveToFront(ent)
+			ent.Value.(*entry).value.LastAccess = time.Now()
 		}
 		return ent.Value.(*entry).value, true
 	}
@@ -97,6 +156,9 @@ func (c *LruCache) CreateIfNotExists(key string) (Entry, bool) {
 // removeElement is used to remove a given list element from the cache
 func (c *LruCache) removeElement(e *list.Element) {
 	c.currentSize -= e.Value.(*entry).value.Size
+	if c.groupSizes != nil && e.Value.(*entry).value.Completed {
+		c.groupSizes[e.Value.(*entry).value.Group] -= e.Value.(*entry).value.Size
+	}
 	c.evictList.Remove(e)
 	kv := e.Value.(*entry)
 	delete(c.items, kv.key)
@@ -105,12 +167,129 @@ func (c *LruCache) removeElement(e *list.Element) {
 	}
 }
 
-// removeOldest removes the oldest item from the cache.
-func (c *LruCache) removeOldest() {
-	ent := c.evictList.Back()
-	if ent != nil {
+// evictable tells if entry may be evicted at now, which is neither pinned,
+// in use nor completed within minResidency.
+func (c *LruCache) evictable(value *Entry, now time.Time) bool {
+	return !value.Pinned && value.InUse == 0 && now.Sub(value.Added) >= c.minResidency
+}
+
+// removeOldest removes the oldest evictable item from the cache, or from
+// group if it is not empty. Returns false if none is evictable.
+func (c *LruCache) removeOldest(group string) bool {
+	now := time.Now()
+	for ent := c.evictList.Back(); ent != nil; ent = ent.Prev() {
+		value := &ent.Value.(*entry).value
+		if !c.evictable(value, now) || (group != "" && value.Group != group) {
+			continue
+		}
 		c.removeElement(ent)
+		return true
+	}
+	return false
+}
+
+// add accounts size of entry just completed, and evicts the oldest entries
+// until both its group and the whole cache fit in their limits. Returns
+// true if an eviction occurred.
+func (c *LruCache) add(key string, value *Entry) bool {
+	c.currentSize += value.Size
+	if c.groupSizes != nil {
+		value.Group = c.groupOf(key)
+		c.groupSizes[value.Group] += value.Size
+	}
+	return c.shrink() > 0
+}
+
+// shrink evicts the oldest evictable entries until all groups and the whole
+// cache fit in their limits. Cache stays oversized if none is evictable,
+// and shrinks once entries become evictable. Returns number of entries
+// evicted.
+func (c *LruCache) shrink() (evicted int) {
+	for group, limit := range c.groupLimits {
+		for c.groupSizes[group] > limit && c.removeOldest(group) {
+			evicted++
+		}
+	}
+	for c.currentSize > c.limitSize && c.removeOldest("") {
+		evicted++
 	}
+	return evicted
+}
+
+// Expire removes completed entries not accessed for maxAge, and evicts
+// entries which have become evictable since the cache was oversized.
+// Returns number of entries removed.
+func (c *LruCache) Expire() (removed int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.maxAge > 0 {
+		now := time.Now()
+		for ent := c.evictList.Back(); ent != nil; {
+			prev := ent.Prev()
+			value := &ent.Value.(*entry).value
+			if now.Sub(value.LastAccess) > c.maxAge && c.evictable(value, now) {
+				log.Debugf("cache key: %s expired, last accessed at %v", ent.Value.(*entry).key, value.LastAccess)
+				c.removeElement(ent)
+				removed++
+			}
+			ent = prev
+		}
+	}
+	return removed + c.shrink()
+}
+
+// Acquire marks entry of key in use, keeping it from eviction until it is
+// released, and returns its value. Returns false if the key is not contained.
+func (c *LruCache) Acquire(key string) (Entry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	ent, ok := c.items[key]
+	if !ok || ent.Value.(*entry).doomed {
+		return Entry{}, false
+	}
+	ent.Value.(*entry).value.InUse++
+	return ent.Value.(*entry).value, true
+}
+
+// Release releases entry of key acquired before, evicting it if it has been
+// removed while in use, or evicting other entries if the cache has been
+// oversized while it was in use.
+func (c *LruCache) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+	ent, ok := c.items[key]
+	if !ok || ent.Value.(*entry).value.InUse == 0 {
+		return
+	}
+	kv := ent.Value.(*entry)
+	kv.value.InUse--
+	if kv.value.InUse > 0 {
+		return
+	}
+	if kv.doomed {
+		delete(c.items, key)
+		if c.onEvict != nil {
+			c.onEvict(key)
+		}
+		close(kv.value.Done)
+		return
+	}
+	c.shrink()
+}
+
+// doom takes completed entry in use out of accounting and eviction, and
+// presents it as in progress until it is released and evicted, so that it
+// is neither served nor created again meanwhile.
+func (c *LruCache) doom(e *list.Element) {
+	kv := e.Value.(*entry)
+	c.currentSize -= kv.value.Size
+	if c.groupSizes != nil {
+		c.groupSizes[kv.value.Group] -= kv.value.Size
+	}
+	c.evictList.Remove(e)
+	kv.doomed = true
+	kv.value.Completed = false
+	kv.value.Done = make(chan struct{})
 }
 
 // SetComplete mark completed status of cache entry.  Returns true if an eviction occurred.
@@ -126,33 +305,129 @@ func (c *LruCache) SetComplete(key string, size int64) (evicted bool) {
 	// Set status and size
 	ent.Value.(*entry).value.Completed = true
 	ent.Value.(*entry).value.Size = size
+	ent.Value.(*entry).value.LastAccess = time.Now()
+	ent.Value.(*entry).value.Added = ent.Value.(*entry).value.LastAccess
 	close(ent.Value.(*entry).value.Done)
 
-	entry := c.evictList.PushFront(ent.Value.(*entry))
-	c.items[key] = entry
+	elem := c.evictList.PushFront(ent.Value.(*entry))
+	c.items[key] = elem
 
 	// Verify size not exceeded
-	c.currentSize += size
-	evict := c.currentSize > c.limitSize
-	if evict {
-		c.removeOldest()
+	return c.add(key, &ent.Value.(*entry).value)
+}
+
+// Restore adds a completed entry last accessed at lastAccess, e.g. from
+// index persisted before restart. It is placed by its recency, so entries can
+// be restored in any order. Entry in progress, e.g. created while restored
+// data is verified, is completed by it. Returns true if an eviction occurred.
+func (c *LruCache) Restore(key string, size int64, lastAccess time.Time, pinned bool) (evicted bool) {
+	c.Lock()
+	defer c.Unlock()
+	done := make(chan struct{})
+	if ent, ok := c.items[key]; ok {
+		kv := ent.Value.(*entry)
+		if kv.value.Completed || kv.doomed {
+			return false
+		}
+		done = kv.value.Done
+	}
+	close(done)
+	ent := &entry{
+		key: key,
+		value: Entry{
+			Done:       done,
+			Completed:  true,
+			Size:       size,
+			Pinned:     pinned,
+			LastAccess: lastAccess,
+		},
+	}
+	// insert before the first entry accessed no later than it
+	var elem *list.Element
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		if !e.Value.(*entry).value.LastAccess.After(lastAccess) {
+			elem = c.evictList.InsertBefore(ent, e)
+			break
+		}
+	}
+	if elem == nil {
+		elem = c.evictList.PushBack(ent)
 	}
-	return evict
+	c.items[key] = elem
+
+	return c.add(key, &ent.value)
 }
 
 // Remove removes the provided key from the cache, returning if the
-// key was contained.
+// key was contained. Pinned entry is removed as well, while completed entry
+// in use is removed once all of its readers release it, and is seen as in
+// progress until then.
 func (c *LruCache) Remove(key string) (present bool) {
 	c.Lock()
 	defer c.Unlock()
 	if ent, ok := c.items[key]; ok {
-		close(ent.Value.(*entry).value.Done)
-		c.removeElement(ent)
+		kv := ent.Value.(*entry)
+		switch {
+		case kv.doomed:
+		case kv.value.Completed && kv.value.InUse > 0:
+			c.doom(ent)
+		default:
+			// Done of completed entry has been closed already
+			if !kv.value.Completed {
+				close(kv.value.Done)
+			}
+			c.removeElement(ent)
+		}
 		return true
 	}
 	return false
 }
 
+// Pin keeps the entry of key from eviction, returning if the key was contained.
+func (c *LruCache) Pin(key string) bool {
+	return c.setPinned(key, true)
+}
+
+// Unpin makes the entry of key evictable again, returning if the key was contained.
+func (c *LruCache) Unpin(key string) bool {
+	return c.setPinned(key, false)
+}
+
+func (c *LruCache) setPinned(key string, pinned bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	ent, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	ent.Value.(*entry).value.Pinned = pinned
+	return true
+}
+
+// Keys returns keys of completed entries from the most recently used to the
+// least, followed by keys of entries in progress.
+func (c *LruCache) Keys() []string {
+	c.RLock()
+	defer c.RUnlock()
+	keys := make([]string, 0, len(c.items))
+	for ent := c.evictList.Front(); ent != nil; ent = ent.Next() {
+		keys = append(keys, ent.Value.(*entry).key)
+	}
+	for k, ent := range c.items {
+		if !ent.Value.(*entry).value.Completed {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Size returns current and limit size of the cache.
+func (c *LruCache) Size() (int64, int64) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.currentSize, c.limitSize
+}
+
 func (c *LruCache) Output() {
 	c.RLock()
 	defer c.RUnlock()
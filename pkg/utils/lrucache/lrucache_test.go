@@ -0,0 +1,135 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lrucache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicy(t *testing.T) {
+	var evicted []string
+	c, err := NewLRU(100, func(key string) { evicted = append(evicted, key) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetPolicy(time.Hour, time.Minute)
+	now := time.Now()
+	c.Restore("old", 40, now.Add(-2*time.Hour), false)
+	c.Restore("pinned", 40, now.Add(-3*time.Hour), true)
+	c.CreateIfNotExists("new")
+	c.SetComplete("new", 10)
+
+	// layers being served are kept even if expired
+	if _, ok := c.Acquire("old"); !ok {
+		t.Fatal("failed to acquire old")
+	}
+	if n := c.Expire(); n != 0 {
+		t.Fatalf("got %d expired while old is in use, want 0", n)
+	}
+	c.Release("old")
+	if n := c.Expire(); n != 1 || !reflect.DeepEqual(evicted, []string{"old"}) {
+		t.Fatalf("got %d expired %v, want old only", n, evicted)
+	}
+
+	// layers just downloaded are kept even if cache is oversized
+	c.CreateIfNotExists("big")
+	c.SetComplete("big", 60)
+	if keys, want := c.Keys(), []string{"big", "new", "pinned"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got keys %v, want %v", keys, want)
+	}
+	if size, _ := c.Size(); size != 110 {
+		t.Fatalf("got size %d, want oversized 110", size)
+	}
+	c.SetPolicy(time.Hour, 0)
+	if n := c.Expire(); n != 1 || evicted[1] != "new" {
+		t.Fatalf("got %d evicted %v, want new", n, evicted)
+	}
+}
+
+func TestRemoveInUse(t *testing.T) {
+	var evicted []string
+	c, err := NewLRU(100, func(key string) { evicted = append(evicted, key) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CreateIfNotExists("layer")
+	c.SetComplete("layer", 40)
+	if _, ok := c.Acquire("layer"); !ok {
+		t.Fatal("expected layer acquired")
+	}
+
+	if !c.Remove("layer") || len(evicted) != 0 {
+		t.Fatalf("expected layer in use kept, evicted %v", evicted)
+	}
+	entry, ok := c.Get("layer")
+	if !ok || entry.Completed {
+		t.Fatalf("expected layer removed while in use seen in progress, got %+v, %t", entry, ok)
+	}
+	if _, ok := c.Acquire("layer"); ok {
+		t.Fatal("expected layer removed not acquired again")
+	}
+	if current, _ := c.Size(); current != 0 {
+		t.Fatalf("expected size of layer removed not accounted, got %d", current)
+	}
+	if _, exist := c.CreateIfNotExists("layer"); !exist {
+		t.Fatal("expected layer not created again while in use")
+	}
+
+	c.Release("layer")
+	if !reflect.DeepEqual(evicted, []string{"layer"}) {
+		t.Fatalf("expected layer evicted once released, got %v", evicted)
+	}
+	select {
+	case <-entry.Done:
+	default:
+		t.Fatal("expected waiters of layer notified")
+	}
+	if _, ok := c.Peek("layer"); ok {
+		t.Fatal("expected layer gone")
+	}
+}
+
+func TestRestoreInProgress(t *testing.T) {
+	c, err := NewLRU(100, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// layer registered while verified is completed by restoring it
+	entry, exist := c.CreateIfNotExists("layer")
+	if exist {
+		t.Fatal("expected layer created")
+	}
+	lastAccess := time.Now().Add(-time.Hour)
+	c.Restore("layer", 40, lastAccess, true)
+	select {
+	case <-entry.Done:
+	default:
+		t.Fatal("expected waiters of layer notified")
+	}
+	got, ok := c.Peek("layer")
+	if !ok || !got.Completed || got.Size != 40 || !got.Pinned || !got.LastAccess.Equal(lastAccess) {
+		t.Fatalf("got %+v, %t, want layer restored", got, ok)
+	}
+	if size, _ := c.Size(); size != 40 {
+		t.Fatalf("got size %d, want 40", size)
+	}
+
+	// completed layer isn't restored again
+	c.Restore("layer", 60, time.Now(), false)
+	if got, _ := c.Peek("layer"); got.Size != 40 {
+		t.Fatalf("got size %d of layer restored twice, want 40", got.Size)
+	}
+}
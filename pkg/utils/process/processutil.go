@@ -14,54 +14,150 @@
 package process
 
 import (
-	"fmt"
-	"github.com/anacrolix/torrent"
-	"io"
+	"context"
 	"time"
 
-	"context"
-	pb "gopkg.in/cheggaaa/pb.v1"
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// interval of reporting progress of a download
+	reportInterval = time.Second
+	// window of measuring download rate
+	rateWindow = 10 * time.Second
+)
+
+// States of a download
+const (
+	StateDownloading = "downloading"
+	StateCompleted   = "completed"
+	StateStopped     = "stopped"
 )
 
+// Progress is a snapshot of a download.
+type Progress struct {
+	ID        string        `json:"id"`
+	State     string        `json:"state"`
+	Total     int64         `json:"total"`
+	Completed int64         `json:"completed"`
+	Rate      int64         `json:"rate"` // bytes per second over the last rateWindow
+	ETA       time.Duration `json:"eta"`  // -1 if unknown
+	Peers     int           `json:"peers"`
+	Started   time.Time     `json:"started"`
+}
+
+// Finished tells whether the download is over.
+func (p Progress) Finished() bool {
+	return p.State != StateDownloading
+}
+
+// ProgressDownload reports progress of a download, driven by piece state
+// changes of its torrent.
 type ProgressDownload struct {
-	id     string
-	output io.Writer
-	bar    *pb.ProgressBar
+	id       string
+	total    int64
+	reporter *Reporter
+}
+
+func NewProgressDownload(id string, total int64, reporter *Reporter) *ProgressDownload {
+	return &ProgressDownload{
+		id:       id,
+		total:    total,
+		reporter: reporter,
+	}
 }
 
+// WaitComplete blocks until t is completed or ctx is done.
 func (p *ProgressDownload) WaitComplete(ctx context.Context, t *torrent.Torrent) {
-	writeReport := func(f string, a ...interface{}) {
-		fmt.Fprintf(p.output, f, a...)
+	m := newMeter(time.Now())
+	report := func(state string, completed int64, now time.Time) {
+		if p.reporter == nil {
+			return
+		}
+		rate := m.update(now, completed)
+		p.reporter.Report(Progress{
+			ID:        p.id,
+			State:     state,
+			Total:     p.total,
+			Completed: completed,
+			Rate:      rate,
+			ETA:       eta(p.total-completed, rate),
+			Peers:     t.Stats().ActivePeers,
+			Started:   m.start,
+		})
 	}
 
-	writeReport("Waiting bt download %s complete ...\n", p.id)
-	writeReport("Getting torrent info %s\n", p.id)
-	<-t.GotInfo()
-	writeReport("Start bittorent downloading %s\n", p.id)
+	select {
+	case <-t.GotInfo():
+	case <-ctx.Done():
+		report(StateStopped, 0, time.Now())
+		return
+	}
+	// subscribe before checking completion, so that no change is missed
+	sub := t.SubscribePieceStateChanges()
+	defer sub.Close()
+	// refresh rate and peers while no piece changes
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
 
-Loop:
+	var lastReport time.Time
 	for {
+		completed, now := t.BytesCompleted(), time.Now()
+		if completed >= p.total {
+			report(StateCompleted, completed, now)
+			return
+		}
+		if now.Sub(lastReport) >= reportInterval {
+			report(StateDownloading, completed, now)
+			lastReport = now
+		} else {
+			m.update(now, completed)
+		}
 		select {
 		case <-ctx.Done():
-			writeReport("Stop bittorent downloading %s\n", p.id)
-			break Loop
-		default:
-			total := t.Info().TotalLength()
-			completed := t.BytesCompleted()
-			if completed >= total {
-				break Loop
-			}
-			time.Sleep(10 * time.Millisecond)
+			report(StateStopped, t.BytesCompleted(), time.Now())
+			return
+		case <-sub.Values:
+		case <-ticker.C:
 		}
 	}
-	writeReport("Download bt %s completed\n", p.id)
 }
 
-func NewProgressDownload(id string, size int, output io.Writer) *ProgressDownload {
-	bar := NewProgressBar(size, output)
-	return &ProgressDownload{
-		id:     id,
-		output: output,
-		bar:    bar,
+func eta(remaining, rate int64) time.Duration {
+	if rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(remaining) / float64(rate) * float64(time.Second))
+}
+
+type sample struct {
+	at    time.Time
+	bytes int64
+}
+
+// meter measures download rate over the last rateWindow.
+type meter struct {
+	start   time.Time
+	samples []sample // oldest first
+}
+
+func newMeter(start time.Time) *meter {
+	return &meter{start: start, samples: []sample{{at: start}}}
+}
+
+// update records completed bytes at now and returns rate in bytes per second.
+func (m *meter) update(now time.Time, completed int64) int64 {
+	m.samples = append(m.samples, sample{at: now, bytes: completed})
+	// keep the newest sample older than window as the base
+	i := 0
+	for i+1 < len(m.samples) && now.Sub(m.samples[i+1].at) >= rateWindow {
+		i++
+	}
+	m.samples = m.samples[i:]
+	base := m.samples[0]
+	elapsed := now.Sub(base.at)
+	if elapsed <= 0 {
+		return 0
 	}
+	return int64(float64(completed-base.bytes) / elapsed.Seconds())
 }
@@ -0,0 +1,65 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package process
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	start := time.Now()
+	m := newMeter(start)
+	if rate := m.update(start.Add(time.Second), 100); rate != 100 {
+		t.Fatalf("rate of the first second: got %d, want 100", rate)
+	}
+	if rate := m.update(start.Add(5*time.Second), 1000); rate != 200 {
+		t.Fatalf("rate of the first 5 seconds: got %d, want 200", rate)
+	}
+	// samples older than window are dropped
+	if rate := m.update(start.Add(20*time.Second), 1000); rate != 0 {
+		t.Fatalf("rate of idle window: got %d, want 0", rate)
+	}
+}
+
+func TestETA(t *testing.T) {
+	if d := eta(1000, 100); d != 10*time.Second {
+		t.Fatalf("got eta %v, want 10s", d)
+	}
+	if d := eta(1000, 0); d != -1 {
+		t.Fatalf("got eta %v of zero rate, want -1", d)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	r := NewReporter()
+	var got []Progress
+	unsubscribe := r.Subscribe(func(p Progress) { got = append(got, p) })
+
+	r.Report(Progress{ID: "b", State: StateDownloading})
+	r.Report(Progress{ID: "a", State: StateDownloading})
+	if active := r.Active(); len(active) != 2 || active[0].ID != "a" || active[1].ID != "b" {
+		t.Fatalf("unexpected active downloads %v", active)
+	}
+	r.Report(Progress{ID: "a", State: StateCompleted})
+	if active := r.Active(); len(active) != 1 || active[0].ID != "b" {
+		t.Fatalf("unexpected active downloads %v after completion", active)
+	}
+
+	unsubscribe()
+	r.Report(Progress{ID: "b", State: StateStopped})
+	if len(got) != 3 {
+		t.Fatalf("listener got %d reports, want 3", len(got))
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package process
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Listener receives progress of downloads. It is called in the goroutine
+// waiting for the download, so it should not block.
+type Listener func(p Progress)
+
+// Reporter publishes progress of downloads to its listeners, and keeps the
+// latest progress of downloads in progress.
+type Reporter struct {
+	sync.RWMutex
+	nextID    int
+	listeners map[int]Listener
+	active    map[string]Progress
+}
+
+func NewReporter() *Reporter {
+	return &Reporter{
+		listeners: make(map[int]Listener),
+		active:    make(map[string]Progress),
+	}
+}
+
+// Subscribe adds listener l, which is removed by calling the returned func.
+func (r *Reporter) Subscribe(l Listener) func() {
+	r.Lock()
+	defer r.Unlock()
+	id := r.nextID
+	r.nextID++
+	r.listeners[id] = l
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.listeners, id)
+	}
+}
+
+// Report publishes p to all listeners.
+func (r *Reporter) Report(p Progress) {
+	r.Lock()
+	if p.Finished() {
+		delete(r.active, p.ID)
+	} else {
+		r.active[p.ID] = p
+	}
+	listeners := make([]Listener, 0, len(r.listeners))
+	for _, l := range r.listeners {
+		listeners = append(listeners, l)
+	}
+	r.Unlock()
+	for _, l := range listeners {
+		l(p)
+	}
+}
+
+// Active returns the latest progress of downloads in progress, ordered by id.
+func (r *Reporter) Active() []Progress {
+	r.RLock()
+	defer r.RUnlock()
+	ps := make([]Progress, 0, len(r.active))
+	for _, p := range r.active {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+	return ps
+}
+
+// PublishExpvar exposes active downloads as expvar variable name.
+func (r *Reporter) PublishExpvar(name string) {
+	if expvar.Get(name) != nil {
+		return
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.Active()
+	}))
+}
+
+// NewLogListener logs start and end of downloads, and their progress at
+// most once per interval.
+func NewLogListener(interval time.Duration) Listener {
+	var (
+		mu     sync.Mutex
+		logged = make(map[string]time.Time)
+	)
+	return func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		last, exist := logged[p.ID]
+		switch {
+		case p.Finished():
+			delete(logged, p.ID)
+			log.Infof("Download %s %s, %d/%d bytes in %v", p.ID, p.State, p.Completed, p.Total, time.Since(p.Started).Round(time.Millisecond))
+		case !exist:
+			logged[p.ID] = time.Now()
+			log.Infof("Start bittorrent downloading %s, %d bytes", p.ID, p.Total)
+		case time.Since(last) >= interval:
+			logged[p.ID] = time.Now()
+			log.Infof("Download %s: %d/%d bytes, %d bytes/s, eta %v, %d peers", p.ID, p.Completed, p.Total, p.Rate, p.ETA.Round(time.Second), p.Peers)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ratelimiter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Limits are upload and download rate limits in bytes per second, zero of
+// which means not limited by it.
+type Limits struct {
+	Upload   int64 `json:"upload,omitempty"`
+	Download int64 `json:"download,omitempty"`
+}
+
+// Window is a daily time window in local time, during which its limits
+// apply instead of the default ones. Window crossing midnight, e.g. from
+// 22:00 to 06:00, belongs to the day it starts.
+type Window struct {
+	Days   []time.Weekday // every day if empty
+	Start  time.Duration  // offset of start from midnight
+	End    time.Duration  // offset of end from midnight
+	Limits Limits
+}
+
+// ParseClock parses time of day in form of 15:04 as offset from midnight.
+func ParseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseWeekday parses weekday by its name or abbreviation, e.g. Monday or Mon.
+func ParseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) || strings.EqualFold(s, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+func (w Window) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, day := range w.Days {
+		if day == d {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells if t is within the window.
+func (w Window) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End && w.onDay(t.Weekday())
+	}
+	// part after midnight belongs to the previous day
+	if offset >= w.Start {
+		return w.onDay(t.Weekday())
+	}
+	return offset < w.End && w.onDay((t.Weekday()+6)%7)
+}
+
+// Scheduler applies limits of the current window of schedule, or limits
+// overridden at runtime, to live rate limiters. Limiters are shared by all
+// connections, so changes take effect without dropping any of them.
+type Scheduler struct {
+	sync.Mutex
+	upload   *rate.Limiter
+	download *rate.Limiter
+	defaults Limits
+	windows  []Window
+
+	override *Limits
+	until    time.Time // expiry of override, never if zero
+	current  Limits
+	stop     chan struct{}
+}
+
+// NewScheduler returns a scheduler of upload and download limiters, which
+// are limited by defaults out of windows. The first window containing
+// current time wins.
+func NewScheduler(upload, download *rate.Limiter, defaults Limits, windows []Window) *Scheduler {
+	s := &Scheduler{
+		upload:   upload,
+		download: download,
+		defaults: defaults,
+		windows:  windows,
+		stop:     make(chan struct{}),
+	}
+	s.apply(time.Now())
+	return s
+}
+
+// Start re-applies limits every minute, following schedule and expiry of
+// override.
+func (s *Scheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.apply(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops applying schedule.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+// Limits returns limits in effect, and whether they are overridden at runtime
+// until the time returned, which is zero if the override never expires.
+func (s *Scheduler) Limits() (Limits, bool, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	return s.current, s.override != nil, s.until
+}
+
+// Scheduled returns limits of schedule at t, regardless of override.
+func (s *Scheduler) Scheduled(t time.Time) Limits {
+	limits := s.defaults
+	for _, w := range s.windows {
+		if w.contains(t) {
+			if w.Limits.Upload > 0 {
+				limits.Upload = w.Limits.Upload
+			}
+			if w.Limits.Download > 0 {
+				limits.Download = w.Limits.Download
+			}
+			break
+		}
+	}
+	return limits
+}
+
+// Override applies limits instead of schedule for d, or until it is reset
+// if d is zero. Zero limit keeps the scheduled one.
+func (s *Scheduler) Override(limits Limits, d time.Duration) {
+	s.Lock()
+	s.override = &limits
+	s.until = time.Time{}
+	if d > 0 {
+		s.until = time.Now().Add(d)
+	}
+	s.Unlock()
+	s.apply(time.Now())
+}
+
+// Reset drops override, going back to schedule.
+func (s *Scheduler) Reset() {
+	s.Lock()
+	s.override = nil
+	s.until = time.Time{}
+	s.Unlock()
+	s.apply(time.Now())
+}
+
+func (s *Scheduler) apply(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if s.override != nil && !s.until.IsZero() && !now.Before(s.until) {
+		log.Infof("Override of bandwidth limits %+v expired, go back to schedule", *s.override)
+		s.override, s.until = nil, time.Time{}
+	}
+	limits := s.Scheduled(now)
+	if s.override != nil {
+		if s.override.Upload > 0 {
+			limits.Upload = s.override.Upload
+		}
+		if s.override.Download > 0 {
+			limits.Download = s.override.Download
+		}
+	}
+	if limits == s.current {
+		return
+	}
+	log.Infof("Apply bandwidth limits: upload %d/s, download %d/s", limits.Upload, limits.Download)
+	setLimit(s.upload, limits.Upload)
+	setLimit(s.download, limits.Download)
+	s.current = limits
+}
+
+func setLimit(l *rate.Limiter, limit int64) {
+	if l == nil {
+		return
+	}
+	if limit <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(limit))
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestScheduler(t *testing.T) {
+	clock := func(s string) time.Duration {
+		d, err := ParseClock(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	windows := []Window{
+		// business hours on weekdays
+		{Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start: clock("09:00"), End: clock("18:00"), Limits: Limits{Upload: 10}},
+		// nights, crossing midnight
+		{Start: clock("22:00"), End: clock("06:00"), Limits: Limits{Upload: 1000, Download: 1000}},
+	}
+	upload := rate.NewLimiter(100, 1)
+	s := NewScheduler(upload, nil, Limits{Upload: 100, Download: 100}, windows)
+
+	// 2020-06-01 is a Monday
+	for _, c := range []struct {
+		at   string
+		want Limits
+	}{
+		{"2020-06-01 10:00", Limits{Upload: 10, Download: 100}},
+		{"2020-06-01 18:00", Limits{Upload: 100, Download: 100}},
+		{"2020-06-06 10:00", Limits{Upload: 100, Download: 100}},
+		{"2020-06-06 23:00", Limits{Upload: 1000, Download: 1000}},
+		{"2020-06-07 05:59", Limits{Upload: 1000, Download: 1000}},
+	} {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", c.at, time.Local)
+		if got := s.Scheduled(at); got != c.want {
+			t.Errorf("got limits %+v at %s, want %+v", got, c.at, c.want)
+		}
+	}
+
+	// override applies to live limiter until it expires
+	s.Override(Limits{Upload: 5}, time.Minute)
+	if upload.Limit() != 5 {
+		t.Fatalf("got upload limit %v, want 5", upload.Limit())
+	}
+	s.apply(time.Now().Add(2 * time.Minute))
+	if _, overridden, _ := s.Limits(); overridden {
+		t.Fatal("override not expired")
+	}
+}
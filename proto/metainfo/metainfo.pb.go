@@ -39,6 +39,7 @@ const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 // The request message containing the source request
 type MetaInfoRequest struct {
 	Url                  string   `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	Refetch              bool     `protobuf:"varint,2,opt,name=refetch,proto3" json:"refetch,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -75,6 +76,13 @@ func (m *MetaInfoRequest) GetUrl() string {
 	return ""
 }
 
+func (m *MetaInfoRequest) GetRefetch() bool {
+	if m != nil {
+		return m.Refetch
+	}
+	return false
+}
+
 // The response message containing the metainfo bytes
 type MetaInfoReply struct {
 	Metainfo             []byte   `protobuf:"bytes,1,opt,name=metainfo,proto3" json:"metainfo,omitempty"`
@@ -196,14 +204,15 @@ var _MetaInfo_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("metainfo.proto", fileDescriptor_metainfo_d2823776ee631445) }
 
 var fileDescriptor_metainfo_d2823776ee631445 = []byte{
-	// 134 bytes of a gzipped FileDescriptorProto
+	// 151 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xcb, 0x4d, 0x2d, 0x49,
-	0xcc, 0xcc, 0x4b, 0xcb, 0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x80, 0xf1, 0x95, 0x94,
+	0xcc, 0xcc, 0x4b, 0xcb, 0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x80, 0xf1, 0x95, 0x6c,
 	0xb9, 0xf8, 0x7d, 0x53, 0x4b, 0x12, 0x3d, 0xf3, 0xd2, 0xf2, 0x83, 0x52, 0x0b, 0x4b, 0x53, 0x8b,
 	0x4b, 0x84, 0x04, 0xb8, 0x98, 0x4b, 0x8b, 0x72, 0x24, 0x18, 0x15, 0x18, 0x35, 0x38, 0x83, 0x40,
-	0x4c, 0x25, 0x6d, 0x2e, 0x5e, 0x84, 0xa2, 0x82, 0x9c, 0x4a, 0x21, 0x29, 0x2e, 0xb8, 0x09, 0x60,
-	0x75, 0x3c, 0x41, 0x70, 0xbe, 0x91, 0x3f, 0x17, 0x07, 0x4c, 0xb1, 0x90, 0x33, 0x17, 0xb7, 0x7b,
-	0x6a, 0x09, 0x9c, 0x2b, 0xa9, 0x07, 0x77, 0x07, 0x9a, 0xa5, 0x52, 0xe2, 0xd8, 0xa4, 0x0a, 0x72,
-	0x2a, 0x95, 0x18, 0x92, 0xd8, 0xc0, 0x6e, 0x36, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0x0f, 0x67,
-	0x8a, 0xf4, 0xc5, 0x00, 0x00, 0x00,
+	0x4c, 0x21, 0x09, 0x2e, 0xf6, 0xa2, 0xd4, 0xb4, 0xd4, 0x92, 0xe4, 0x0c, 0x09, 0x26, 0x05, 0x46,
+	0x0d, 0x8e, 0x20, 0x18, 0x57, 0x49, 0x9b, 0x8b, 0x17, 0xa1, 0xbd, 0x20, 0xa7, 0x52, 0x48, 0x8a,
+	0x0b, 0x6e, 0x36, 0xd8, 0x04, 0x9e, 0x20, 0x38, 0xdf, 0xc8, 0x9f, 0x8b, 0x03, 0xa6, 0x58, 0xc8,
+	0x99, 0x8b, 0xdb, 0x3d, 0xb5, 0x04, 0xce, 0x95, 0xd4, 0x83, 0xbb, 0x10, 0xcd, 0x39, 0x52, 0xe2,
+	0xd8, 0xa4, 0x0a, 0x72, 0x2a, 0x95, 0x18, 0x92, 0xd8, 0xc0, 0xbe, 0x31, 0x06, 0x0c, 0x00, 0x22,
+	0x57, 0x50, 0xbe, 0xdf, 0x00, 0x00, 0x00,
 }
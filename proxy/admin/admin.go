@@ -0,0 +1,264 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/duyanghao/eagle/eagleclient"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"github.com/duyanghao/eagle/pkg/utils/ratelimiter"
+	"github.com/duyanghao/eagle/proxy/transport"
+	distdigests "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+const unixPrefix = "unix://"
+
+// Engine is p2p client managed through admin API, implemented by eagleclient.BtEngine.
+type Engine interface {
+	CacheEntries() []eagleclient.CacheEntry
+	Downloads() []eagleclient.Download
+	Evict(id string) error
+	Pin(id string) error
+	Unpin(id string) error
+	PrefetchLayer(repository, digest string) error
+	PrefetchImage(image string) error
+	Bandwidth() eagleclient.Bandwidth
+	SetBandwidth(limits ratelimiter.Limits, d time.Duration)
+	ResetBandwidth()
+}
+
+// Server serves admin API of proxy node:
+//
+//	GET    /cache            list cached layers
+//	DELETE /cache/<id>       evict a layer
+//	PUT    /cache/<id>/pin   pin a layer
+//	DELETE /cache/<id>/pin   unpin a layer
+//	GET    /downloads        list layers being downloaded
+//	POST   /prefetch         prefetch a layer, {"repository": "...", "digest": "sha256:..."},
+//	                         or layers of an image, {"image": "..."}
+//	GET    /fallbacks        list recent blob requests falling back to origin
+//	GET    /bandwidth        show bandwidth limits
+//	PUT    /bandwidth        override bandwidth limits, {"upload": "10M", "download": "50M", "duration": 3600}
+//	DELETE /bandwidth        go back to scheduled bandwidth limits
+//
+// Layers are identified by sha256 digest, with or without "sha256:" prefix.
+type Server struct {
+	engine    Engine
+	fallbacks func() []transport.Fallback
+	mux       *http.ServeMux
+}
+
+func NewServer(engine Engine, fallbacks func() []transport.Fallback) *Server {
+	s := &Server{
+		engine:    engine,
+		fallbacks: fallbacks,
+		mux:       http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/cache", s.listCache)
+	s.mux.HandleFunc("/cache/", s.cacheEntry)
+	s.mux.HandleFunc("/downloads", s.listDownloads)
+	s.mux.HandleFunc("/prefetch", s.prefetch)
+	s.mux.HandleFunc("/fallbacks", s.listFallbacks)
+	s.mux.HandleFunc("/bandwidth", s.bandwidth)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves admin API on address, which is either host:port or
+// unix:///path/of/socket.
+func (s *Server) ListenAndServe(address string) error {
+	var (
+		lis net.Listener
+		err error
+	)
+	if strings.HasPrefix(address, unixPrefix) {
+		path := strings.TrimPrefix(address, unixPrefix)
+		// remove socket left by last run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		lis, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+	} else {
+		lis, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return fmt.Errorf("listen on %s: %v", address, err)
+	}
+	return http.Serve(lis, s)
+}
+
+func (s *Server) listCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.engine.CacheEntries())
+}
+
+// cacheEntry handles /cache/<id> and /cache/<id>/pin.
+func (s *Server) cacheEntry(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cache/"), "/")
+	id := strings.TrimPrefix(parts[0], string(distdigests.SHA256)+":")
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		err = s.engine.Evict(id)
+	case len(parts) == 2 && parts[1] == "pin" && r.Method == http.MethodPut:
+		err = s.engine.Pin(id)
+	case len(parts) == 2 && parts[1] == "pin" && r.Method == http.MethodDelete:
+		err = s.engine.Unpin(id)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s not found", r.Method, r.URL.Path))
+		return
+	}
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case backenderrors.IsNotFound(err):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, eagleclient.ErrInProgress), errors.Is(err, eagleclient.ErrInUse):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) listDownloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.engine.Downloads())
+}
+
+type prefetchRequest struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Image      string `json:"image"`
+}
+
+// prefetch starts downloading a layer, or layers of an image in background.
+func (s *Server) prefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	var req prefetchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode request: %v", err))
+		return
+	}
+	if req.Image != "" {
+		go func() {
+			if err := s.engine.PrefetchImage(req.Image); err != nil {
+				log.Errorf("Prefetch image %s failed: %v", req.Image, err)
+				return
+			}
+			log.Infof("Prefetch image %s successfully", req.Image)
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if req.Repository == "" {
+		writeError(w, http.StatusBadRequest, errors.New("repository is required"))
+		return
+	}
+	if _, err := distdigests.Parse(req.Digest); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid digest %q: %v", req.Digest, err))
+		return
+	}
+	go func() {
+		if err := s.engine.PrefetchLayer(req.Repository, req.Digest); err != nil {
+			log.Errorf("Prefetch layer %s of %s failed: %v", req.Digest, req.Repository, err)
+			return
+		}
+		log.Infof("Prefetch layer %s of %s successfully", req.Digest, req.Repository)
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) listFallbacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.fallbacks())
+}
+
+type bandwidthRequest struct {
+	Upload   string `json:"upload"`
+	Download string `json:"download"`
+	Duration int    `json:"duration"` // seconds, until reset if not set
+}
+
+// bandwidth shows or changes bandwidth limits of live p2p client.
+func (s *Server) bandwidth(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.engine.Bandwidth())
+	case http.MethodPut:
+		var req bandwidthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("decode request: %v", err))
+			return
+		}
+		if (req.Upload == "" && req.Download == "") || req.Duration < 0 ||
+			(req.Upload != "" && !ratelimiter.ValidateRateLimiter(req.Upload)) ||
+			(req.Download != "" && !ratelimiter.ValidateRateLimiter(req.Download)) {
+			writeError(w, http.StatusBadRequest, errors.New("invalid bandwidth limits"))
+			return
+		}
+		var limits ratelimiter.Limits
+		if req.Upload != "" {
+			limits.Upload = ratelimiter.RateConvert(req.Upload)
+		}
+		if req.Download != "" {
+			limits.Download = ratelimiter.RateConvert(req.Download)
+		}
+		s.engine.SetBandwidth(limits, time.Duration(req.Duration)*time.Second)
+		writeJSON(w, http.StatusOK, s.engine.Bandwidth())
+	case http.MethodDelete:
+		s.engine.ResetBandwidth()
+		writeJSON(w, http.StatusOK, s.engine.Bandwidth())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Write admin response failed: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duyanghao/eagle/eagleclient"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	"github.com/duyanghao/eagle/pkg/utils/ratelimiter"
+	"github.com/duyanghao/eagle/proxy/transport"
+)
+
+const testDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type fakeEngine struct {
+	entries    map[string]*eagleclient.CacheEntry
+	prefetched chan string
+	bandwidth  *ratelimiter.Scheduler
+}
+
+func newFakeEngine() *fakeEngine {
+	return &fakeEngine{
+		entries: map[string]*eagleclient.CacheEntry{
+			"aaa": {ID: "aaa", Size: 10, Completed: true},
+			"bbb": {ID: "bbb"},
+		},
+		prefetched: make(chan string, 1),
+		bandwidth:  ratelimiter.NewScheduler(nil, nil, ratelimiter.Limits{Upload: 100, Download: 100}, nil),
+	}
+}
+
+func (f *fakeEngine) CacheEntries() []eagleclient.CacheEntry {
+	return []eagleclient.CacheEntry{*f.entries["aaa"], *f.entries["bbb"]}
+}
+
+func (f *fakeEngine) Downloads() []eagleclient.Download {
+	return []eagleclient.Download{{ID: "bbb", Total: 10, Completed: 5}}
+}
+
+func (f *fakeEngine) Evict(id string) error {
+	entry, ok := f.entries[id]
+	if !ok {
+		return backenderrors.New(backenderrors.ErrBlobNotFound, id, nil)
+	}
+	if !entry.Completed {
+		return eagleclient.ErrInProgress
+	}
+	delete(f.entries, id)
+	return nil
+}
+
+func (f *fakeEngine) Pin(id string) error {
+	entry, ok := f.entries[id]
+	if !ok {
+		return backenderrors.New(backenderrors.ErrBlobNotFound, id, nil)
+	}
+	entry.Pinned = true
+	return nil
+}
+
+func (f *fakeEngine) Unpin(id string) error {
+	entry, ok := f.entries[id]
+	if !ok {
+		return backenderrors.New(backenderrors.ErrBlobNotFound, id, nil)
+	}
+	entry.Pinned = false
+	return nil
+}
+
+func (f *fakeEngine) PrefetchLayer(repository, digest string) error {
+	f.prefetched <- repository + "@" + digest
+	return nil
+}
+
+func (f *fakeEngine) PrefetchImage(image string) error {
+	f.prefetched <- image
+	return nil
+}
+
+func (f *fakeEngine) Bandwidth() eagleclient.Bandwidth {
+	current, overridden, _ := f.bandwidth.Limits()
+	return eagleclient.Bandwidth{Current: current, Overridden: overridden}
+}
+
+func (f *fakeEngine) SetBandwidth(limits ratelimiter.Limits, d time.Duration) {
+	f.bandwidth.Override(limits, d)
+}
+
+func (f *fakeEngine) ResetBandwidth() {
+	f.bandwidth.Reset()
+}
+
+func do(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestCache(t *testing.T) {
+	engine := newFakeEngine()
+	s := NewServer(engine, func() []transport.Fallback { return nil })
+
+	w := do(s, http.MethodGet, "/cache", "")
+	var entries []eagleclient.CacheEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil || len(entries) != 2 {
+		t.Fatalf("list cache: %v, %v", err, entries)
+	}
+
+	if w := do(s, http.MethodPut, "/cache/sha256:aaa/pin", ""); w.Code != http.StatusNoContent || !engine.entries["aaa"].Pinned {
+		t.Fatalf("pin: got %d", w.Code)
+	}
+	if w := do(s, http.MethodDelete, "/cache/aaa/pin", ""); w.Code != http.StatusNoContent || engine.entries["aaa"].Pinned {
+		t.Fatalf("unpin: got %d", w.Code)
+	}
+	if w := do(s, http.MethodPut, "/cache/ccc/pin", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("pin missing layer: got %d", w.Code)
+	}
+	if w := do(s, http.MethodDelete, "/cache/bbb", ""); w.Code != http.StatusConflict {
+		t.Fatalf("evict layer in progress: got %d", w.Code)
+	}
+	if w := do(s, http.MethodDelete, "/cache/aaa", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("evict: got %d", w.Code)
+	}
+	if _, ok := engine.entries["aaa"]; ok {
+		t.Fatal("layer not evicted")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	engine := newFakeEngine()
+	s := NewServer(engine, func() []transport.Fallback { return nil })
+
+	if w := do(s, http.MethodPost, "/prefetch", `{"repository": "library/nginx", "digest": "sha256:xyz"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("prefetch invalid digest: got %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/prefetch", `{"repository": "library/nginx", "digest": "`+testDigest+`"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("prefetch: got %d", w.Code)
+	}
+	select {
+	case got := <-engine.prefetched:
+		if got != "library/nginx@"+testDigest {
+			t.Fatalf("prefetched %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("layer not prefetched")
+	}
+
+	if w := do(s, http.MethodPost, "/prefetch", `{"image": "nginx:1.19"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("prefetch image: got %d", w.Code)
+	}
+	select {
+	case got := <-engine.prefetched:
+		if got != "nginx:1.19" {
+			t.Fatalf("prefetched %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("image not prefetched")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	engine := newFakeEngine()
+	s := NewServer(engine, func() []transport.Fallback { return nil })
+
+	if w := do(s, http.MethodPut, "/bandwidth", `{"upload": "10X"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("set invalid bandwidth: got %d", w.Code)
+	}
+	w := do(s, http.MethodPut, "/bandwidth", `{"upload": "1K"}`)
+	var b eagleclient.Bandwidth
+	if err := json.NewDecoder(w.Body).Decode(&b); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("set bandwidth: got %d, %v", w.Code, err)
+	}
+	if want := (ratelimiter.Limits{Upload: 1024, Download: 100}); b.Current != want || !b.Overridden {
+		t.Fatalf("got bandwidth %+v, want %+v overridden", b, want)
+	}
+	w = do(s, http.MethodDelete, "/bandwidth", "")
+	if err := json.NewDecoder(w.Body).Decode(&b); err != nil || b.Current.Upload != 100 || b.Overridden {
+		t.Fatalf("reset bandwidth: got %+v, %v", b, err)
+	}
+}
@@ -16,6 +16,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/duyanghao/eagle/eagleclient"
+	"github.com/duyanghao/eagle/proxy/admin"
 	"github.com/duyanghao/eagle/proxy/routes"
 	"net/http"
 
@@ -63,19 +64,77 @@ func Run(flags *Flags) {
 		EnableUpload:      true,
 		EnableSeeding:     true,
 		IncomingPort:      config.ClientCfg.Port,
-		DownloadTimeout:   time.Duration(config.ClientCfg.DownloadTimeout),
 		UploadRateLimit:   ratelimiter.RateConvert(config.ClientCfg.UploadRateLimit),
 		DownloadRateLimit: ratelimiter.RateConvert(config.ClientCfg.DownloadRateLimit),
 		CacheLimitSize:    ratelimiter.RateConvert(config.ClientCfg.LimitSize),
+		ScrubInterval:     time.Duration(config.ClientCfg.ScrubInterval) * time.Second,
+		Locality:          config.ClientCfg.Locality,
+	}
+	c.PrefetchConcurrency = config.ClientCfg.PrefetchConcurrency
+	for _, r := range config.ClientCfg.RootDirectories {
+		c.Roots = append(c.Roots, eagleclient.CacheRoot{Dir: r.Path, LimitSize: ratelimiter.RateConvert(r.LimitSize)})
+	}
+	c.Placement = config.ClientCfg.Placement
+	c.MaxAge = time.Duration(config.ClientCfg.MaxAge) * time.Second
+	c.MinResidency = time.Duration(config.ClientCfg.MinResidency) * time.Second
+	c.PinnedImages = config.ClientCfg.PinnedImages
+	c.PeerAuth = config.ClientCfg.PeerAuth
+	c.Origin = config.ClientCfg.Origin
+	for _, w := range config.ClientCfg.BandwidthSchedule {
+		window, _ := w.window() // validated already
+		c.BandwidthSchedule = append(c.BandwidthSchedule, window)
+	}
+	if config.ClientCfg.ScrubRateLimit != "" {
+		c.ScrubRateLimit = ratelimiter.RateConvert(config.ClientCfg.ScrubRateLimit)
+	}
+	c.Stall = eagleclient.StallConfig{
+		StallTimeout:     time.Duration(config.ClientCfg.StallTimeout) * time.Second,
+		ThroughputWindow: time.Duration(config.ClientCfg.ThroughputWindow) * time.Second,
+		MaxDownloadTime:  time.Duration(config.ClientCfg.MaxDownloadTime) * time.Second,
+	}
+	if config.ClientCfg.MinThroughput != "" {
+		c.Stall.MinThroughput = ratelimiter.RateConvert(config.ClientCfg.MinThroughput)
+	}
+	if config.ClientCfg.MaxDownloadTime == 0 && config.ClientCfg.DownloadTimeout > 0 {
+		log.Warnf("downloadTimeout is deprecated, use it as maxDownloadTime, please switch to stall detection")
+		c.Stall.MaxDownloadTime = time.Duration(config.ClientCfg.DownloadTimeout) * time.Second
+	}
+	if d := config.ClientCfg.LANDiscovery; d != nil {
+		c.LANDiscovery = &eagleclient.LANDiscoveryConfig{
+			Multicast: d.Multicast,
+			Port:      d.Port,
+			Peers:     d.Peers,
+			Interval:  time.Duration(d.Interval) * time.Second,
+		}
+	}
+	if s := config.ClientCfg.Seeding; s != nil {
+		c.Seeding = &eagleclient.SeedingPolicy{
+			MaxRatio:   s.MaxRatio,
+			IdleTime:   time.Duration(s.IdleTime) * time.Second,
+			MinSeeders: s.MinSeeders,
+			Interval:   time.Duration(s.Interval) * time.Second,
+		}
+	}
+	if config.ClientCfg.StreamReadahead != "" {
+		c.StreamReadahead = ratelimiter.RateConvert(config.ClientCfg.StreamReadahead)
 	}
 	eagleClient := eagleclient.NewBtEngine(config.ClientCfg.RootDirectory, config.ClientCfg.Trackers, config.ClientCfg.Seeders, c)
 	proxyRoundTripper := transport.NewProxyRoundTripper(eagleClient, config.ProxyCfg.Rules)
 	err = proxyRoundTripper.P2PClient.Run()
 	if err != nil {
-		log.Fatal("Start eagleClient failure: %v", err)
+		log.Fatalf("Start eagleClient failure: %v", err)
 	}
 	log.Infof("Start eagleClient successfully ...")
 
+	// serve admin API of local node
+	log.Infof("Launch admin API on: %s", config.ProxyCfg.AdminAddress)
+	adminServer := admin.NewServer(eagleClient, proxyRoundTripper.Fallbacks)
+	go func() {
+		if err := adminServer.ListenAndServe(config.ProxyCfg.AdminAddress); err != nil {
+			log.Errorf("Failed to serve admin API: %v", err)
+		}
+	}()
+
 	// init routes
 	routes.InitMux()
 
@@ -15,6 +15,9 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/duyanghao/eagle/eagleclient"
+	"github.com/duyanghao/eagle/pkg/locality"
+	"github.com/duyanghao/eagle/pkg/peerauth"
 	"github.com/duyanghao/eagle/pkg/utils/ratelimiter"
 	"io/ioutil"
 
@@ -29,17 +32,105 @@ type ClientCfg struct {
 	DownloadRateLimit string   `yaml:"downloadRateLimit,omitempty"`
 	UploadRateLimit   string   `yaml:"uploadRateLimit,omitempty"`
 	DownloadTimeout   int      `yaml:"downloadTimeout,omitempty"`
+	StallTimeout      int      `yaml:"stallTimeout,omitempty"`
+	MinThroughput     string   `yaml:"minThroughput,omitempty"`
+	ThroughputWindow  int      `yaml:"throughputWindow,omitempty"`
+	MaxDownloadTime   int      `yaml:"maxDownloadTime,omitempty"`
+	ScrubInterval     int      `yaml:"scrubInterval,omitempty"`
+	ScrubRateLimit    string   `yaml:"scrubRateLimit,omitempty"`
+	StreamReadahead   string   `yaml:"streamReadahead,omitempty"`
 	Port              int      `yaml:"port,omitempty"`
+
+	PrefetchConcurrency int                  `yaml:"prefetchConcurrency,omitempty"`
+	Locality            *locality.Config     `yaml:"locality,omitempty"`
+	LANDiscovery        *LANDiscoveryCfg     `yaml:"lanDiscovery,omitempty"`
+	RootDirectories     []CacheRootCfg       `yaml:"rootDirectories,omitempty"`
+	Placement           string               `yaml:"placement,omitempty"`
+	MaxAge              int                  `yaml:"maxAge,omitempty"`
+	MinResidency        int                  `yaml:"minResidency,omitempty"`
+	PinnedImages        []string             `yaml:"pinnedImages,omitempty"`
+	BandwidthSchedule   []BandwidthWindowCfg `yaml:"bandwidthSchedule,omitempty"`
+	Seeding             *SeedingCfg          `yaml:"seeding,omitempty"`
+	PeerAuth            *peerauth.Config     `yaml:"peerAuth,omitempty"`
+	Origin              string               `yaml:"origin,omitempty"`
+}
+
+type SeedingCfg struct {
+	MaxRatio   float64 `yaml:"maxRatio,omitempty"`
+	IdleTime   int     `yaml:"idleTime,omitempty"`
+	MinSeeders int     `yaml:"minSeeders,omitempty"`
+	Interval   int     `yaml:"interval,omitempty"`
+}
+
+type BandwidthWindowCfg struct {
+	Days              []string `yaml:"days,omitempty"`
+	Start             string   `yaml:"start,omitempty"`
+	End               string   `yaml:"end,omitempty"`
+	UploadRateLimit   string   `yaml:"uploadRateLimit,omitempty"`
+	DownloadRateLimit string   `yaml:"downloadRateLimit,omitempty"`
+}
+
+// window converts configuration of bandwidth window
+func (c BandwidthWindowCfg) window() (ratelimiter.Window, error) {
+	var (
+		w   ratelimiter.Window
+		err error
+	)
+	for _, day := range c.Days {
+		d, err := ratelimiter.ParseWeekday(day)
+		if err != nil {
+			return w, err
+		}
+		w.Days = append(w.Days, d)
+	}
+	if w.Start, err = ratelimiter.ParseClock(c.Start); err != nil {
+		return w, err
+	}
+	if w.End, err = ratelimiter.ParseClock(c.End); err != nil {
+		return w, err
+	}
+	if c.UploadRateLimit == "" && c.DownloadRateLimit == "" {
+		return w, fmt.Errorf("neither uploadRateLimit nor downloadRateLimit is set")
+	}
+	if c.UploadRateLimit != "" {
+		if !ratelimiter.ValidateRateLimiter(c.UploadRateLimit) {
+			return w, fmt.Errorf("invalid uploadRateLimit %s", c.UploadRateLimit)
+		}
+		w.Limits.Upload = ratelimiter.RateConvert(c.UploadRateLimit)
+	}
+	if c.DownloadRateLimit != "" {
+		if !ratelimiter.ValidateRateLimiter(c.DownloadRateLimit) {
+			return w, fmt.Errorf("invalid downloadRateLimit %s", c.DownloadRateLimit)
+		}
+		w.Limits.Download = ratelimiter.RateConvert(c.DownloadRateLimit)
+	}
+	return w, nil
+}
+
+type CacheRootCfg struct {
+	Path      string `yaml:"path,omitempty"`
+	LimitSize string `yaml:"limitSize,omitempty"`
+}
+
+type LANDiscoveryCfg struct {
+	Multicast bool     `yaml:"multicast,omitempty"`
+	Port      int      `yaml:"port,omitempty"`
+	Peers     []string `yaml:"peers,omitempty"`
+	Interval  int      `yaml:"interval,omitempty"`
 }
 
 type ProxyCfg struct {
-	Port     int      `yaml:"port,omitempty"`
-	Verbose  bool     `yaml:"verbose,omitempty"`
-	Rules    []string `yaml:"rules,omitempty"`
-	CertFile string   `yaml:"certFile,omitempty"`
-	KeyFile  string   `yaml:"keyFile,omitempty"`
+	Port         int      `yaml:"port,omitempty"`
+	Verbose      bool     `yaml:"verbose,omitempty"`
+	Rules        []string `yaml:"rules,omitempty"`
+	CertFile     string   `yaml:"certFile,omitempty"`
+	KeyFile      string   `yaml:"keyFile,omitempty"`
+	AdminAddress string   `yaml:"adminAddress,omitempty"`
 }
 
+// defaultAdminAddress only accepts local requests
+const defaultAdminAddress = "127.0.0.1:43003"
+
 type Config struct {
 	ClientCfg *ClientCfg `yaml:"clientCfg,omitempty"`
 	ProxyCfg  *ProxyCfg  `yaml:"proxyCfg,omitempty"`
@@ -47,15 +138,67 @@ type Config struct {
 
 // validate the configuration
 func (c *Config) validate() error {
-	if c.ClientCfg.RootDirectory == "" || len(c.ClientCfg.Trackers) == 0 || len(c.ClientCfg.Seeders) == 0 ||
-		c.ClientCfg.LimitSize == "" || c.ClientCfg.Port <= 0 {
+	if len(c.ClientCfg.Trackers) == 0 || len(c.ClientCfg.Seeders) == 0 || c.ClientCfg.Port <= 0 {
 		return fmt.Errorf("Invalid eagle client configurations, please check ...")
 	}
+	// either a single root directory or multiple ones with their own limits
+	if len(c.ClientCfg.RootDirectories) == 0 {
+		if c.ClientCfg.RootDirectory == "" || c.ClientCfg.LimitSize == "" || !ratelimiter.ValidateRateLimiter(c.ClientCfg.LimitSize) {
+			return fmt.Errorf("Invalid eagle client cache directory configurations, please check ...")
+		}
+	}
+	dirs := make(map[string]bool)
+	for _, r := range c.ClientCfg.RootDirectories {
+		if r.Path == "" || r.LimitSize == "" || !ratelimiter.ValidateRateLimiter(r.LimitSize) || dirs[r.Path] {
+			return fmt.Errorf("Invalid eagle client root directory %q, please check ...", r.Path)
+		}
+		dirs[r.Path] = true
+	}
+	switch c.ClientCfg.Placement {
+	case "", eagleclient.PlacementFreeSpace, eagleclient.PlacementHash:
+	default:
+		return fmt.Errorf("Invalid placement %s, please check ...", c.ClientCfg.Placement)
+	}
 	if !ratelimiter.ValidateRateLimiter(c.ClientCfg.DownloadRateLimit) ||
 		!ratelimiter.ValidateRateLimiter(c.ClientCfg.UploadRateLimit) ||
-		!ratelimiter.ValidateRateLimiter(c.ClientCfg.LimitSize) {
+		(c.ClientCfg.ScrubRateLimit != "" && !ratelimiter.ValidateRateLimiter(c.ClientCfg.ScrubRateLimit)) ||
+		(c.ClientCfg.StreamReadahead != "" && !ratelimiter.ValidateRateLimiter(c.ClientCfg.StreamReadahead)) ||
+		(c.ClientCfg.MinThroughput != "" && !ratelimiter.ValidateRateLimiter(c.ClientCfg.MinThroughput)) {
 		return fmt.Errorf("Invalid ratelimiter format, please check ...")
 	}
+	for _, w := range c.ClientCfg.BandwidthSchedule {
+		if _, err := w.window(); err != nil {
+			return fmt.Errorf("Invalid bandwidth schedule: %v", err)
+		}
+	}
+	if c.ClientCfg.PeerAuth != nil {
+		if err := c.ClientCfg.PeerAuth.Validate(); err != nil {
+			return fmt.Errorf("Invalid peer authentication configurations: %v", err)
+		}
+	}
+	if s := c.ClientCfg.Seeding; s != nil && (s.MaxRatio < 0 || s.IdleTime < 0 || s.MinSeeders < 0 || s.Interval < 0) {
+		return fmt.Errorf("Invalid seeding policy configurations, please check ...")
+	}
+	if c.ClientCfg.MaxAge < 0 || c.ClientCfg.MinResidency < 0 {
+		return fmt.Errorf("Invalid cache eviction policy configurations, please check ...")
+	}
+	if c.ClientCfg.PrefetchConcurrency < 0 {
+		return fmt.Errorf("Invalid prefetch concurrency %d, please check ...", c.ClientCfg.PrefetchConcurrency)
+	}
+	if len(c.ClientCfg.PinnedImages) > 0 && c.ClientCfg.Origin == "" {
+		return fmt.Errorf("Origin is required to resolve pinned images, please check ...")
+	}
+	if c.ClientCfg.StallTimeout < 0 || c.ClientCfg.ThroughputWindow < 0 || c.ClientCfg.MaxDownloadTime < 0 {
+		return fmt.Errorf("Invalid stall detection configurations, please check ...")
+	}
+	if c.ClientCfg.Locality != nil {
+		if err := c.ClientCfg.Locality.Validate(); err != nil {
+			return fmt.Errorf("Invalid locality configurations: %v", err)
+		}
+	}
+	if d := c.ClientCfg.LANDiscovery; d != nil && (d.Port < 0 || d.Port > 65535 || d.Interval < 0) {
+		return fmt.Errorf("Invalid lan discovery configurations, please check ...")
+	}
 	if c.ProxyCfg.Port <= 0 {
 		return fmt.Errorf("Invalid proxy configurations, please check ...")
 	}
@@ -75,6 +218,9 @@ func LoadConfig(path string) (*Config, error) {
 	if err = yaml.Unmarshal(contents, c); err != nil {
 		return nil, fmt.Errorf("Failed to parse configuration,error: %s", err)
 	}
+	if c.ProxyCfg != nil && c.ProxyCfg.AdminAddress == "" {
+		c.ProxyCfg.AdminAddress = defaultAdminAddress
+	}
 	if err = c.validate(); err != nil {
 		return nil, fmt.Errorf("Invalid configuration,error: %s", err)
 	}
@@ -0,0 +1,63 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+// maxFallbacks is number of recent fallbacks kept
+const maxFallbacks = 100
+
+// Fallback records a blob request which failed through p2p and was sent to origin.
+type Fallback struct {
+	Time   time.Time `json:"time"`
+	URL    string    `json:"url"`
+	Reason string    `json:"reason"`
+}
+
+// fallbackLog keeps recent fallbacks in a ring.
+type fallbackLog struct {
+	sync.Mutex
+	entries []Fallback
+	next    int
+}
+
+func (l *fallbackLog) add(f Fallback) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.entries) < maxFallbacks {
+		l.entries = append(l.entries, f)
+		return
+	}
+	l.entries[l.next] = f
+	l.next = (l.next + 1) % maxFallbacks
+}
+
+// list returns fallbacks from the newest to the oldest.
+func (l *fallbackLog) list() []Fallback {
+	l.Lock()
+	defer l.Unlock()
+	fs := make([]Fallback, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		fs = append(fs, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return fs
+}
+
+// Fallbacks returns recent blob requests which fell back to origin, the newest first.
+func (prt *ProxyRoundTripper) Fallbacks() []Fallback {
+	return prt.fallbacks.list()
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errUnsatisfiableRange is returned when none of requested range overlaps blob
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+// byteRange is a satisfiable range of blob
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses Range header of request on blob of size bytes. It
+// returns nil if the whole blob should be served, which is the case for
+// missing, malformed or multiple ranges, since the header may be ignored then.
+func parseRange(s string, size int64) (*byteRange, error) {
+	const b = "bytes="
+	if s == "" || !strings.HasPrefix(s, b) || strings.Contains(s, ",") {
+		return nil, nil
+	}
+	spec := strings.TrimSpace(s[len(b):])
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return nil, nil
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// suffix range, e.g. bytes=-500 for the last 500 bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return &byteRange{start: size - n, length: n}, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return nil, errUnsatisfiableRange
+	}
+	return &byteRange{start: start, length: end - start + 1}, nil
+}
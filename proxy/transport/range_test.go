@@ -0,0 +1,50 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header string
+		want   *byteRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=0-99", &byteRange{0, 100}, nil},
+		{"bytes=900-", &byteRange{900, 100}, nil},
+		{"bytes=900-2000", &byteRange{900, 100}, nil},
+		{"bytes=-100", &byteRange{900, 100}, nil},
+		{"bytes=-2000", &byteRange{0, 1000}, nil},
+		{"bytes=1000-", nil, errUnsatisfiableRange},
+		{"bytes=-0", nil, errUnsatisfiableRange},
+		{"bytes=0-1,5-9", nil, nil},
+		{"bytes=9-1", nil, nil},
+		{"items=0-1", nil, nil},
+		{"bytes=a-b", nil, nil},
+	}
+	for _, test := range tests {
+		got, err := parseRange(test.header, size)
+		if err != test.err {
+			t.Fatalf("%q: expected error %v, got %v", test.header, test.err, err)
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Fatalf("%q: expected %+v, got %+v", test.header, test.want, got)
+		}
+	}
+	if cr := (byteRange{900, 100}).contentRange(size); cr != "bytes 900-999/1000" {
+		t.Fatalf("unexpected Content-Range %s", cr)
+	}
+}
@@ -14,10 +14,15 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	. "net/http"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,9 +33,10 @@ import (
 
 type ProxyRoundTripper struct {
 	Round     *Transport
-	Round2    RoundTripper
 	P2PClient *eagleclient.BtEngine
 	Rules     []string
+
+	fallbacks fallbackLog
 }
 
 var proxyRoundTripper *ProxyRoundTripper
@@ -50,7 +56,6 @@ func NewProxyRoundTripper(eagleClient *eagleclient.BtEngine, rules []string) *Pr
 				ExpectContinueTimeout: 1 * time.Second,
 				TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
 			},
-			Round2:    NewFileTransport(Dir("/")),
 			P2PClient: eagleClient,
 			Rules:     rules,
 		}
@@ -93,10 +98,18 @@ func (prt *ProxyRoundTripper) RoundTrip(req *Request) (*Response, error) {
 	urlString := req.URL.String()
 	if prt.needUseP2PClient(req, urlString) {
 		log.Debugf("try to get blob: %s through p2p based image distribution system ...", urlString)
-		if res, err := prt.download(req, urlString); err == nil {
+		res, err := prt.download(req, urlString)
+		if err == nil {
 			return res, err
 		}
-		log.Errorf("failed to get blob: %s from p2p based image distribution system, let's switch to original request ...", urlString)
+		// blob not found by seeder only means its own origin doesn't serve it,
+		// the requested registry may still do so, e.g. with client credentials
+		prt.fallbacks.add(Fallback{Time: time.Now(), URL: urlString, Reason: err.Error()})
+		if eagleclient.IsDigestMismatch(err) {
+			log.Errorf("blob: %s got through p2p based image distribution system is corrupt: %v, let's switch to original request ...", urlString, err)
+		} else {
+			log.Errorf("failed to get blob: %s from p2p based image distribution system, let's switch to original request ...", urlString)
+		}
 	}
 
 	req.Host = req.URL.Host
@@ -105,24 +118,75 @@ func (prt *ProxyRoundTripper) RoundTrip(req *Request) (*Response, error) {
 	return res, err
 }
 
+// download returns a streaming response of blob as soon as its metainfo is
+// loaded, so that client can start extracting while the blob is downloading.
+// Ranged requests, e.g. of resumed pulls, are answered with the requested
+// range only, whose pieces are prioritised over the rest of blob.
 func (prt *ProxyRoundTripper) download(req *Request, urlString string) (*Response, error) {
 	//use P2PClient to download
-	if dstPath, err := prt.P2PClient.DownloadLayer(req, urlString); err == nil {
-		// defer os.Remove(dstPath)
-		if fileReq, err := NewRequest("GET", "file:///"+dstPath, nil); err == nil {
-			response, err := prt.Round2.RoundTrip(fileReq)
-			if err == nil {
-				response.Header.Set("Content-Disposition", "attachment; filename="+dstPath)
-			} else {
-				log.Errorf("read response from file: %s error: %v", dstPath, err)
-			}
-			return response, err
-		} else {
-			return nil, err
-		}
-	} else {
+	layer, size, err := prt.P2PClient.OpenLayer(req, urlString)
+	if err != nil {
 		log.Errorf("download fail: %v", err)
 		return nil, err
 	}
-	return nil, nil
+	res := &Response{
+		Status:        "200 OK",
+		StatusCode:    StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        Header{"Content-Type": []string{"application/octet-stream"}, "Accept-Ranges": []string{"bytes"}},
+		Body:          &layerBody{ctx: req.Context(), layer: layer},
+		ContentLength: size,
+		Request:       req,
+	}
+	ra, err := parseRange(req.Header.Get("Range"), size)
+	if err != nil {
+		layer.Close()
+		log.Infof("range %s of blob: %s of %d bytes is not satisfiable", req.Header.Get("Range"), urlString, size)
+		res.Status, res.StatusCode = "416 Requested Range Not Satisfiable", StatusRequestedRangeNotSatisfiable
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		res.Body, res.ContentLength = ioutil.NopCloser(strings.NewReader("")), 0
+		return res, nil
+	}
+	if ra == nil {
+		return res, nil
+	}
+	if _, err := layer.Seek(ra.start, io.SeekStart); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	// prioritise exactly the pieces covering the range
+	if r, ok := layer.(interface{ SetReadahead(int64) }); ok {
+		r.SetReadahead(ra.length)
+	}
+	log.Debugf("serve range %s of blob: %s", ra.contentRange(size), urlString)
+	res.Status, res.StatusCode = "206 Partial Content", StatusPartialContent
+	res.Header.Set("Content-Range", ra.contentRange(size))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(res.Body, ra.length), res.Body}
+	res.ContentLength = ra.length
+	return res, nil
+}
+
+// layerBody reads layer as response body, aborting reads blocked on
+// downloading pieces once the request is canceled
+type layerBody struct {
+	ctx   context.Context
+	layer eagleclient.LayerReader
+}
+
+func (b *layerBody) Read(p []byte) (int, error) {
+	if r, ok := b.layer.(interface {
+		ReadContext(context.Context, []byte) (int, error)
+	}); ok {
+		return r.ReadContext(b.ctx, p)
+	}
+	return b.layer.Read(p)
+}
+
+func (b *layerBody) Close() error {
+	return b.layer.Close()
 }
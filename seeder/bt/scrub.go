@@ -0,0 +1,95 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+	log "github.com/sirupsen/logrus"
+)
+
+// scrubSource implements scrubber.Source for blobs held by seeder storage backend.
+type scrubSource struct {
+	*Seeder
+}
+
+func (s scrubSource) Blobs() ([]string, error) {
+	files, err := s.storage.List(s.storage.GetDataDir())
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		id, ok := layerID(f.Name)
+		if !ok {
+			continue
+		}
+		// skip layers in progress
+		if entry, exist := s.lruCache.Peek(id); exist && entry.Completed {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s scrubSource) Open(id string) (io.ReadCloser, int64, error) {
+	f := s.storage.GetFilePath(id)
+	fi, err := s.storage.Stat(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(backend.NewReader(s.storage, f, fi.Length)), fi.Length, nil
+}
+
+func (s scrubSource) Stat(id string) (int64, error) {
+	fi, err := s.storage.Stat(s.storage.GetFilePath(id))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Length, nil
+}
+
+func (s scrubSource) Info(id string) (*metainfo.Info, error) {
+	content, err := s.storage.Download(s.storage.GetTorrentFilePath(id))
+	if backenderrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mi, err := metainfo.Load(bytes.NewReader(content))
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, id, err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrCorrupt, id, err)
+	}
+	return &info, nil
+}
+
+// Quarantine stops seeding corrupt layer and removes it, so that it is
+// fetched from origin again on next request.
+func (s scrubSource) Quarantine(id string, reason error) {
+	log.Errorf("Quarantine corrupt layer %s: %v", id, reason)
+	// evicting from lruCache drops torrent and removes files as well
+	if !s.lruCache.Remove(id) {
+		s.DeleteTorrent(id)
+	}
+}
@@ -14,15 +14,16 @@
 package bt
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/duyanghao/eagle/pkg/constants"
 	pb "github.com/duyanghao/eagle/proto/metainfo"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -32,7 +33,12 @@ import (
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
 	"github.com/duyanghao/eagle/lib/backend/fsbackend"
+	_ "github.com/duyanghao/eagle/lib/backend/middleware"
+	_ "github.com/duyanghao/eagle/lib/backend/registrybackend"
+	"github.com/duyanghao/eagle/pkg/peerauth"
+	"github.com/duyanghao/eagle/pkg/scrubber"
 	"github.com/duyanghao/eagle/pkg/utils/lrucache"
 	"github.com/duyanghao/eagle/pkg/utils/process"
 	distdigests "github.com/opencontainers/go-digest"
@@ -50,6 +56,10 @@ type Config struct {
 	DownloadRateLimit int
 	CacheLimitSize    int64
 	DownloadTimeout   time.Duration
+	ScrubInterval     time.Duration
+	ScrubRateLimit    int64
+	// authentication of peers, shared with eagleclient, disabled if nil
+	PeerAuth *peerauth.Config
 }
 
 // Seeder backed by anacrolix/torrent
@@ -63,9 +73,18 @@ type Seeder struct {
 	trackers   []string
 	origin     string
 	storage    backend.Storage
+	progress   *process.Reporter
+	scrubber   *scrubber.Scrubber
+
+	layersLock sync.Mutex
+	checking   map[string]bool          // layer digest -> verifying layer reported corrupt
+	removing   map[string]chan struct{} // layer digest -> closed once its files are removed
+
+	// storage of seeding torrents, nil if torrent client reads flat fs layout
+	torrentStorage *torrentStorage
 }
 
-func NewSeeder(root, storage, origin string, trackers []string, c *Config) (*Seeder, error) {
+func NewSeeder(storage string, storageCfg, authCfg interface{}, origin string, trackers []string, middlewares []backend.MiddlewareConfig, c *Config) (*Seeder, error) {
 	if c == nil {
 		c = &Config{
 			EnableUpload:      true,
@@ -76,11 +95,12 @@ func NewSeeder(root, storage, origin string, trackers []string, c *Config) (*See
 		}
 	}
 	// Create storage backend
-	backendCfg := fsbackend.Config{RootDirectory: root}
-	s, err := backend.GetStorageBackend(storage, backendCfg, nil)
+	s, err := backend.GetStorageBackend(storage, storageCfg, authCfg, middlewares...)
 	if err != nil {
 		return nil, err
 	}
+	progress := process.NewReporter()
+	progress.Subscribe(process.NewLogListener(constants.DefaultProgressLogInterval))
 	return &Seeder{
 		trackers: trackers,
 		origin:   origin,
@@ -99,7 +119,8 @@ func NewSeeder(root, storage, origin string, trackers []string, c *Config) (*See
 				IdleConnTimeout:     90 * time.Second,
 			},
 		},
-		storage: s,
+		storage:  s,
+		progress: progress,
 	}, nil
 }
 
@@ -111,18 +132,37 @@ func (s *Seeder) Run() error {
 
 	tc := torrent.NewDefaultClientConfig()
 	tc.DataDir = s.storage.GetDataDir()
+	// flat fs layout keeps layers where file storage of torrent client expects
+	// them, which keeps files open, other backends are read through storage
+	if fs, ok := s.storage.(*fsbackend.Storage); !ok || fs.Layout() != fsbackend.LayoutFlat {
+		s.torrentStorage = newTorrentStorage(s.storage, constants.DefaultPieceCacheSize)
+		tc.DefaultStorage = s.torrentStorage
+	}
 	tc.NoUpload = !c.EnableUpload
 	tc.Seed = c.EnableSeeding
 	tc.DisableUTP = true
 	tc.ListenPort = c.IncomingPort
+	if c.PeerAuth != nil {
+		// peers are only served through authenticated socket
+		peerauth.Apply(tc)
+	}
 
 	client, err := torrent.NewClient(tc)
 	if err != nil {
 		return err
 	}
+	if c.PeerAuth != nil {
+		if _, err = peerauth.Listen(client, c.PeerAuth, c.IncomingPort); err != nil {
+			client.Close()
+			return fmt.Errorf("Listen for authenticated peers failed: %v", err)
+		}
+	}
 
 	s.client = client
 
+	// report progress of downloads to metrics
+	s.progress.PublishExpvar("seeder_downloads")
+
 	// create lruCache
 	s.lruCache, err = lrucache.NewLRU(c.CacheLimitSize, s.DeleteTorrent)
 	if err != nil {
@@ -137,19 +177,24 @@ func (s *Seeder) Run() error {
 
 	for _, f := range files {
 		go func(f *backend.FileInfo) {
-			if filepath.Ext(f.Name) != ".layer" {
+			if ext := filepath.Ext(f.Name); ext != "" && ext != layerSuffix {
 				return
 			}
-			ss := strings.Split(f.Name, ".")
-			if len(ss) != 2 {
+			id, ok := layerID(f.Name)
+			if !ok {
 				log.Errorf("Found invalid layer file %s", f.Name)
 				return
 			}
 
-			id := ss[0]
 			df := s.storage.GetFilePath(id)
 
-			if _, err = s.storage.Stat(df); err != nil {
+			fi, err := s.storage.Stat(df)
+			if err != nil {
+				return
+			}
+			if !s.layerComplete(id, fi.Length) {
+				log.Errorf("Found incomplete layer %s of %d bytes, try to remove it", id, fi.Length)
+				s.removeLayer(id)
 				return
 			}
 
@@ -158,7 +203,7 @@ func (s *Seeder) Run() error {
 				return
 			}
 			s.lruCache.CreateIfNotExists(id)
-			s.lruCache.SetComplete(id, f.Length)
+			s.lruCache.SetComplete(id, fi.Length)
 		}(f)
 	}
 
@@ -169,6 +214,15 @@ func (s *Seeder) Run() error {
 		}
 	}()
 
+	// verify stored layers in background, and layers reported corrupt by clients
+	s.scrubber = scrubber.New("seeder", scrubSource{s}, scrubber.Config{
+		Interval:  c.ScrubInterval,
+		RateLimit: c.ScrubRateLimit,
+	})
+	if c.ScrubInterval > 0 {
+		s.scrubber.Start()
+	}
+
 	return nil
 }
 
@@ -189,17 +243,25 @@ func (s *Seeder) getDataFromOrigin(reqUrl string) ([]byte, error) {
 	// use httpClient to send request
 	rsp, err := s.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, backenderrors.New(backenderrors.ErrUnavailable, endpoint, err)
 	}
 	// close the connection to reuse it
 	defer rsp.Body.Close()
 	// check status code
-	if rsp.StatusCode != http.StatusOK {
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return nil, backenderrors.New(backenderrors.ErrBlobNotFound, endpoint, fmt.Errorf("origin rsp status: %s", rsp.Status))
+	case rsp.StatusCode >= http.StatusInternalServerError || rsp.StatusCode == http.StatusTooManyRequests:
+		return nil, backenderrors.New(backenderrors.ErrUnavailable, endpoint, fmt.Errorf("origin rsp status: %s", rsp.Status))
+	case rsp.StatusCode != http.StatusOK:
 		return nil, fmt.Errorf("GetDataFromOrigin rsp error: %v", rsp)
 	}
 	// parse rsp body
 	t, err := ioutil.ReadAll(rsp.Body)
-	return t, err
+	if err != nil {
+		return nil, backenderrors.New(backenderrors.ErrUnavailable, endpoint, err)
+	}
+	return t, nil
 }
 
 // getMetaData generates layer file and its relevant torrent
@@ -213,6 +275,7 @@ func (s *Seeder) getMetaData(ctx context.Context, reqUrl, id string) (int, error
 	}
 	// step2 - generate layerFile
 	log.Debugf("Start to generate dataFile of layer: %s ...", id)
+	s.waitRemoval(id)
 	layerFile := s.storage.GetFilePath(id)
 	err = s.storage.Upload(layerFile, data)
 	if err != nil {
@@ -236,12 +299,14 @@ Execute:
 			if _, err := s.storage.Stat(torrentFile); err != nil {
 				log.Errorf("Failed to find torrent file of cached layer: %s, try to remove its relevant records", id)
 				s.lruCache.Remove(id)
-				return err
+				// layer is missing from local cache rather than origin, let client retry
+				return backenderrors.New(backenderrors.ErrUnavailable, id, err)
 			}
 			if _, err := s.storage.Stat(layerFile); err != nil {
 				log.Errorf("Failed to find data file of cached layer: %s, try to remove its relevant records", id)
 				s.lruCache.Remove(id)
-				return err
+				// layer is missing from local cache rather than origin, let client retry
+				return backenderrors.New(backenderrors.ErrUnavailable, id, err)
 			}
 			log.Infof("Layer: %s has been cached, return directly", id)
 			return nil
@@ -282,7 +347,7 @@ Execute:
 				s.lruCache.SetComplete(id, int64(size))
 			}
 		case <-time.After(s.config.DownloadTimeout * time.Second):
-			err = fmt.Errorf("GetMetaData layer: %s timeout %s", id, s.config.DownloadTimeout)
+			err = backenderrors.New(backenderrors.ErrUnavailable, id, fmt.Errorf("GetMetaData layer timeout %s", s.config.DownloadTimeout))
 			log.Errorf("GetMetaData layer: %s timeout %s, %v, try to remove its relevant records ...", id, s.config.DownloadTimeout, err)
 			s.storage.Delete(torrentFile)
 			s.storage.Delete(layerFile)
@@ -292,24 +357,59 @@ Execute:
 	}
 }
 
-// GetMetaData get torrent of layer
+// GetMetaData get torrent of layer, errors are returned as gRPC status
+// carrying the code of relevant backenderrors kind
 func (s *Seeder) GetMetaInfo(ctx context.Context, metaInfoReq *pb.MetaInfoRequest) (*pb.MetaInfoReply, error) {
 	log.Debugf("Access: %s", metaInfoReq.Url)
 	digest := metaInfoReq.Url[strings.LastIndex(metaInfoReq.Url, "/")+1:]
 	id := distdigests.Digest(digest).Encoded()
+	if metaInfoReq.Refetch {
+		s.checkLayer(id)
+	}
 	log.Debugf("Start to get metadata of layer %s", id)
 	err := s.getMetaDataSync(metaInfoReq.Url, id)
 	if err != nil {
-		return nil, fmt.Errorf("Get metainfo from origin failed: %v", err)
+		return nil, backenderrors.ToStatus(fmt.Errorf("Get metainfo from origin failed: %w", err))
 	}
 	torrentFile := s.storage.GetTorrentFilePath(id)
 	content, err := s.storage.Download(torrentFile)
 	if err != nil {
-		return nil, fmt.Errorf("Download metainfo file failed: %v", err)
+		return nil, backenderrors.ToStatus(fmt.Errorf("Download metainfo file failed: %w", err))
 	}
 	return &pb.MetaInfoReply{Metainfo: content}, nil
 }
 
+// checkLayer verifies stored layer id reported corrupt by a client, and
+// quarantines it if so, so that it is fetched from origin again. Reports of
+// a layer being verified already are ignored.
+func (s *Seeder) checkLayer(id string) {
+	s.layersLock.Lock()
+	if s.checking == nil {
+		s.checking = make(map[string]bool)
+	}
+	if s.checking[id] {
+		s.layersLock.Unlock()
+		return
+	}
+	s.checking[id] = true
+	s.layersLock.Unlock()
+	defer func() {
+		s.layersLock.Lock()
+		delete(s.checking, id)
+		s.layersLock.Unlock()
+	}()
+
+	if entry, exist := s.lruCache.Peek(id); !exist || !entry.Completed {
+		return
+	}
+	log.Warnf("Layer %s is reported corrupt by client, verify it ...", id)
+	if err := s.scrubber.Verify(id); backenderrors.IsCorrupt(err) {
+		scrubSource{s}.Quarantine(id, err)
+	} else if err != nil {
+		log.Errorf("Verify layer %s reported corrupt failed: %v", id, err)
+	}
+}
+
 // StartSeed seeds relevant blob
 func (s *Seeder) StartSeed(ctx context.Context, id string) error {
 	tf := s.storage.GetTorrentFilePath(id)
@@ -341,10 +441,8 @@ func (s *Seeder) StartSeed(ctx context.Context, id string) error {
 		log.Infof("Start torrent %v of layer %s success", tt.InfoHash(), id)
 	}()
 
-	p := process.NewProgressDownload(id, int(tt.Info().TotalLength()), os.Stdout)
-	if p != nil {
-		p.WaitComplete(ctx, tt)
-	}
+	p := process.NewProgressDownload(id, tt.Info().TotalLength(), s.progress)
+	p.WaitComplete(ctx, tt)
 
 	return nil
 }
@@ -354,19 +452,85 @@ func (s *Seeder) DeleteTorrent(id string) {
 	s.deleteTorrent(id)
 
 	// remove data file and torrent file asynchronously
+	s.layersLock.Lock()
+	if s.removing == nil {
+		s.removing = make(map[string]chan struct{})
+	}
+	done := make(chan struct{})
+	s.removing[id] = done
+	s.layersLock.Unlock()
 	go func() {
-		tf := s.storage.GetTorrentFilePath(id)
-		if err := s.storage.Delete(tf); err != nil && !os.IsNotExist(err) {
-			log.Errorf("Remove torrent file %s failed: %v", tf, err)
-		}
-
-		df := s.storage.GetFilePath(id)
-		if err := s.storage.Delete(df); err != nil && !os.IsNotExist(err) {
-			log.Errorf("Remove layer file %s failed: %v", df, err)
+		s.removeLayer(id)
+		s.layersLock.Lock()
+		if s.removing[id] == done {
+			delete(s.removing, id)
 		}
+		s.layersLock.Unlock()
+		close(done)
 	}()
 }
 
+// waitRemoval waits for files of layer id being removed, so that layer
+// fetched again isn't removed with them.
+func (s *Seeder) waitRemoval(id string) {
+	s.layersLock.Lock()
+	done, ok := s.removing[id]
+	s.layersLock.Unlock()
+	if ok {
+		<-done
+	}
+}
+
+// removeLayer removes torrent file and data file of layer
+func (s *Seeder) removeLayer(id string) {
+	tf := s.storage.GetTorrentFilePath(id)
+	if err := s.storage.Delete(tf); err != nil && !backenderrors.IsNotFound(err) {
+		log.Errorf("Remove torrent file %s failed: %v", tf, err)
+	}
+
+	df := s.storage.GetFilePath(id)
+	if err := s.storage.Delete(df); err != nil && !backenderrors.IsNotFound(err) {
+		log.Errorf("Remove layer file %s failed: %v", df, err)
+	}
+	// pieces read since torrent was dropped
+	s.purgePieces(id)
+}
+
+// purgePieces drops cached pieces of layer id.
+func (s *Seeder) purgePieces(id string) {
+	if s.torrentStorage != nil {
+		s.torrentStorage.purge(id)
+	}
+}
+
+// layerComplete checks layer of length bytes found at startup against its
+// torrent. Layers written before writes became crash-consistent may have
+// been truncated by power loss while their torrents are intact.
+func (s *Seeder) layerComplete(id string, length int64) bool {
+	if length <= 0 {
+		return false
+	}
+	content, err := s.storage.Download(s.storage.GetTorrentFilePath(id))
+	if backenderrors.IsNotFound(err) {
+		// torrent will be created from layer
+		return true
+	} else if err != nil {
+		log.Errorf("Download torrent file of layer %s failed: %v", id, err)
+		return false
+	}
+	mi, err := metainfo.Load(bytes.NewReader(content))
+	if err != nil {
+		log.Errorf("Load torrent file of layer %s failed: %v", id, err)
+		return false
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		log.Errorf("Unmarshal torrent info of layer %s failed: %v", id, err)
+		return false
+	}
+	return info.TotalLength() == length
+}
+
 func (s *Seeder) deleteTorrent(id string) {
 	s.Lock()
 	defer s.Unlock()
@@ -374,14 +538,27 @@ func (s *Seeder) deleteTorrent(id string) {
 		tt.Drop()
 	}
 	delete(s.idInfos, id)
+	s.purgePieces(id)
 }
 
 func (s *Seeder) createTorrent(id string) error {
+	f := s.storage.GetFilePath(id)
+	fi, err := s.storage.Stat(f)
+	if err != nil {
+		return fmt.Errorf("Create torrent file for %s failed: %v", f, err)
+	}
+	// Name data file of torrent regardless of backend layout,
+	// since peers store layer data under this name
 	info := metainfo.Info{
 		PieceLength: constants.DefaultMetaInfoPieceLength,
+		Name:        id + layerSuffix,
+		Length:      fi.Length,
 	}
-	f := s.storage.GetFilePath(id)
-	err := info.BuildFromFilePath(f)
+	// Generate pieces from content read through backend, which may
+	// differ from what is kept in backend, e.g. encrypted
+	err = info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+		return ioutil.NopCloser(backend.NewReader(s.storage, f, fi.Length)), nil
+	})
 	if err != nil {
 		return fmt.Errorf("Create torrent file for %s failed: %v", f, err)
 	}
@@ -0,0 +1,229 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bt
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+const layerSuffix = ".layer"
+
+// layerID returns layer id of a file name listed from storage backend, which
+// is either <id>.layer or <id> depending on backend layout.
+func layerID(name string) (string, bool) {
+	id := strings.TrimSuffix(name, layerSuffix)
+	if id == "" || strings.Contains(id, ".") {
+		return "", false
+	}
+	return id, true
+}
+
+// torrentStorage implements storage.ClientImpl on top of backend.Storage, so
+// that data of seeding torrents is resolved through the backend instead of
+// assuming a fixed location. Pieces are read from backend as a whole and
+// cached, since peers request them in small chunks.
+type torrentStorage struct {
+	storage backend.Storage
+	pieces  *pieceCache
+}
+
+func newTorrentStorage(s backend.Storage, cacheSize int64) *torrentStorage {
+	return &torrentStorage{storage: s, pieces: newPieceCache(cacheSize)}
+}
+
+// purge drops cached pieces of layer id, so that pieces of a layer removed,
+// e.g. quarantined as corrupt, aren't served once it is fetched again.
+func (ts *torrentStorage) purge(id string) {
+	ts.pieces.purge(id)
+}
+
+func (ts *torrentStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	id, ok := layerID(info.Name)
+	if !ok {
+		return nil, errors.New("invalid layer name " + info.Name)
+	}
+	// pieces are complete only if the whole layer is held by backend
+	fi, err := ts.storage.Stat(ts.storage.GetFilePath(id))
+	complete := err == nil && fi.Length == info.TotalLength()
+	return &torrentImpl{storage: ts.storage, pieces: ts.pieces, id: id, complete: complete}, nil
+}
+
+type torrentImpl struct {
+	storage  backend.Storage
+	pieces   *pieceCache
+	id       string
+	complete bool
+}
+
+func (t *torrentImpl) Piece(p metainfo.Piece) storage.PieceImpl {
+	return &pieceImpl{torrentImpl: t, p: p}
+}
+
+// Close is called once torrent is dropped.
+func (t *torrentImpl) Close() error {
+	t.pieces.purge(t.id)
+	return nil
+}
+
+// pieceImpl serves piece data of a layer held by the seeder. Layers are
+// complete before being seeded, so pieces are never written.
+type pieceImpl struct {
+	*torrentImpl
+	p metainfo.Piece
+}
+
+func (p *pieceImpl) ReadAt(b []byte, off int64) (n int, err error) {
+	n, err = p.readAt(b, off)
+	if backenderrors.IsNotFound(err) {
+		// Layer may have been moved by backend in the meantime, resolve it again
+		n, err = p.readAt(b, off)
+	}
+	return
+}
+
+func (p *pieceImpl) readAt(b []byte, off int64) (int, error) {
+	if off < 0 || off > p.p.Length() {
+		return 0, fmt.Errorf("offset %d out of piece %d of %d bytes", off, p.p.Index(), p.p.Length())
+	}
+	if int64(len(b)) > p.p.Length()-off {
+		b = b[:p.p.Length()-off]
+	}
+	data, err := p.pieces.get(pieceKey{id: p.id, index: p.p.Index()}, func() ([]byte, error) {
+		return p.storage.DownloadRange(p.storage.GetFilePath(p.id), p.p.Offset(), p.p.Length())
+	})
+	if err != nil {
+		return 0, err
+	}
+	if off >= int64(len(data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(b, data[off:])
+	if n < len(b) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func (p *pieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	return 0, errors.New("seeder storage is read-only")
+}
+
+func (p *pieceImpl) MarkComplete() error {
+	return nil
+}
+
+func (p *pieceImpl) MarkNotComplete() error {
+	return nil
+}
+
+func (p *pieceImpl) Completion() storage.Completion {
+	return storage.Completion{Complete: p.complete, Ok: true}
+}
+
+type pieceKey struct {
+	id    string
+	index int
+}
+
+type cachedPiece struct {
+	key   pieceKey
+	data  []byte
+	err   error
+	ready chan struct{}
+	// bytes accounted in cache size, zero while loading
+	size int64
+}
+
+// pieceCache keeps recently read pieces up to capacity bytes. Concurrent
+// reads of a piece missing from cache share a single backend call.
+type pieceCache struct {
+	capacity int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[pieceKey]*list.Element
+}
+
+func newPieceCache(capacity int64) *pieceCache {
+	return &pieceCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[pieceKey]*list.Element),
+	}
+}
+
+// get returns data of piece key, loading it by load if it isn't cached.
+// Failed loads aren't cached.
+func (c *pieceCache) get(key pieceKey, load func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if ent, ok := c.items[key]; ok {
+		c.lru.MoveToFront(ent)
+		c.mu.Unlock()
+		piece := ent.Value.(*cachedPiece)
+		<-piece.ready
+		return piece.data, piece.err
+	}
+	piece := &cachedPiece{key: key, ready: make(chan struct{})}
+	ent := c.lru.PushFront(piece)
+	c.items[key] = ent
+	c.mu.Unlock()
+
+	piece.data, piece.err = load()
+
+	c.mu.Lock()
+	if c.items[key] == ent {
+		if piece.err != nil {
+			c.remove(ent)
+		} else {
+			piece.size = int64(len(piece.data))
+			c.size += piece.size
+		}
+	}
+	for c.size > c.capacity && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+	c.mu.Unlock()
+	close(piece.ready)
+	return piece.data, piece.err
+}
+
+// purge drops pieces of layer id. Pieces being loaded are dropped as well,
+// and aren't cached once loaded.
+func (c *pieceCache) purge(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, ent := range c.items {
+		if key.id == id {
+			c.remove(ent)
+		}
+	}
+}
+
+func (c *pieceCache) remove(ent *list.Element) {
+	piece := ent.Value.(*cachedPiece)
+	c.lru.Remove(ent)
+	delete(c.items, piece.key)
+	c.size -= piece.size
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 duyanghao
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bt
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/lib/backend/backenderrors"
+)
+
+// memBackend is an in-memory backend.Storage counting ranged reads.
+type memBackend struct {
+	blobs  map[string][]byte
+	ranges int
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{blobs: make(map[string][]byte)}
+}
+
+func (m *memBackend) CreateWithMetaInfo(name string, info *metainfo.MetaInfo) error { return nil }
+
+func (m *memBackend) Stat(name string) (*backend.FileInfo, error) {
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, backenderrors.New(backenderrors.ErrBlobNotFound, name, nil)
+	}
+	return &backend.FileInfo{Name: name, Length: int64(len(data))}, nil
+}
+
+func (m *memBackend) Upload(name string, data []byte) error {
+	m.blobs[name] = data
+	return nil
+}
+
+func (m *memBackend) Download(name string) ([]byte, error) {
+	return m.DownloadRange(name, 0, int64(len(m.blobs[name])))
+}
+
+func (m *memBackend) DownloadRange(name string, offset, length int64) ([]byte, error) {
+	m.ranges++
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, backenderrors.New(backenderrors.ErrBlobNotFound, name, nil)
+	}
+	if offset+length > int64(len(data)) {
+		length = int64(len(data)) - offset
+	}
+	return data[offset : offset+length], nil
+}
+
+func (m *memBackend) Delete(name string) error {
+	delete(m.blobs, name)
+	return nil
+}
+
+func (m *memBackend) List(prefix string) ([]*backend.FileInfo, error) { return nil, nil }
+func (m *memBackend) GetFilePath(id string) string                    { return "data/" + id }
+func (m *memBackend) GetTorrentFilePath(id string) string             { return "torrents/" + id }
+func (m *memBackend) GetDataDir() string                              { return "data" }
+func (m *memBackend) GetTorrentDir() string                           { return "torrents" }
+
+func TestPieceCache(t *testing.T) {
+	c := newPieceCache(10)
+	var mu sync.Mutex
+	loads := make(map[int]int)
+	load := func(index int) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			mu.Lock()
+			loads[index]++
+			mu.Unlock()
+			return bytes.Repeat([]byte{byte(index)}, 4), nil
+		}
+	}
+
+	// concurrent chunk reads of a piece share one load
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.get(pieceKey{"a", 0}, load(0)); err != nil || len(data) != 4 {
+				t.Errorf("got %v, %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if loads[0] != 1 {
+		t.Fatalf("got %d loads of piece, want 1", loads[0])
+	}
+
+	// capacity of 10 bytes holds 2 pieces, piece 0 is evicted as the oldest
+	c.get(pieceKey{"a", 1}, load(1))
+	c.get(pieceKey{"a", 2}, load(2))
+	c.get(pieceKey{"a", 0}, load(0))
+	if loads[0] != 2 || c.size != 8 {
+		t.Fatalf("got %d loads of evicted piece and cache size %d, want 2 and 8", loads[0], c.size)
+	}
+
+	c.get(pieceKey{"b", 0}, load(3))
+	c.purge("a")
+	if c.size != 4 || c.lru.Len() != 1 {
+		t.Fatalf("got cache size %d of %d pieces, want pieces of b only", c.size, c.lru.Len())
+	}
+}
+
+func TestPieceReadAt(t *testing.T) {
+	mem := newMemBackend()
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	mem.blobs[mem.GetFilePath("blob")] = content
+	info := &metainfo.Info{Name: "blob.layer", PieceLength: 32, Length: int64(len(content))}
+	ts := newTorrentStorage(mem, 1024)
+	tt, err := ts.OpenTorrent(info, metainfo.Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < info.NumPieces(); index++ {
+		p := tt.Piece(info.Piece(index))
+		if !p.Completion().Complete {
+			t.Fatalf("expected piece %d complete", index)
+		}
+		length := info.Piece(index).Length()
+		for off := int64(0); off < length; off += 8 {
+			b := make([]byte, 8)
+			n, err := p.ReadAt(b, off)
+			want := content[info.Piece(index).Offset()+off:]
+			if int64(len(want)) > length-off {
+				want = want[:length-off]
+			}
+			if len(want) > 8 {
+				want = want[:8]
+			}
+			if err != nil || !bytes.Equal(b[:n], want) {
+				t.Fatalf("piece %d at %d: got %q, %v, want %q", index, off, b[:n], err, want)
+			}
+		}
+	}
+	if got, want := mem.ranges, info.NumPieces(); got != want {
+		t.Fatalf("got %d backend reads, want one per piece %d", got, want)
+	}
+
+	p := tt.Piece(info.Piece(0))
+	for _, off := range []int64{-1, info.Piece(0).Length() + 1} {
+		if _, err := p.ReadAt(make([]byte, 8), off); err == nil {
+			t.Fatalf("expected error of reading at %d", off)
+		}
+	}
+
+	// layer fetched again after removal isn't served from cache
+	fresh := bytes.Repeat([]byte("abcdefghij"), 10)
+	mem.blobs[mem.GetFilePath("blob")] = fresh
+	ts.purge("blob")
+	b := make([]byte, 8)
+	if _, err := p.ReadAt(b, 0); err != nil || !bytes.Equal(b, fresh[:8]) {
+		t.Fatalf("got %q, %v, want %q", b, err, fresh[:8])
+	}
+}
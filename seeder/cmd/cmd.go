@@ -22,6 +22,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"net"
+	"net/http"
 	"time"
 )
 
@@ -61,8 +62,13 @@ func Run(flags *Flags) {
 		IncomingPort:    config.SeederCfg.Port,
 		DownloadTimeout: time.Duration(config.SeederCfg.DownloadTimeout),
 		CacheLimitSize:  ratelimiter.RateConvert(config.SeederCfg.LimitSize),
+		ScrubInterval:   time.Duration(config.SeederCfg.ScrubInterval) * time.Second,
+		PeerAuth:        config.SeederCfg.PeerAuth,
 	}
-	seeder, err := bt.NewSeeder(config.SeederCfg.RootDirectory, config.SeederCfg.StorageBackend, config.SeederCfg.Origin, config.SeederCfg.Trackers, c)
+	if config.SeederCfg.ScrubRateLimit != "" {
+		c.ScrubRateLimit = ratelimiter.RateConvert(config.SeederCfg.ScrubRateLimit)
+	}
+	seeder, err := bt.NewSeeder(config.SeederCfg.Storage.Backend, config.SeederCfg.Storage.Config, config.SeederCfg.Storage.Auth, config.SeederCfg.Origin, config.SeederCfg.Trackers, config.SeederCfg.StorageMiddlewares, c)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,6 +78,16 @@ func Run(flags *Flags) {
 	}
 	log.Infof("Start seeder bt on port: %d successfully", config.SeederCfg.Port)
 
+	// expose expvar metrics, e.g. storage backend metrics middleware
+	if config.DaemonCfg.MetricsPort > 0 {
+		log.Infof("Launch seeder metrics on port: %d", config.DaemonCfg.MetricsPort)
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", config.DaemonCfg.MetricsPort), nil); err != nil {
+				log.Errorf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
 	// start seeder
 	log.Infof("Launch seeder on port: %d", config.DaemonCfg.Port)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.DaemonCfg.Port))
@@ -17,23 +17,44 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"github.com/duyanghao/eagle/lib/backend"
+	"github.com/duyanghao/eagle/pkg/peerauth"
 	"github.com/duyanghao/eagle/pkg/utils/ratelimiter"
 	"gopkg.in/yaml.v2"
 )
 
 type SeederCfg struct {
-	RootDirectory   string   `yaml:"rootDirectory,omitempty"`
-	Origin          string   `yaml:"origin,omitempty"`
-	Trackers        []string `yaml:"trackers,omitempty"`
-	LimitSize       string   `yaml:"limitSize,omitempty"`
-	DownloadTimeout int      `yaml:"downloadTimeout,omitempty"`
-	StorageBackend  string   `yaml:"storageBackend,omitempty"`
-	Port            int      `yaml:"port,omitempty"`
+	RootDirectory      string                     `yaml:"rootDirectory,omitempty"`
+	Origin             string                     `yaml:"origin,omitempty"`
+	Trackers           []string                   `yaml:"trackers,omitempty"`
+	LimitSize          string                     `yaml:"limitSize,omitempty"`
+	DownloadTimeout    int                        `yaml:"downloadTimeout,omitempty"`
+	StorageBackend     string                     `yaml:"storageBackend,omitempty"`
+	StorageLayout      string                     `yaml:"storageLayout,omitempty"`
+	Storage            *StorageCfg                `yaml:"storage,omitempty"`
+	StorageMiddlewares []backend.MiddlewareConfig `yaml:"storageMiddlewares,omitempty"`
+	ScrubInterval      int                        `yaml:"scrubInterval,omitempty"`
+	ScrubRateLimit     string                     `yaml:"scrubRateLimit,omitempty"`
+	Port               int                        `yaml:"port,omitempty"`
+
+	PeerAuth *peerauth.Config `yaml:"peerAuth,omitempty"`
+}
+
+// StorageCfg declares storage backend of seeder. Config and credentials
+// loaded from AuthFile are free-form here, and decoded by the schema
+// declared by backend.
+type StorageCfg struct {
+	Backend  string                 `yaml:"backend,omitempty"`
+	Config   map[string]interface{} `yaml:"config,omitempty"`
+	AuthFile string                 `yaml:"authFile,omitempty"`
+	// Auth holds credentials loaded from AuthFile
+	Auth map[string]interface{} `yaml:"-"`
 }
 
 type DaemonCfg struct {
-	Port    int  `yaml:"port,omitempty"`
-	Verbose bool `yaml:"verbose,omitempty"`
+	Port        int  `yaml:"port,omitempty"`
+	MetricsPort int  `yaml:"metricsPort,omitempty"`
+	Verbose     bool `yaml:"verbose,omitempty"`
 }
 
 type Config struct {
@@ -41,15 +62,56 @@ type Config struct {
 	DaemonCfg *DaemonCfg `yaml:"daemonCfg,omitempty"`
 }
 
+// complete fills storage section from legacy storage options, and loads
+// credentials of storage backend
+func (c *Config) complete() error {
+	if c.SeederCfg == nil || c.DaemonCfg == nil {
+		return fmt.Errorf("Both seederCfg and daemonCfg are required, please check ...")
+	}
+	sc := c.SeederCfg
+	if sc.Storage == nil {
+		sc.Storage = &StorageCfg{Backend: sc.StorageBackend}
+		if sc.StorageLayout != "" {
+			sc.Storage.Config = map[string]interface{}{"layout": sc.StorageLayout}
+		}
+	}
+	// rootDirectory of seeder is the default root directory of backend
+	if _, ok := sc.Storage.Config["rootDirectory"]; !ok && sc.RootDirectory != "" {
+		if sc.Storage.Config == nil {
+			sc.Storage.Config = make(map[string]interface{})
+		}
+		sc.Storage.Config["rootDirectory"] = sc.RootDirectory
+	}
+	if sc.Storage.AuthFile != "" {
+		contents, err := ioutil.ReadFile(sc.Storage.AuthFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read storage auth file: %s,error: %s", sc.Storage.AuthFile, err)
+		}
+		if err = yaml.Unmarshal(contents, &sc.Storage.Auth); err != nil {
+			return fmt.Errorf("Failed to parse storage auth file: %s,error: %s", sc.Storage.AuthFile, err)
+		}
+	}
+	return nil
+}
+
 // validate the configuration
 func (c *Config) validate() error {
-	if c.SeederCfg.RootDirectory == "" || c.SeederCfg.Origin == "" || c.SeederCfg.Port <= 0 ||
-		len(c.SeederCfg.Trackers) == 0 || c.SeederCfg.StorageBackend == "" {
+	if c.SeederCfg.Origin == "" || c.SeederCfg.Port <= 0 ||
+		len(c.SeederCfg.Trackers) == 0 || c.SeederCfg.Storage.Backend == "" {
 		return fmt.Errorf("Invalid seeder configurations, please check ...")
 	}
-	if !ratelimiter.ValidateRateLimiter(c.SeederCfg.LimitSize) {
+	if err := backend.ValidateStorageBackend(c.SeederCfg.Storage.Backend, c.SeederCfg.Storage.Config, c.SeederCfg.Storage.Auth); err != nil {
+		return fmt.Errorf("Invalid storage configurations: %s", err)
+	}
+	if !ratelimiter.ValidateRateLimiter(c.SeederCfg.LimitSize) ||
+		(c.SeederCfg.ScrubRateLimit != "" && !ratelimiter.ValidateRateLimiter(c.SeederCfg.ScrubRateLimit)) {
 		return fmt.Errorf("Invalid rate limiter format, please check ...")
 	}
+	if c.SeederCfg.PeerAuth != nil {
+		if err := c.SeederCfg.PeerAuth.Validate(); err != nil {
+			return fmt.Errorf("Invalid peer authentication configurations: %v", err)
+		}
+	}
 	if c.DaemonCfg.Port <= 0 {
 		return fmt.Errorf("Invalid daemon configurations, please check ...")
 	}
@@ -69,6 +131,9 @@ func LoadConfig(path string) (*Config, error) {
 	if err = yaml.Unmarshal(contents, c); err != nil {
 		return nil, fmt.Errorf("Failed to parse configuration,error: %s", err)
 	}
+	if err = c.complete(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration,error: %s", err)
+	}
 	if err = c.validate(); err != nil {
 		return nil, fmt.Errorf("Invalid configuration,error: %s", err)
 	}